@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+)
+
+// auditLog records every device change as a JSON line. It is nil unless an
+// audit log path is configured.
+var auditLog *slog.Logger
+
+// openAuditLog opens the configured audit log with rotation. It returns a nil
+// file when no path is set.
+func openAuditLog(config AuditConfig) (*RotatingFile, error) {
+	if config.Path == "" {
+		return nil, nil
+	}
+	file, err := OpenRotatingFile(config.Path, RotateOptions{
+		MaxSize:  int64(config.MaxSizeMB) << 20,
+		MaxAge:   config.MaxAge,
+		MaxFiles: config.MaxFiles,
+		Compress: config.Compress,
+	})
+	if err != nil {
+		return nil, err
+	}
+	auditLog = slog.New(slog.NewJSONHandler(file, nil))
+	return file, nil
+}
+
+// audit records a device change made by the identity in ctx.
+func audit(ctx context.Context, action string, device *Device) {
+	if auditLog == nil || device == nil {
+		return
+	}
+	identity := identityFrom(ctx)
+	auditLog.LogAttrs(ctx, slog.LevelInfo, "device change",
+		slog.String("action", action),
+		slog.String("device", device.ID),
+		slog.String("kind", device.Kind),
+		slog.String("identity", identity.Name),
+		slog.String("role", identity.Role),
+		slog.Any("state", device.State),
+		slog.String("request_id", requestIDFrom(ctx)),
+	)
+}
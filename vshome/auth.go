@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	roleAdmin = "admin"
+	roleUser  = "user"
+	// roleViewer may read everything and change nothing; see readonly.go.
+	roleViewer = "viewer"
+)
+
+// Identity is the caller a request was authenticated as.
+type Identity struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+var anonymousIdentity = Identity{Name: "anonymous"}
+
+// systemIdentity is used for writes the server makes on its own behalf.
+var systemIdentity = Identity{Name: "system", Role: roleAdmin}
+
+type identityKey struct{}
+
+func withIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// identityFrom returns the identity stored in ctx, or the anonymous identity.
+func identityFrom(ctx context.Context) Identity {
+	if identity, ok := ctx.Value(identityKey{}).(Identity); ok {
+		return identity
+	}
+	return anonymousIdentity
+}
+
+func systemContext() context.Context {
+	return withIdentity(context.Background(), systemIdentity)
+}
+
+type apiKey struct {
+	key      string
+	identity Identity
+}
+
+var apiKeys []apiKey
+
+// parseAPIKeys reads a comma-separated list of name:role:key entries, as
+// supplied through VSHOME_API_KEYS.
+func parseAPIKeys(spec string) ([]apiKey, error) {
+	var keys []apiKey
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("invalid api key entry %q, expected name:role:key", parts[0])
+		}
+		switch parts[1] {
+		case roleAdmin, roleUser, roleViewer:
+		default:
+			return nil, fmt.Errorf("unknown role %q for api key %s", parts[1], parts[0])
+		}
+		keys = append(keys, apiKey{key: parts[2], identity: Identity{Name: parts[0], Role: parts[1]}})
+	}
+	return keys, nil
+}
+
+func requestAPIKey(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		if token, ok := strings.CutPrefix(header, "Bearer "); ok {
+			return strings.TrimSpace(token)
+		}
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	// Browsers cannot set headers on WebSocket upgrades.
+	return r.URL.Query().Get("api_key")
+}
+
+// identityFromRequest resolves the caller of r. An API key wins over a client
+// certificate; requests with neither are anonymous, and requests with an
+// unknown key report ok=false.
+func identityFromRequest(r *http.Request) (Identity, bool) {
+	presented := requestAPIKey(r)
+	if presented == "" {
+		if identity, ok := certIdentity(r); ok {
+			return identity, true
+		}
+		return anonymousIdentity, true
+	}
+	for _, candidate := range apiKeys {
+		if subtle.ConstantTimeCompare([]byte(candidate.key), []byte(presented)) == 1 {
+			return candidate.identity, true
+		}
+	}
+	return Identity{}, false
+}
+
+// authenticate rejects requests presenting an unknown API key, and requests
+// other than reads from viewers, and records the caller's identity in the
+// request context.
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := identityFromRequest(r)
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		if identity.Role == roleViewer && !safeMethods[r.Method] {
+			writeError(w, http.StatusForbidden, "the viewer role is read-only")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), identity)))
+	})
+}
+
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := identityFromRequest(r)
+		if !ok || identity == anonymousIdentity {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		if identity.Role != roleAdmin {
+			writeError(w, http.StatusForbidden, "admin role required")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// clientCertTLS returns a TLS config that requires clients to present a
+// certificate signed by a CA in the PEM file at caPath.
+func clientCertTLS(caPath string) (*tls.Config, error) {
+	pem, err := os.ReadFile(filepath.Clean(caPath))
+	if err != nil {
+		return nil, fmt.Errorf("read client ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("client ca holds no PEM certificates")
+	}
+	return &tls.Config{ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert}, nil
+}
+
+// certIdentity derives the caller from r's verified client certificate: its
+// subject common name, with the admin role when an organizational unit is
+// "admin" and the user role otherwise.
+func certIdentity(r *http.Request) (Identity, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return Identity{}, false
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	identity := Identity{Name: subject.CommonName, Role: roleUser}
+	if identity.Name == "" {
+		identity.Name = subject.String()
+	}
+	for _, unit := range subject.OrganizationalUnit {
+		if unit == roleAdmin {
+			identity.Role = roleAdmin
+		}
+	}
+	return identity, true
+}
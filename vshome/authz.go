@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var errForbidden = errors.New("forbidden")
+
+// WriteAuthorizer decides whether identity may write state to device. A nil
+// error allows the write; denials should wrap errForbidden with a reason.
+// device must be treated as read-only.
+type WriteAuthorizer interface {
+	AuthorizeWrite(identity Identity, device *Device, state map[string]interface{}) error
+}
+
+// WritePredicate is a single per-device or per-kind authorization check.
+type WritePredicate func(identity Identity, device *Device, state map[string]interface{}) error
+
+// WriteRules is the default WriteAuthorizer. Every predicate registered for the
+// device's ID or kind must allow the write.
+type WriteRules struct {
+	byID   map[string][]WritePredicate
+	byKind map[string][]WritePredicate
+}
+
+var _ WriteAuthorizer = (*WriteRules)(nil)
+
+func NewWriteRules() *WriteRules {
+	return &WriteRules{
+		byID:   make(map[string][]WritePredicate),
+		byKind: make(map[string][]WritePredicate),
+	}
+}
+
+func (r *WriteRules) ForDevice(id string, predicate WritePredicate) {
+	r.byID[id] = append(r.byID[id], predicate)
+}
+
+func (r *WriteRules) ForKind(kind string, predicate WritePredicate) {
+	r.byKind[kind] = append(r.byKind[kind], predicate)
+}
+
+func (r *WriteRules) AuthorizeWrite(identity Identity, device *Device, state map[string]interface{}) error {
+	for _, predicate := range r.byKind[device.Kind] {
+		if err := predicate(identity, device, state); err != nil {
+			return err
+		}
+	}
+	for _, predicate := range r.byID[device.ID] {
+		if err := predicate(identity, device, state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteRuleConfig restricts writes to a device ID or to every device of a kind
+// to the listed roles and/or identity names.
+type WriteRuleConfig struct {
+	ID         string   `yaml:"id"`
+	Kind       string   `yaml:"kind"`
+	Roles      []string `yaml:"roles"`
+	Identities []string `yaml:"identities"`
+}
+
+// writeRulesFromConfig builds WriteRules from the write_rules catalog section.
+func writeRulesFromConfig(configs []WriteRuleConfig) (*WriteRules, error) {
+	rules := NewWriteRules()
+	for _, config := range configs {
+		if (config.ID == "") == (config.Kind == "") {
+			return nil, errors.New("write rule needs exactly one of id or kind")
+		}
+		if len(config.Roles) == 0 && len(config.Identities) == 0 {
+			return nil, fmt.Errorf("write rule for %s%s allows nobody", config.ID, config.Kind)
+		}
+		predicate := allowOnly(config.Roles, config.Identities)
+		if config.ID != "" {
+			rules.ForDevice(config.ID, predicate)
+		} else {
+			rules.ForKind(config.Kind, predicate)
+		}
+	}
+	return rules, nil
+}
+
+// addCommandAllowlist limits each listed device to writing only the given
+// state keys. An empty list makes the device read-only.
+func addCommandAllowlist(rules *WriteRules, allowlist map[string][]string) {
+	for id, keys := range allowlist {
+		rules.ForDevice(id, allowKeys(keys))
+	}
+}
+
+func allowKeys(keys []string) WritePredicate {
+	allowed := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		allowed[key] = struct{}{}
+	}
+	return func(identity Identity, device *Device, state map[string]interface{}) error {
+		for key := range state {
+			if _, ok := allowed[key]; !ok {
+				return fmt.Errorf("%w: %q may not be changed on this device", errForbidden, key)
+			}
+		}
+		return nil
+	}
+}
+
+func allowOnly(roles, names []string) WritePredicate {
+	var allowed []string
+	for _, role := range roles {
+		allowed = append(allowed, "role "+role)
+	}
+	allowed = append(allowed, names...)
+	reason := "only " + strings.Join(allowed, ", ") + " may change this device"
+	return func(identity Identity, device *Device, state map[string]interface{}) error {
+		for _, role := range roles {
+			if identity.Role == role {
+				return nil
+			}
+		}
+		for _, name := range names {
+			if identity.Name == name {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s", errForbidden, reason)
+	}
+}
+
+// authorizeWrite consults authorizer, if any, for the identity carried by ctx.
+func authorizeWrite(ctx context.Context, authorizer WriteAuthorizer, device *Device, state map[string]interface{}) error {
+	identity := identityFrom(ctx)
+	if identity.Role == roleViewer {
+		return fmt.Errorf("%w: the viewer role is read-only", errForbidden)
+	}
+	if authorizer == nil {
+		return nil
+	}
+	if identity == systemIdentity {
+		return nil
+	}
+	return authorizer.AuthorizeWrite(identity, cloneDevice(device), state)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// defaultBackfillSize is how many recent broadcasts the hub keeps for
+// reconnecting clients unless configured otherwise.
+const defaultBackfillSize = 256
+
+// backfillRing holds the most recent broadcasts, oldest first, so a client
+// reconnecting with ?since= can be sent the ones it missed. Guarded by the
+// hub's mu.
+type backfillRing struct {
+	size     int
+	seq      uint64
+	messages []WSMessage
+}
+
+// newBackfillRing numbers broadcasts on from the current time in
+// milliseconds, so sequence numbers keep increasing across restarts and a
+// seq from an earlier run is never mistaken for one of this run's.
+func newBackfillRing(size int) *backfillRing {
+	return &backfillRing{size: size, seq: uint64(time.Now().UnixMilli())}
+}
+
+// record numbers message and keeps it, dropping the oldest message once the
+// ring is full.
+func (b *backfillRing) record(message *WSMessage) {
+	b.seq++
+	message.Seq = b.seq
+	if b.size <= 0 {
+		return
+	}
+	if len(b.messages) == b.size {
+		copy(b.messages, b.messages[1:])
+		b.messages = b.messages[:len(b.messages)-1]
+	}
+	b.messages = append(b.messages, *message)
+}
+
+// since returns the messages broadcast after seq, or ok=false when the ring
+// no longer holds all of them or seq is not one the hub has sent.
+func (b *backfillRing) since(seq uint64) (missed []WSMessage, ok bool) {
+	if seq > b.seq {
+		return nil, false
+	}
+	if seq == b.seq {
+		return nil, true
+	}
+	if len(b.messages) == 0 || seq < b.messages[0].Seq-1 {
+		return nil, false
+	}
+	start := len(b.messages) - int(b.seq-seq)
+	return b.messages[start:], true
+}
+
+// Seq returns the seq of the last broadcast.
+func (h *Hub) Seq() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.recent.seq
+}
+
+// parseSince reads the ?since= of a /ws request.
+func parseSince(raw string) (seq uint64, ok bool) {
+	if raw == "" {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(raw, 10, 64)
+	return seq, err == nil
+}
+
+// backfill queues for c, which is being registered, the broadcasts it missed
+// after seq followed by a caught_up marker, and reports whether it could. It
+// cannot when they have left the ring or would overflow c's queue; c then
+// needs a full state instead. Callers hold h.mu, so no broadcast is missed or
+// sent twice between the backfill and the first live message.
+func (h *Hub) backfill(c *client, seq uint64) bool {
+	missed, ok := h.recent.since(seq)
+	if !ok || len(missed) >= cap(c.send) {
+		return false
+	}
+	for _, message := range missed {
+		if c.wants(message) {
+			c.sendJSON(c.visibleMessage(message))
+		}
+	}
+	c.sendJSON(WSMessage{Type: "caught_up", Seq: h.recent.seq})
+	return true
+}
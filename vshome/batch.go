@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// updateBatch collects the update frames a client is sent during the flush
+// window, keeping only the latest per device. Frames already encoded for the
+// client are kept as they are and sent together in one batch message.
+type updateBatch struct {
+	mu       sync.Mutex
+	window   time.Duration
+	timer    *time.Timer
+	frames   []json.RawMessage
+	byDevice map[string]int
+}
+
+// addToBatch holds payload, the update of device id, until the window opened
+// by the first held frame ends, replacing an earlier update of the device.
+func (c *client) addToBatch(id string, payload []byte) {
+	b := c.batch
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if i, ok := b.byDevice[id]; ok {
+		b.frames[i] = payload
+		return
+	}
+	if b.byDevice == nil {
+		b.byDevice = make(map[string]int)
+	}
+	b.byDevice[id] = len(b.frames)
+	b.frames = append(b.frames, payload)
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.window, c.flushBatch)
+	}
+}
+
+// flushBatch sends the held updates, if any, as one batch message. Every
+// other message for the client flushes first, so nothing overtakes an update
+// it followed.
+func (c *client) flushBatch() {
+	b := c.batch
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(b.frames) == 0 {
+		return
+	}
+	frames := b.frames
+	b.frames, b.byDevice = nil, nil
+	payload, err := json.Marshal(WSMessage{Type: "batch", Messages: frames})
+	if err != nil {
+		log.Printf("websocket encode failed: %v", err)
+		return
+	}
+	warnOversized(c.messageLimit, "batch", payload)
+	if c.enqueueNow(payload) {
+		c.counts.sent("batch")
+	}
+}
+
+// batches reports whether message, on its way to c, waits in c's batch.
+func (c *client) batches(message WSMessage) bool {
+	return c.batch != nil && message.Type == "update" && message.Device != nil
+}
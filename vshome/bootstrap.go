@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+)
+
+// Bootstrap is everything the dashboard needs to render, as returned by GET
+// /api/bootstrap in one response instead of several that could disagree.
+// Seq is the last broadcast the devices reflect, for connecting to /ws with
+// ?since=.
+type Bootstrap struct {
+	Devices []*Device              `json:"devices"`
+	Rooms   []string               `json:"rooms"`
+	Kinds   []KindSchema           `json:"kinds"`
+	Scenes  []string               `json:"scenes"`
+	Version map[string]interface{} `json:"version"`
+	Seq     uint64                 `json:"seq"`
+}
+
+func handleBootstrap(w http.ResponseWriter, r *http.Request) {
+	seq := hub.Seq()
+	devices := store.List()
+	bootstrap := Bootstrap{
+		Devices: visibleDevices(r, devices),
+		Rooms:   deviceRooms(devices),
+		Kinds:   kindList(),
+		Scenes:  []string{},
+		Version: versionInfo(),
+		Seq:     seq,
+	}
+	for _, scene := range scenes.List() {
+		bootstrap.Scenes = append(bootstrap.Scenes, scene.Name)
+	}
+	writeJSON(w, http.StatusOK, bootstrap)
+}
+
+// deviceRooms returns the distinct rooms of devices, sorted.
+func deviceRooms(devices []*Device) []string {
+	seen := make(map[string]bool)
+	rooms := []string{}
+	for _, device := range devices {
+		if device.Room != "" && !seen[device.Room] {
+			seen[device.Room] = true
+			rooms = append(rooms, device.Room)
+		}
+	}
+	sort.Strings(rooms)
+	return rooms
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// buttonScenes maps a button's ID to the scene it triggers when pressed, from
+// the catalog's button_scenes.
+var buttonScenes map[string]string
+
+// validateButtonScenes checks that every entry maps a button to a scene
+// defined in the catalog.
+func validateButtonScenes(bindings map[string]string, devices []*Device, sceneList []*Scene) error {
+	kinds := make(map[string]string, len(devices))
+	for _, device := range devices {
+		kinds[device.ID] = device.Kind
+	}
+	names := make(map[string]bool, len(sceneList))
+	for _, scene := range sceneList {
+		names[scene.Name] = true
+	}
+	for id, scene := range bindings {
+		kind, ok := kinds[id]
+		if !ok {
+			return fmt.Errorf("button scene: unknown device %q", id)
+		}
+		if kind != "button" {
+			return fmt.Errorf("button scene: %s is a %s, not a button", id, kind)
+		}
+		if !names[scene] {
+			return fmt.Errorf("button scene for %s: unknown scene %q", id, scene)
+		}
+	}
+	return nil
+}
+
+// PressResult is the response to a button press. Scene and Devices are set
+// when the press triggered a scene.
+type PressResult struct {
+	ID      string    `json:"id"`
+	Event   string    `json:"event"`
+	Scene   string    `json:"scene,omitempty"`
+	Devices []*Device `json:"devices,omitempty"`
+}
+
+// handlePress serves POST /api/devices/{id}/press. Buttons are momentary: a
+// press is broadcast as an event and stores nothing on the device.
+func handlePress(w http.ResponseWriter, r *http.Request, id string) {
+	device, ok := store.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "device not found")
+		return
+	}
+	if device.Kind != "button" {
+		writeStoreError(w, fmt.Errorf("%w: %s is not a button", errInvalidValue, id))
+		return
+	}
+	if err := checkOnline(device); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	audit(r.Context(), "pressed", device)
+	hub.Publish(WSMessage{Type: "event", ID: id, Event: "pressed", RequestID: requestIDFrom(r.Context()), target: device})
+	result := PressResult{ID: id, Event: "pressed"}
+	if name, ok := buttonScenes[id]; ok {
+		scene, ok := scenes.Get(name)
+		if !ok {
+			writeError(w, http.StatusNotFound, errSceneNotFound.Error())
+			return
+		}
+		updated, err := store.ApplyScene(r.Context(), scene)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		for _, device := range updated {
+			hub.PublishChange(r.Context(), WSMessage{Type: "update", Device: device})
+		}
+		result.Scene, result.Devices = name, visibleDevices(r, updated)
+	}
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// writeAuthorizer is the catalog's write rules and command allowlist, set at
+// startup, for reporting what a caller may change.
+var writeAuthorizer WriteAuthorizer
+
+// Capabilities is what one device accepts from the caller asking, as returned
+// by GET /api/devices/{id}/capabilities: its kind's schema with the caller's
+// view of the keys, and whether the write rules let the caller change it.
+type Capabilities struct {
+	ID       string                   `json:"id"`
+	Kind     string                   `json:"kind"`
+	Writable bool                     `json:"writable"`
+	Reason   string                   `json:"reason,omitempty"`
+	Keys     map[string]KeyCapability `json:"keys"`
+	Derived  map[string]DerivedField  `json:"derived,omitempty"`
+}
+
+// KeyCapability is a key's schema and whether the caller may write it. Reason
+// says why not.
+type KeyCapability struct {
+	KeySchema
+	Writable bool   `json:"writable"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// deviceCapabilities resolves device's schema for the caller of ctx. Private
+// keys are left out unless private is set, and ranges of Celsius keys are
+// given in unit.
+func deviceCapabilities(ctx context.Context, device *Device, private bool, unit string) Capabilities {
+	capabilities := Capabilities{ID: device.ID, Kind: device.Kind, Writable: true, Keys: make(map[string]KeyCapability)}
+	if err := authorizeWrite(ctx, writeAuthorizer, device, map[string]interface{}{}); err != nil {
+		capabilities.Writable, capabilities.Reason = false, forbiddenReason(err)
+	}
+	schema, ok := schemaFor(device.schemaKind())
+	if !ok {
+		return capabilities
+	}
+	capabilities.Derived = schema.Derived
+	for key, keySchema := range schema.Keys {
+		if keySchema.Private && !private {
+			continue
+		}
+		capability := KeyCapability{KeySchema: localizeKeySchema(keySchema, unit), Writable: capabilities.Writable, Reason: capabilities.Reason}
+		switch {
+		case !capability.Writable:
+		case keySchema.Control.Widget == widgetReadonly:
+			capability.Writable, capability.Reason = false, "read-only"
+		default:
+			if err := authorizeWrite(ctx, writeAuthorizer, device, map[string]interface{}{key: device.State[key]}); err != nil {
+				capability.Writable, capability.Reason = false, forbiddenReason(err)
+			}
+		}
+		capabilities.Keys[key] = capability
+	}
+	return capabilities
+}
+
+// forbiddenReason is err's message without the errForbidden prefix.
+func forbiddenReason(err error) string {
+	return strings.TrimPrefix(err.Error(), errForbidden.Error()+": ")
+}
+
+// localizeKeySchema returns schema with the range of a Celsius key in unit.
+func localizeKeySchema(schema KeySchema, unit string) KeySchema {
+	if unit != unitFahrenheit || !isCelsiusKey(schema) {
+		return schema
+	}
+	schema.Unit = fahrenheitSymbol
+	if schema.Min != nil {
+		min := roundTenth(toFahrenheit(*schema.Min, schema.difference))
+		schema.Min = &min
+	}
+	if schema.Max != nil {
+		max := roundTenth(toFahrenheit(*schema.Max, schema.difference))
+		schema.Max = &max
+	}
+	return schema
+}
+
+// handleDeviceCapabilities serves GET /api/devices/{id}/capabilities.
+func handleDeviceCapabilities(w http.ResponseWriter, r *http.Request, id string) {
+	device, ok := store.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "device not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, deviceCapabilities(r.Context(), device, showPrivate(r), requestUnit(r)))
+}
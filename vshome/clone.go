@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// handleClone serves POST /api/devices/{id}/clone: it creates a device of the
+// same kind, room, and current state as the source under the body's
+// {"id":...,"name":...}. The name defaults to the source's; the ID may be
+// left out only when the catalog derives IDs from names.
+func handleClone(w http.ResponseWriter, r *http.Request, id string) {
+	var payload struct {
+		ID   string  `json:"id"`
+		Name *string `json:"name"`
+	}
+	if err := decodeJSON(r.Body, &payload); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	device, ok := store.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "device not found")
+		return
+	}
+	device.ID = strings.TrimSpace(payload.ID)
+	if payload.Name != nil {
+		device.Name = strings.TrimSpace(*payload.Name)
+	}
+	if err := validDisplayName("name", device.Name, false); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	device.LastSeen, device.Offline, device.Updating = nil, false, false
+	created, err := store.Add(device)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	hub.PublishChange(r.Context(), WSMessage{Type: "added", Device: created})
+	writeJSON(w, http.StatusCreated, visibleDevice(r, created))
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const defaultConfigPath = "config.yaml"
+
+// Config is the complete server configuration. LoadConfig fills it from, in
+// increasing precedence: defaults, a YAML config file, VSHOME_* environment
+// variables, and command-line flags.
+type Config struct {
+	Addr           string        `yaml:"addr"`
+	Features       string        `yaml:"features"`
+	WebDir         string        `yaml:"web_dir"`
+	DevicesPath    string        `yaml:"devices"`
+	Watch          bool          `yaml:"watch"`
+	DefaultRoom    string        `yaml:"default_room"`
+	TempUnit       string        `yaml:"temperature_unit"`
+	Scenarios      string        `yaml:"scenarios"`
+	MaxDevices     int           `yaml:"max_devices"`
+	MaxStateKeys   int           `yaml:"max_state_keys"`
+	DBPath         string        `yaml:"db"`
+	AllowCreate    bool          `yaml:"create"`
+	AllowEmpty     bool          `yaml:"allow_empty"`
+	APIKeys        string        `yaml:"api_keys"`
+	TLSCert        string        `yaml:"tls_cert"`
+	TLSKey         string        `yaml:"tls_key"`
+	ClientCA       string        `yaml:"client_ca"`
+	RateLimit      float64       `yaml:"rate_limit"`
+	RateBurst      int           `yaml:"rate_burst"`
+	MethodOverride bool          `yaml:"method_override"`
+	WSMessageLimit int           `yaml:"ws_message_limit"`
+	WSResumeTTL    time.Duration `yaml:"ws_resume_ttl"`
+	WSEcho         string        `yaml:"ws_echo"`
+	WSSkipNoops    bool          `yaml:"ws_skip_noops"`
+	WSQueueSize    int           `yaml:"ws_queue_size"`
+	WSBackfill     int           `yaml:"ws_backfill"`
+	WSQueueMaxAge  time.Duration `yaml:"ws_queue_max_age"`
+	WSSlowClient   string        `yaml:"ws_slow_client"`
+	WSReconnect    time.Duration `yaml:"ws_reconnect_after"`
+	WSPing         time.Duration `yaml:"ws_ping_interval"`
+	WSPongWait     time.Duration `yaml:"ws_pong_wait"`
+	WSIdleTimeout  time.Duration `yaml:"ws_idle_timeout"`
+	WSBatchWindow  time.Duration `yaml:"ws_batch_window"`
+	WSAnonReadOnly bool          `yaml:"ws_anonymous_read_only"`
+	DebugEventLog  string        `yaml:"debug_event_log"`
+	Webhooks       string        `yaml:"webhooks"`
+	PrefsPath      string        `yaml:"prefs"`
+	PrefsMaxBytes  int           `yaml:"prefs_max_bytes"`
+	MetricsSeries  int           `yaml:"metrics_max_series"`
+	MOTD           MOTDConfig    `yaml:"motd"`
+	Webhook        WebhookConfig `yaml:"webhook"`
+	Audit          AuditConfig   `yaml:"audit"`
+	HTTP           HTTPConfig    `yaml:"http"`
+}
+
+// HTTPConfig bounds how long the server waits on a client connection; 0
+// disables a timeout. WebSocket connections are exempt once upgraded.
+type HTTPConfig struct {
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+}
+
+// WebhookConfig controls retries of outbound webhook deliveries and where
+// deliveries that are given up on are logged.
+type WebhookConfig struct {
+	MaxAttempts int           `yaml:"max_attempts"`
+	Backoff     time.Duration `yaml:"backoff"`
+	MaxBackoff  time.Duration `yaml:"max_backoff"`
+	DeadLetter  string        `yaml:"dead_letter_log"`
+}
+
+// AuditConfig controls the audit log; an empty Path disables it.
+type AuditConfig struct {
+	Path      string        `yaml:"path"`
+	MaxSizeMB int           `yaml:"max_size_mb"`
+	MaxAge    time.Duration `yaml:"max_age"`
+	MaxFiles  int           `yaml:"max_files"`
+	Compress  bool          `yaml:"compress"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Addr:           ":8080",
+		WebDir:         "web",
+		DevicesPath:    "devices.yaml",
+		AllowCreate:    true,
+		RateBurst:      20,
+		MaxStateKeys:   64,
+		WSMessageLimit: defaultMessageLimit,
+		WSResumeTTL:    defaultResumeTTL,
+		WSEcho:         echoAll,
+		WSQueueSize:    defaultQueueSize,
+		WSBackfill:     defaultBackfillSize,
+		WSSlowClient:   slowClientDrop,
+		WSReconnect:    2 * time.Second,
+		WSPing:         defaultPingInterval,
+		WSPongWait:     defaultPongWait,
+		PrefsMaxBytes:  defaultPrefsMaxBytes,
+		TempUnit:       unitCelsius,
+		MetricsSeries:  defaultMetricsMaxSeries,
+		MOTD:           MOTDConfig{ServerName: "Virtual Smart Home"},
+		Webhook: WebhookConfig{
+			MaxAttempts: 5,
+			Backoff:     time.Second,
+			MaxBackoff:  time.Minute,
+		},
+		Audit: AuditConfig{
+			MaxSizeMB: 10,
+			MaxFiles:  5,
+		},
+		HTTP: HTTPConfig{
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       30 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+		},
+	}
+}
+
+// configOption binds one Config field to its flag and environment variable.
+// field returns a pointer to the field; either name may be empty.
+type configOption struct {
+	flag  string
+	env   string
+	usage string
+	field func(c *Config) interface{}
+}
+
+var configOptions = []configOption{
+	{"addr", "VSHOME_ADDR", "listen address", func(c *Config) interface{} { return &c.Addr }},
+	{"features", "VSHOME_FEATURES", "comma-separated optional subsystems to enable (persistence, metrics, webhooks, audit, scenarios, replays), empty for all, none for none", func(c *Config) interface{} { return &c.Features }},
+	{"web", "VSHOME_WEB_DIR", "directory of static dashboard assets", func(c *Config) interface{} { return &c.WebDir }},
+	{"devices", "VSHOME_DEVICES", "path or http(s) URL of the device catalog", func(c *Config) interface{} { return &c.DevicesPath }},
+	{"watch", "VSHOME_WATCH", "reload the device catalog when the file changes", func(c *Config) interface{} { return &c.Watch }},
+	{"default-room", "VSHOME_DEFAULT_ROOM", "room given to catalog devices that have none, empty leaves them without one", func(c *Config) interface{} { return &c.DefaultRoom }},
+	{"temperature-unit", "VSHOME_TEMPERATURE_UNIT", "unit API and WebSocket clients read temperatures in: C, F, or auto (from Accept-Language); ?unit= overrides it", func(c *Config) interface{} { return &c.TempUnit }},
+	{"scenarios", "VSHOME_SCENARIOS", "YAML file of scripted scenarios", func(c *Config) interface{} { return &c.Scenarios }},
+	{"max-devices", "VSHOME_MAX_DEVICES", "maximum number of devices, 0 for unlimited", func(c *Config) interface{} { return &c.MaxDevices }},
+	{"max-state-keys", "VSHOME_MAX_STATE_KEYS", "maximum number of state keys a write may give a device, 0 for unlimited", func(c *Config) interface{} { return &c.MaxStateKeys }},
+	{"db", "VSHOME_DB", "SQLite database for persistent device state (requires -tags sqlite)", func(c *Config) interface{} { return &c.DBPath }},
+	{"create", "VSHOME_CREATE", "allow creating devices through POST /api/devices", func(c *Config) interface{} { return &c.AllowCreate }},
+	{"allow-empty", "VSHOME_ALLOW_EMPTY", "start with an empty catalog and add devices at runtime (requires -create)", func(c *Config) interface{} { return &c.AllowEmpty }},
+	{"", "VSHOME_API_KEYS", "", func(c *Config) interface{} { return &c.APIKeys }},
+	{"tls-cert", "VSHOME_TLS_CERT", "TLS certificate file; serves HTTPS together with -tls-key", func(c *Config) interface{} { return &c.TLSCert }},
+	{"tls-key", "VSHOME_TLS_KEY", "TLS private key file", func(c *Config) interface{} { return &c.TLSKey }},
+	{"client-ca", "VSHOME_CLIENT_CA", "CA certificate file; when set, HTTPS clients must present a certificate it signed", func(c *Config) interface{} { return &c.ClientCA }},
+	{"read-header-timeout", "VSHOME_READ_HEADER_TIMEOUT", "time allowed to read request headers, 0 for none", func(c *Config) interface{} { return &c.HTTP.ReadHeaderTimeout }},
+	{"read-timeout", "VSHOME_READ_TIMEOUT", "time allowed to read a whole request, 0 for none", func(c *Config) interface{} { return &c.HTTP.ReadTimeout }},
+	{"write-timeout", "VSHOME_WRITE_TIMEOUT", "time allowed to write a response, 0 for none; WebSocket connections are exempt", func(c *Config) interface{} { return &c.HTTP.WriteTimeout }},
+	{"idle-timeout", "VSHOME_IDLE_TIMEOUT", "how long an idle keep-alive connection stays open, 0 for none", func(c *Config) interface{} { return &c.HTTP.IdleTimeout }},
+	{"rate-limit", "VSHOME_RATE_LIMIT", "API requests per second allowed per client address, 0 for unlimited", func(c *Config) interface{} { return &c.RateLimit }},
+	{"rate-burst", "VSHOME_RATE_BURST", "API requests a client may make at once before -rate-limit applies", func(c *Config) interface{} { return &c.RateBurst }},
+	{"method-override", "VSHOME_METHOD_OVERRIDE", "honor X-HTTP-Method-Override on POST requests to /api/ routes (PUT, PATCH, or DELETE)", func(c *Config) interface{} { return &c.MethodOverride }},
+	{"ws-message-limit", "VSHOME_WS_MESSAGE_LIMIT", "largest WebSocket message in bytes accepted from clients; larger outgoing messages are logged, 0 for unlimited", func(c *Config) interface{} { return &c.WSMessageLimit }},
+	{"ws-resume-ttl", "VSHOME_WS_RESUME_TTL", "how long a disconnected WebSocket client can resume its subscription, 0 disables", func(c *Config) interface{} { return &c.WSResumeTTL }},
+	{"ws-echo", "VSHOME_WS_ECHO", "what a WebSocket client receives for its own changes: all (the broadcast), skip, or ack", func(c *Config) interface{} { return &c.WSEcho }},
+	{"ws-skip-noops", "VSHOME_WS_SKIP_NOOPS", "broadcast an update only when it changes the device's state; the client that made it still gets its echo", func(c *Config) interface{} { return &c.WSSkipNoops }},
+	{"ws-queue-size", "VSHOME_WS_QUEUE_SIZE", "messages that may wait for a slow WebSocket client", func(c *Config) interface{} { return &c.WSQueueSize }},
+	{"ws-backfill", "VSHOME_WS_BACKFILL", "recent broadcasts kept for WebSocket clients reconnecting with ?since=, 0 disables", func(c *Config) interface{} { return &c.WSBackfill }},
+	{"ws-queue-max-age", "VSHOME_WS_QUEUE_MAX_AGE", "how long a message may wait for a slow WebSocket client, 0 for no limit", func(c *Config) interface{} { return &c.WSQueueMaxAge }},
+	{"ws-slow-client", "VSHOME_WS_SLOW_CLIENT", "what to do when a WebSocket client falls behind: drop messages or disconnect it", func(c *Config) interface{} { return &c.WSSlowClient }},
+	{"ws-reconnect-after", "VSHOME_WS_RECONNECT_AFTER", "how long WebSocket clients are told to wait before reconnecting when the server shuts down", func(c *Config) interface{} { return &c.WSReconnect }},
+	{"ws-ping-interval", "VSHOME_WS_PING_INTERVAL", "how often WebSocket clients are pinged to detect dead connections, 0 disables", func(c *Config) interface{} { return &c.WSPing }},
+	{"ws-pong-wait", "VSHOME_WS_PONG_WAIT", "how long after a ping a WebSocket client without a pong is dropped", func(c *Config) interface{} { return &c.WSPongWait }},
+	{"ws-idle-timeout", "VSHOME_WS_IDLE_TIMEOUT", "close WebSocket clients that send nothing for this long, even if they answer pings; 0 never does", func(c *Config) interface{} { return &c.WSIdleTimeout }},
+	{"ws-batch-window", "VSHOME_WS_BATCH_WINDOW", "how long WebSocket updates wait to be sent together in one batch message, keeping the latest per device; 0 sends each at once", func(c *Config) interface{} { return &c.WSBatchWindow }},
+	{"ws-anonymous-read-only", "VSHOME_WS_ANONYMOUS_READ_ONLY", "limit anonymous WebSocket clients to reading, as for the viewer role", func(c *Config) interface{} { return &c.WSAnonReadOnly }},
+	{"debug-event-log", "VSHOME_DEBUG_EVENT_LOG", "debugging: append every WebSocket broadcast to this JSONL file and enable the admin event log replay endpoint", func(c *Config) interface{} { return &c.DebugEventLog }},
+	{"prefs", "VSHOME_PREFS", "JSON file to persist per-client dashboard prefs in, empty keeps them in memory", func(c *Config) interface{} { return &c.PrefsPath }},
+	{"prefs-max-bytes", "VSHOME_PREFS_MAX_BYTES", "largest prefs blob a client may store", func(c *Config) interface{} { return &c.PrefsMaxBytes }},
+	{"metrics-max-series", "VSHOME_METRICS_MAX_SERIES", "most per-device state gauges exported on /metrics, 0 exports none", func(c *Config) interface{} { return &c.MetricsSeries }},
+	{"server-name", "VSHOME_SERVER_NAME", "server name shown on the dashboard and served by /api/motd", func(c *Config) interface{} { return &c.MOTD.ServerName }},
+	{"motd", "VSHOME_MOTD", "welcome message shown on the dashboard and served by /api/motd", func(c *Config) interface{} { return &c.MOTD.Message }},
+	{"logo-url", "VSHOME_LOGO_URL", "logo shown on the dashboard and served by /api/motd", func(c *Config) interface{} { return &c.MOTD.LogoURL }},
+	{"webhooks", "VSHOME_WEBHOOKS", "comma-separated URLs to POST hub events to", func(c *Config) interface{} { return &c.Webhooks }},
+	{"webhook-attempts", "VSHOME_WEBHOOK_ATTEMPTS", "delivery attempts before a webhook event is dead-lettered", func(c *Config) interface{} { return &c.Webhook.MaxAttempts }},
+	{"webhook-backoff", "VSHOME_WEBHOOK_BACKOFF", "wait before the first webhook retry, doubling after each", func(c *Config) interface{} { return &c.Webhook.Backoff }},
+	{"webhook-max-backoff", "VSHOME_WEBHOOK_MAX_BACKOFF", "longest wait between webhook retries", func(c *Config) interface{} { return &c.Webhook.MaxBackoff }},
+	{"dead-letter-log", "VSHOME_DEAD_LETTER_LOG", "file to append failed webhook deliveries to", func(c *Config) interface{} { return &c.Webhook.DeadLetter }},
+	{"audit-log", "VSHOME_AUDIT_LOG", "audit log file, empty disables auditing", func(c *Config) interface{} { return &c.Audit.Path }},
+	{"", "VSHOME_AUDIT_MAX_SIZE_MB", "", func(c *Config) interface{} { return &c.Audit.MaxSizeMB }},
+	{"", "VSHOME_AUDIT_MAX_AGE", "", func(c *Config) interface{} { return &c.Audit.MaxAge }},
+	{"", "VSHOME_AUDIT_MAX_FILES", "", func(c *Config) interface{} { return &c.Audit.MaxFiles }},
+	{"", "VSHOME_AUDIT_COMPRESS", "", func(c *Config) interface{} { return &c.Audit.Compress }},
+}
+
+// LoadConfig builds the configuration from args (without the program name)
+// and getenv. The config file is -config, else VSHOME_CONFIG, else
+// config.yaml when it exists.
+func LoadConfig(args []string, getenv func(string) string) (*Config, error) {
+	// Flags are parsed first to find -config but applied last, so they are
+	// bound to a scratch Config and copied over only when set.
+	flagged := defaultConfig()
+	fs := flag.NewFlagSet("vshome", flag.ContinueOnError)
+	configPath := fs.String("config", "", "YAML config file (default "+defaultConfigPath+" when present)")
+	for _, option := range configOptions {
+		if option.flag == "" {
+			continue
+		}
+		switch field := option.field(&flagged).(type) {
+		case *string:
+			fs.StringVar(field, option.flag, *field, option.usage)
+		case *int:
+			fs.IntVar(field, option.flag, *field, option.usage)
+		case *bool:
+			fs.BoolVar(field, option.flag, *field, option.usage)
+		case *float64:
+			fs.Float64Var(field, option.flag, *field, option.usage)
+		case *time.Duration:
+			fs.DurationVar(field, option.flag, *field, option.usage)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	config := defaultConfig()
+	path, required := *configPath, true
+	if path == "" {
+		path = getenv("VSHOME_CONFIG")
+	}
+	if path == "" {
+		path, required = defaultConfigPath, false
+	}
+	if err := loadConfigFile(&config, path, required); err != nil {
+		return nil, err
+	}
+
+	for _, option := range configOptions {
+		if option.env == "" {
+			continue
+		}
+		raw := getenv(option.env)
+		if raw == "" {
+			continue
+		}
+		if err := setConfigField(option.field(&config), raw); err != nil {
+			return nil, fmt.Errorf("%s: %w", option.env, err)
+		}
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, option := range configOptions {
+		if set[option.flag] {
+			copyConfigField(option.field(&config), option.field(&flagged))
+		}
+	}
+	return &config, config.validate()
+}
+
+func loadConfigFile(config *Config, path string, required bool) error {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if errors.Is(err, os.ErrNotExist) && !required {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read config: %w", err)
+	}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return fmt.Errorf("parse config %s: %w", path, err)
+	}
+	return nil
+}
+
+func setConfigField(field interface{}, raw string) error {
+	switch field := field.(type) {
+	case *string:
+		*field = raw
+	case *int:
+		value, err := strconv.Atoi(raw)
+		if err != nil {
+			return errors.New("must be an integer")
+		}
+		*field = value
+	case *bool:
+		value, err := strconv.ParseBool(raw)
+		if err != nil {
+			return errors.New("must be true or false")
+		}
+		*field = value
+	case *float64:
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return errors.New("must be a number")
+		}
+		*field = value
+	case *time.Duration:
+		value, err := time.ParseDuration(raw)
+		if err != nil {
+			return errors.New("must be a duration such as 24h")
+		}
+		*field = value
+	}
+	return nil
+}
+
+func copyConfigField(dst, src interface{}) {
+	switch dst := dst.(type) {
+	case *string:
+		*dst = *src.(*string)
+	case *int:
+		*dst = *src.(*int)
+	case *bool:
+		*dst = *src.(*bool)
+	case *float64:
+		*dst = *src.(*float64)
+	case *time.Duration:
+		*dst = *src.(*time.Duration)
+	}
+}
+
+func (c *Config) validate() error {
+	if c.MaxDevices < 0 {
+		return errors.New("max devices must not be negative")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("tls cert and key must be set together")
+	}
+	if c.ClientCA != "" && c.TLSCert == "" {
+		return errors.New("client ca requires tls cert and key")
+	}
+	if c.HTTP.ReadHeaderTimeout < 0 || c.HTTP.ReadTimeout < 0 || c.HTTP.WriteTimeout < 0 || c.HTTP.IdleTimeout < 0 {
+		return errors.New("http timeouts must not be negative")
+	}
+	if c.WSMessageLimit < 0 || c.WSResumeTTL < 0 {
+		return errors.New("ws message limit and resume ttl must not be negative")
+	}
+	if err := validEchoMode(c.WSEcho); err != nil {
+		return err
+	}
+	if c.WSReconnect < 0 {
+		return errors.New("ws reconnect after must not be negative")
+	}
+	if c.WSPing < 0 || c.WSIdleTimeout < 0 {
+		return errors.New("ws ping interval and idle timeout must not be negative")
+	}
+	if c.WSPing > 0 && c.WSPongWait <= 0 {
+		return errors.New("ws pong wait must be positive")
+	}
+	if c.WSBackfill < 0 {
+		return errors.New("ws backfill must not be negative")
+	}
+	if c.WSBatchWindow < 0 {
+		return errors.New("ws batch window must not be negative")
+	}
+	if c.WSQueueSize < 1 || c.WSQueueMaxAge < 0 {
+		return errors.New("ws queue size must be at least 1 and max age not negative")
+	}
+	if err := validSlowClientPolicy(c.WSSlowClient); err != nil {
+		return err
+	}
+	if c.PrefsMaxBytes < 1 {
+		return errors.New("prefs max bytes must be at least 1")
+	}
+	if err := validDisplayName("default room", c.DefaultRoom, true); err != nil {
+		return err
+	}
+	if err := validTemperatureUnit(c.TempUnit); err != nil {
+		return err
+	}
+	if c.MaxStateKeys < 0 {
+		return errors.New("max state keys must not be negative")
+	}
+	if c.MetricsSeries < 0 {
+		return errors.New("metrics max series must not be negative")
+	}
+	if err := validLogoURL(c.MOTD.LogoURL); err != nil {
+		return err
+	}
+	if c.RateLimit < 0 || c.RateBurst < 0 {
+		return errors.New("rate limit and burst must not be negative")
+	}
+	if c.Webhook.MaxAttempts < 1 || c.Webhook.Backoff < 0 || c.Webhook.MaxBackoff < c.Webhook.Backoff {
+		return errors.New("webhook attempts must be at least 1 and max backoff at least backoff")
+	}
+	if c.Audit.MaxSizeMB < 0 || c.Audit.MaxFiles < 0 || c.Audit.MaxAge < 0 {
+		return errors.New("audit limits must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestLoadConfigPrecedence sets each field from fewer sources than the last,
+// so each shows which source wins: flag > env > file > default.
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	file := "addr: \":7000\"\nmax_devices: 7\nws_ping_interval: 7s\n"
+	if err := os.WriteFile(path, []byte(file), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"VSHOME_ADDR":        ":8000",
+		"VSHOME_MAX_DEVICES": "8",
+	}
+	config, err := LoadConfig([]string{"-config", path, "-addr", ":9000"}, func(key string) string { return env[key] })
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+
+	if config.Addr != ":9000" {
+		t.Errorf("addr = %q, want the flag's :9000", config.Addr)
+	}
+	if config.MaxDevices != 8 {
+		t.Errorf("max devices = %d, want the environment's 8", config.MaxDevices)
+	}
+	if config.WSPing != 7*time.Second {
+		t.Errorf("ping interval = %s, want the file's 7s", config.WSPing)
+	}
+	if want := defaultConfig().WebDir; config.WebDir != want {
+		t.Errorf("web dir = %q, want the default %q", config.WebDir, want)
+	}
+}
+
+func TestLoadConfigRejectsBadInput(t *testing.T) {
+	noEnv := func(string) string { return "" }
+	missing := filepath.Join(t.TempDir(), "missing.yaml")
+	tests := map[string]struct {
+		args []string
+		env  func(string) string
+	}{
+		"missing explicit file": {[]string{"-config", missing}, noEnv},
+		"bad environment value": {nil, func(key string) string {
+			if key == "VSHOME_MAX_DEVICES" {
+				return "many"
+			}
+			return ""
+		}},
+		"invalid value": {[]string{"-max-devices", "-1"}, noEnv},
+	}
+	for name, test := range tests {
+		if _, err := LoadConfig(test.args, test.env); err == nil {
+			t.Errorf("%s: LoadConfig succeeded", name)
+		}
+	}
+}
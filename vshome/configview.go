@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// redacted stands in for a secret in GET /api/config.
+const redacted = "***"
+
+// sanitizedConfig returns config keyed as the YAML config file spells it, with
+// every secret replaced by redacted: API keys, and everything after the host
+// of webhook URLs and of a catalog fetched over HTTP. Empty secrets stay empty
+// so their absence shows.
+func sanitizedConfig(config Config) (map[string]interface{}, error) {
+	config.APIKeys = redactAPIKeys(config.APIKeys)
+	config.Webhooks = redactURLs(config.Webhooks)
+	if isCatalogURL(config.DevicesPath) {
+		config.DevicesPath = redactURL(config.DevicesPath)
+	}
+	encoded, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var sanitized map[string]interface{}
+	if err := yaml.Unmarshal(encoded, &sanitized); err != nil {
+		return nil, err
+	}
+	return sanitized, nil
+}
+
+// redactAPIKeys keeps the name and role of each name:role:key entry and hides
+// the key. Entries of another shape are hidden whole.
+func redactAPIKeys(spec string) string {
+	var entries []string
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 {
+			entries = append(entries, redacted)
+			continue
+		}
+		entries = append(entries, parts[0]+":"+parts[1]+":"+redacted)
+	}
+	return strings.Join(entries, ",")
+}
+
+// redactURLs applies redactURL to each URL of a comma-separated list.
+func redactURLs(list string) string {
+	var urls []string
+	for _, raw := range strings.Split(list, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		urls = append(urls, redactURL(raw))
+	}
+	return strings.Join(urls, ",")
+}
+
+// redactURL keeps only the scheme and host of raw. Tokens travel in the user
+// info, the query, and often the path, as in Slack's
+// /services/T.../B.../secret, so whatever follows the host becomes a single
+// redacted segment. A URL that does not parse is hidden whole.
+func redactURL(raw string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return redacted
+	}
+	sanitized := parsed.Scheme + "://" + parsed.Host
+	if parsed.User != nil || strings.Trim(parsed.Path, "/") != "" || parsed.RawQuery != "" || parsed.Fragment != "" {
+		sanitized += "/" + redacted
+	}
+	return sanitized
+}
+
+// handleConfig serves GET /api/config, the effective configuration with
+// secrets redacted.
+func handleConfig(config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sanitized, err := sanitizedConfig(*config)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, sanitized)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Heartbeat defaults: the server pings every defaultPingInterval and drops a
+// connection whose pong has not arrived defaultPongWait later.
+const (
+	defaultPingInterval = 30 * time.Second
+	defaultPongWait     = 10 * time.Second
+)
+
+// Conn is the part of a client connection the hub uses. Production clients
+// are websockets; anything else implementing it, such as an in-memory pipe,
+// can be attached with Hub.Serve to drive the hub without a network.
+type Conn interface {
+	// NextReader blocks until the next client message arrives.
+	NextReader() (io.Reader, error)
+	// WriteMessage sends one JSON-encoded server message.
+	WriteMessage(payload []byte) error
+	Subprotocol() string
+	Close() error
+}
+
+// closeFramer is implemented by connections that can tell the peer why they
+// are being closed before the hub closes them.
+type closeFramer interface {
+	WriteClose(code int, reason string) error
+}
+
+// pinger is implemented by connections that need pings to detect a dead peer.
+type pinger interface {
+	Ping() error
+}
+
+// websocketConn adapts a gorilla connection, applying a read limit and read and
+// write deadlines. The read deadline only measures the heartbeat: it is
+// pushed out by every pong and every message, so a peer that stops answering
+// pings is dropped pongWait after the ping it missed, however long it has
+// been quiet otherwise.
+type websocketConn struct {
+	conn     *websocket.Conn
+	liveness time.Duration
+}
+
+func newWebsocketConn(conn *websocket.Conn, readLimit int, pingInterval, pongWait time.Duration) *websocketConn {
+	if readLimit > 0 {
+		conn.SetReadLimit(int64(readLimit))
+	}
+	c := &websocketConn{conn: conn}
+	if pingInterval > 0 {
+		c.liveness = pingInterval + pongWait
+		c.extend()
+		conn.SetPongHandler(func(string) error {
+			c.extend()
+			return nil
+		})
+	}
+	return c
+}
+
+// extend moves the read deadline to one heartbeat from now.
+func (c *websocketConn) extend() {
+	if c.liveness > 0 {
+		_ = c.conn.SetReadDeadline(time.Now().Add(c.liveness))
+	}
+}
+
+func (c *websocketConn) NextReader() (io.Reader, error) {
+	_, reader, err := c.conn.NextReader()
+	if err == nil {
+		c.extend()
+	}
+	return reader, err
+}
+
+func (c *websocketConn) Ping() error {
+	return c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
+}
+
+func (c *websocketConn) WriteMessage(payload []byte) error {
+	_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteMessage(websocket.TextMessage, payload)
+}
+
+func (c *websocketConn) Subprotocol() string {
+	return c.conn.Subprotocol()
+}
+
+func (c *websocketConn) WriteClose(code int, reason string) error {
+	return c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(writeWait))
+}
+
+func (c *websocketConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConn is an in-memory Conn: the test sends client messages into it and
+// reads back what the hub wrote, one decoded frame at a time.
+type fakeConn struct {
+	incoming chan []byte
+	written  chan []byte
+	once     sync.Once
+	closed   chan struct{}
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		incoming: make(chan []byte, 16),
+		written:  make(chan []byte, 64),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (c *fakeConn) NextReader() (io.Reader, error) {
+	select {
+	case message := <-c.incoming:
+		return bytes.NewReader(message), nil
+	case <-c.closed:
+		return nil, io.EOF
+	}
+}
+
+func (c *fakeConn) WriteMessage(payload []byte) error {
+	select {
+	case c.written <- append([]byte(nil), payload...):
+		return nil
+	case <-c.closed:
+		return io.ErrClosedPipe
+	}
+}
+
+func (c *fakeConn) Subprotocol() string { return "" }
+
+func (c *fakeConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+// send delivers message to the hub as if the client had written it.
+func (c *fakeConn) send(t *testing.T, message interface{}) {
+	t.Helper()
+	payload, err := json.Marshal(message)
+	if err != nil {
+		t.Fatalf("encode client message: %v", err)
+	}
+	c.incoming <- payload
+}
+
+// next returns the next frame the hub wrote, failing the test if none comes.
+func (c *fakeConn) next(t *testing.T) WSMessage {
+	t.Helper()
+	select {
+	case payload := <-c.written:
+		var message WSMessage
+		if err := json.Unmarshal(payload, &message); err != nil {
+			t.Fatalf("decode %s: %v", payload, err)
+		}
+		return message
+	case <-time.After(2 * time.Second):
+		t.Fatal("no frame from the hub")
+	}
+	return WSMessage{}
+}
+
+// nextOf skips frames until one of type messageType arrives.
+func (c *fakeConn) nextOf(t *testing.T, messageType string) WSMessage {
+	t.Helper()
+	for {
+		if message := c.next(t); message.Type == messageType {
+			return message
+		}
+	}
+}
+
+// quiet fails the test if the hub writes anything within wait.
+func (c *fakeConn) quiet(t *testing.T, wait time.Duration) {
+	t.Helper()
+	select {
+	case payload := <-c.written:
+		t.Fatalf("unexpected frame %s", payload)
+	case <-time.After(wait):
+	}
+}
+
+// serveFake attaches a fake client to hub as if it had connected to target,
+// such as "/ws?id=light_kitchen", and detaches it when the test ends.
+func serveFake(t *testing.T, hub *Hub, target string) *fakeConn {
+	t.Helper()
+	conn := newFakeConn()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		hub.Serve(conn, httptest.NewRequest("GET", target, nil))
+	}()
+	t.Cleanup(func() {
+		conn.Close()
+		<-done
+	})
+	return conn
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// deviceCSVColumns lead every row of GET /api/devices.csv; a column per state
+// key follows.
+var deviceCSVColumns = []string{"id", "name", "kind", "room"}
+
+// handleDevicesCSV serves GET /api/devices.csv: one row per device, as GET
+// /api/devices lists them, with a column for every state key any device has.
+func handleDevicesCSV(w http.ResponseWriter, r *http.Request) {
+	devices := visibleDevices(r, store.List())
+	seen := make(map[string]bool)
+	var keys []string
+	for _, device := range devices {
+		for key := range device.State {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="devices.csv"`)
+	out := csv.NewWriter(w)
+	_ = out.Write(append(append([]string{}, deviceCSVColumns...), keys...))
+	for _, device := range devices {
+		row := []string{device.ID, device.Name, device.Kind, device.Room}
+		for _, key := range keys {
+			row = append(row, csvCell(device.State[key]))
+		}
+		if err := out.Write(row); err != nil {
+			log.Printf("write csv error: %v", err)
+			return
+		}
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		log.Printf("write csv error: %v", err)
+	}
+}
+
+// csvCell formats a state value for a cell: missing and null values are
+// blank, strings are written as they are, and objects and arrays as JSON.
+func csvCell(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case bool, int, int64, float64, json.Number:
+		return fmt.Sprint(value)
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(encoded)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DerivedField is a read-only value computed from a device's state whenever
+// the device is serialized. Expr compares two operands, each a state key or a
+// literal number, boolean, or quoted string, e.g. "position == 100".
+type DerivedField struct {
+	Expr    string      `json:"expr"`
+	Control ControlHint `json:"control"`
+
+	left, right derivedOperand
+	op          string
+}
+
+type derivedOperand struct {
+	key   string
+	value interface{}
+}
+
+var derivedOps = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+// derivedKey parses expr. Schemas are static, so a malformed expression is a
+// programming error and panics at startup.
+func derivedKey(expr string) DerivedField {
+	for _, op := range derivedOps {
+		left, right, ok := strings.Cut(expr, " "+op+" ")
+		if !ok {
+			continue
+		}
+		return DerivedField{
+			Expr:    expr,
+			Control: ControlHint{Widget: widgetReadonly},
+			left:    parseDerivedOperand(left),
+			right:   parseDerivedOperand(right),
+			op:      op,
+		}
+	}
+	panic(fmt.Sprintf("derived field %q: expected <operand> <op> <operand>", expr))
+}
+
+func parseDerivedOperand(raw string) derivedOperand {
+	raw = strings.TrimSpace(raw)
+	if number, err := strconv.ParseFloat(raw, 64); err == nil {
+		return derivedOperand{value: number}
+	}
+	if flag, err := strconv.ParseBool(raw); err == nil {
+		return derivedOperand{value: flag}
+	}
+	if unquoted, err := strconv.Unquote(raw); err == nil {
+		return derivedOperand{value: unquoted}
+	}
+	return derivedOperand{key: raw}
+}
+
+func (o derivedOperand) resolve(state map[string]interface{}) (interface{}, bool) {
+	if o.key == "" {
+		return o.value, true
+	}
+	value, ok := state[o.key]
+	return value, ok
+}
+
+// eval returns false for ok when a referenced key is missing or the operands
+// cannot be compared with op.
+func (f DerivedField) eval(state map[string]interface{}) (result bool, ok bool) {
+	left, ok := f.left.resolve(state)
+	if !ok {
+		return false, false
+	}
+	right, ok := f.right.resolve(state)
+	if !ok {
+		return false, false
+	}
+	leftNumber, leftIsNumber := toFloat(left)
+	rightNumber, rightIsNumber := toFloat(right)
+	if leftIsNumber && rightIsNumber {
+		switch f.op {
+		case "==":
+			return leftNumber == rightNumber, true
+		case "!=":
+			return leftNumber != rightNumber, true
+		case "<":
+			return leftNumber < rightNumber, true
+		case "<=":
+			return leftNumber <= rightNumber, true
+		case ">":
+			return leftNumber > rightNumber, true
+		case ">=":
+			return leftNumber >= rightNumber, true
+		}
+	}
+	switch f.op {
+	case "==":
+		return left == right, true
+	case "!=":
+		return left != right, true
+	}
+	return false, false
+}
+
+// deriveFields evaluates every derived field of kind against state. It returns
+// nil when the kind has none or none can be computed.
+func deriveFields(kind string, state map[string]interface{}) map[string]interface{} {
+	schema, ok := schemaFor(kind)
+	if !ok || len(schema.Derived) == 0 {
+		return nil
+	}
+	var derived map[string]interface{}
+	for name, field := range schema.Derived {
+		value, ok := field.eval(state)
+		if !ok {
+			continue
+		}
+		if derived == nil {
+			derived = make(map[string]interface{}, len(schema.Derived))
+		}
+		derived[name] = value
+	}
+	return derived
+}
+
+func isDerivedKey(kind, key string) bool {
+	schema, ok := schemaFor(kind)
+	if !ok {
+		return false
+	}
+	_, ok = schema.Derived[key]
+	return ok
+}
+
+// MarshalJSON adds the kind's derived fields to the device as "derived",
+// whether newer firmware is available, and the advised poll interval, so
+// every API and WS response carries them without storing them.
+func (d Device) MarshalJSON() ([]byte, error) {
+	type plainDevice Device
+	return json.Marshal(struct {
+		plainDevice
+		Derived         map[string]interface{} `json:"derived,omitempty"`
+		UpdateAvailable bool                   `json:"update_available,omitempty"`
+		PollInterval    float64                `json:"poll_interval"`
+	}{plainDevice(d), deriveFields(d.schemaKind(), d.State), d.updateAvailable(), d.pollInterval()})
+}
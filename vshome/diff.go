@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+)
+
+// StateDiff lists the keys where a device's current state differs from the
+// state it was loaded or created with. Old is the initial value and New the
+// current one; Removed marks a key the device no longer has.
+type StateDiff struct {
+	ID      string                 `json:"id"`
+	Changes map[string]StateChange `json:"changes"`
+}
+
+// sameValue compares numbers by value, so an int from the catalog equals the
+// int64 or float64 the same number decodes to from JSON.
+func sameValue(a, b interface{}) bool {
+	x, okA := toFloat(a)
+	y, okB := toFloat(b)
+	if okA && okB {
+		return x == y
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func deviceDiff(r *http.Request, device *Device) (StateDiff, bool) {
+	initial, ok := store.Initial(device.ID)
+	if !ok {
+		return StateDiff{}, false
+	}
+	changes := diffState(initial, device.State)
+	private := showPrivate(r)
+	for key, change := range changes {
+		if (!change.Removed && sameValue(change.Old, change.New)) || (!private && isPrivateKey(device.schemaKind(), key)) {
+			delete(changes, key)
+		}
+	}
+	return StateDiff{ID: device.ID, Changes: changes}, true
+}
+
+// handleDeviceDiff serves GET /api/devices/{id}/diff.
+func handleDeviceDiff(w http.ResponseWriter, r *http.Request, id string) {
+	device, ok := store.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "device not found")
+		return
+	}
+	diff, ok := deviceDiff(r, device)
+	if !ok {
+		writeError(w, http.StatusNotFound, "device not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, diff)
+}
+
+// handleDiffs serves GET /api/devices/diff with the diff of every device that
+// changed, in store order.
+func handleDiffs(w http.ResponseWriter, r *http.Request) {
+	diffs := []StateDiff{}
+	for _, device := range store.List() {
+		if diff, ok := deviceDiff(r, device); ok && len(diff.Changes) > 0 {
+			diffs = append(diffs, diff)
+		}
+	}
+	writeList(w, r, diffs)
+}
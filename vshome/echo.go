@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+)
+
+// clientIDHeader names the WS client, by the client_id from its hello frame,
+// on whose behalf an HTTP request is made, so the hub can treat the resulting
+// broadcast as that client's own echo.
+const clientIDHeader = "X-Client-ID"
+
+// Echo modes decide what the client that caused a change receives in place of
+// the broadcast everyone else gets.
+const (
+	echoAll  = "all"
+	echoSkip = "skip"
+	echoAck  = "ack"
+)
+
+func validEchoMode(mode string) error {
+	switch mode {
+	case echoAll, echoSkip, echoAck:
+		return nil
+	}
+	return fmt.Errorf("ws echo must be %s, %s, or %s", echoAll, echoSkip, echoAck)
+}
+
+type originClientKey struct{}
+
+func withOriginClient(ctx context.Context, clientID string) context.Context {
+	return context.WithValue(ctx, originClientKey{}, clientID)
+}
+
+// originClientFrom returns the WS client a change was made for, or "" when
+// it has none.
+func originClientFrom(ctx context.Context) string {
+	id, _ := ctx.Value(originClientKey{}).(string)
+	return id
+}
+
+// tagOriginClient stores a valid X-Client-ID in the request context.
+func tagOriginClient(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := r.Header.Get(clientIDHeader); validRequestID(id) {
+			r = r.WithContext(withOriginClient(r.Context(), id))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// unchanged reports whether device has the state it was last seen with.
+func (h *Hub) unchanged(device *Device) bool {
+	last := h.lastDevice[device.ID]
+	return last != nil && reflect.DeepEqual(last.State, device.State)
+}
+
+// answerOrigin gives the client that made a change the reply its echo mode
+// promises without broadcasting the change to anyone else.
+func (h *Hub) answerOrigin(message WSMessage) {
+	if message.origin == "" {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		if c.id != message.origin || !c.wants(message) {
+			continue
+		}
+		switch h.echo {
+		case echoAck:
+			h.sendAck(c, message)
+		case echoAll:
+			if !c.holding(message.Device.ID) {
+				h.sendOwnEcho(c, message)
+			}
+		}
+	}
+}
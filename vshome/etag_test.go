@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteConditionalJSONVariesByLanguage(t *testing.T) {
+	payload := map[string]interface{}{"temperature": 21.5}
+	first := httptest.NewRecorder()
+	writeConditionalJSON(first, httptest.NewRequest(http.MethodGet, "/api/devices", nil), payload)
+	if first.Code != http.StatusOK || first.Header().Get("Vary") != "Accept-Language" {
+		t.Fatalf("status %d, Vary %q; want 200 varying by Accept-Language", first.Code, first.Header().Get("Vary"))
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/api/devices", nil)
+	request.Header.Set("If-None-Match", first.Header().Get("ETag"))
+	revalidated := httptest.NewRecorder()
+	writeConditionalJSON(revalidated, request, payload)
+	if revalidated.Code != http.StatusNotModified || revalidated.Header().Get("Vary") != "Accept-Language" {
+		t.Fatalf("status %d, Vary %q; want 304 varying by Accept-Language", revalidated.Code, revalidated.Header().Get("Vary"))
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// EventLogEntry is one line of the -debug-event-log file: a broadcast as the
+// hub sent it, before any client's redaction or unit conversion.
+type EventLogEntry struct {
+	Seq     uint64    `json:"seq"`
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Device  *Device   `json:"device,omitempty"`
+	Devices []*Device `json:"devices,omitempty"`
+	ID      string    `json:"id,omitempty"`
+	Event   string    `json:"event,omitempty"`
+}
+
+// eventLogPath is the -debug-event-log file, set at startup.
+var eventLogPath string
+
+func openEventLog(path string) (*os.File, error) {
+	return os.OpenFile(filepath.Clean(path), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+}
+
+// logEvent appends message to the event log, if there is one. Transition
+// frames are left out: they are replayed by the update they belong to, which
+// is logged with its targets rather than the values it starts from.
+// Callers hold h.mu, which keeps the lines in seq order.
+func (h *Hub) logEvent(message WSMessage) {
+	if h.eventLog == nil || message.simulation != nil {
+		return
+	}
+	device := message.Device
+	if device != nil && len(message.Transition) > 0 {
+		device = cloneDevice(device)
+		for key, transition := range message.Transition {
+			device.State[key] = transition.Target
+		}
+	}
+	entry := EventLogEntry{Seq: message.Seq, Time: time.Now().UTC(), Type: message.Type, Device: device, Devices: message.Devices, ID: message.ID, Event: message.Event}
+	if err := json.NewEncoder(h.eventLog).Encode(entry); err != nil {
+		log.Printf("event log write failed: %v", err)
+	}
+}
+
+// readEventLog parses a JSONL event log, skipping blank lines.
+func readEventLog(r io.Reader) ([]EventLogEntry, error) {
+	var entries []EventLogEntry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64<<10), 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry EventLogEntry
+		if err := decodeJSON(bytes.NewReader(scanner.Bytes()), &entry); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+var eventReplay struct {
+	sync.Mutex
+	running bool
+}
+
+// replayEvents brings every device back online and to its initial state,
+// then applies entries in order through the store and the hub, waiting the
+// gaps between their times divided by speed.
+func replayEvents(entries []EventLogEntry, speed float64) {
+	defer func() {
+		eventReplay.Lock()
+		eventReplay.running = false
+		eventReplay.Unlock()
+	}()
+	ctx := systemContext()
+	for _, device := range store.List() {
+		if device.Offline {
+			if online, err := store.SetOffline(device.ID, false); err == nil {
+				hub.PublishChange(ctx, WSMessage{Type: "liveness", Device: online})
+			}
+		}
+	}
+	reset, err := store.Reset(ctx, "", "")
+	if err != nil {
+		log.Printf("event replay aborted: %v", err)
+		return
+	}
+	if len(reset) > 0 {
+		hub.PublishChange(ctx, WSMessage{Type: "reset", Devices: reset})
+	}
+	for i, entry := range entries {
+		if i > 0 {
+			if gap := entry.Time.Sub(entries[i-1].Time); gap > 0 {
+				time.Sleep(time.Duration(float64(gap) / speed))
+			}
+		}
+		if err := applyEvent(ctx, entry); err != nil {
+			log.Printf("event replay: seq %d (%s): %v", entry.Seq, entry.Type, err)
+		}
+	}
+	log.Printf("event replay finished: %d events", len(entries))
+}
+
+// applyEvent makes the change entry records. Events that change nothing
+// stored, such as button presses and firmware progress, are skipped.
+func applyEvent(ctx context.Context, entry EventLogEntry) error {
+	if entry.Type == "reset" {
+		return applyResetEvent(ctx, entry.Devices)
+	}
+	if entry.Device == nil {
+		return nil
+	}
+	var device *Device
+	var err error
+	switch entry.Type {
+	case "update":
+		device, err = store.Update(ctx, entry.Device.ID, entry.Device.State)
+	case "added":
+		device, err = store.Add(cloneDevice(entry.Device))
+	case "removed":
+		device, err = store.Delete(ctx, entry.Device.ID)
+	case "renamed":
+		device, err = store.SetInfo(entry.Device.ID, entry.Device.Name, entry.Device.Room)
+	case "liveness":
+		device, err = store.SetOffline(entry.Device.ID, entry.Device.Offline)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	hub.PublishChange(ctx, WSMessage{Type: entry.Type, Device: device})
+	return nil
+}
+
+// applyResetEvent puts devices back to the states a logged reset gave them,
+// all or nothing, and broadcasts them as one reset.
+func applyResetEvent(ctx context.Context, devices []*Device) error {
+	updates := make([]DeviceUpdate, 0, len(devices))
+	for _, device := range devices {
+		updates = append(updates, DeviceUpdate{ID: device.ID, State: device.State})
+	}
+	results, err := store.UpdateMany(ctx, updates, false)
+	if err != nil {
+		return err
+	}
+	reset := make([]*Device, 0, len(results))
+	for _, result := range results {
+		reset = append(reset, result.Device)
+	}
+	if len(reset) > 0 {
+		hub.PublishChange(ctx, WSMessage{Type: "reset", Devices: reset})
+	}
+	return nil
+}
+
+// handleEventLog serves GET /api/debug/event-log, the log file as written.
+func handleEventLog(w http.ResponseWriter, r *http.Request) {
+	file, err := os.Open(filepath.Clean(eventLogPath))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer file.Close()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if _, err := io.Copy(w, file); err != nil {
+		log.Printf("write event log error: %v", err)
+	}
+}
+
+// handleReplayEventLog serves POST /api/debug/event-log/replay: it replays
+// the JSONL event log in the body, or the server's own when the body is
+// empty, and responds 202 once the log parses. ?speed= scales the pace, 1
+// being real time.
+func handleReplayEventLog(w http.ResponseWriter, r *http.Request) {
+	speed := 1.0
+	if raw := r.URL.Query().Get("speed"); raw != "" {
+		parsed, err := strconv.ParseFloat(raw, 64)
+		if err != nil || parsed <= 0 {
+			writeError(w, http.StatusBadRequest, "speed must be a positive number")
+			return
+		}
+		speed = parsed
+	}
+	var source io.Reader = r.Body
+	if r.ContentLength == 0 {
+		file, err := os.Open(filepath.Clean(eventLogPath))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer file.Close()
+		source = file
+	}
+	entries, err := readEventLog(source)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid event log: %v", err))
+		return
+	}
+	eventReplay.Lock()
+	defer eventReplay.Unlock()
+	if eventReplay.running {
+		writeError(w, http.StatusConflict, "event replay already running")
+		return
+	}
+	eventReplay.running = true
+	go replayEvents(entries, speed)
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"events": len(entries), "speed": speed})
+}
@@ -0,0 +1,37 @@
+package main
+
+import "time"
+
+type EventType string
+
+const (
+	EventClientConnected    EventType = "client_connected"
+	EventClientDisconnected EventType = "client_disconnected"
+	EventDeviceUpdated      EventType = "device_updated"
+	EventDevicePressed      EventType = "device_pressed"
+)
+
+const hubEventBuffer = 64
+
+// Event describes a hub lifecycle change for in-process observers. RemoteAddr
+// is set for client events and Device for device events.
+type Event struct {
+	Type       EventType
+	Time       time.Time
+	RemoteAddr string
+	Device     *Device
+}
+
+// Events returns the channel hub lifecycle events are delivered on. Delivery
+// never blocks the hub: events are dropped while the buffer is full.
+func (h *Hub) Events() <-chan Event {
+	return h.events
+}
+
+func (h *Hub) emit(event Event) {
+	event.Time = time.Now()
+	select {
+	case h.events <- event:
+	default:
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var errDeviceFault = errors.New("device fault")
+
+// Fault makes writes to Key of device ID fail with Error, simulating a
+// hardware failure such as a jammed blind motor, until it is cleared.
+type Fault struct {
+	ID    string `json:"id"`
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+// faults holds the injected faults by device ID and key.
+var faults = struct {
+	sync.RWMutex
+	byDevice map[string]map[string]string
+}{byDevice: make(map[string]map[string]string)}
+
+// checkFaults fails a write of state to the device with id if any of its
+// keys has a fault injected.
+func checkFaults(id string, state map[string]interface{}) error {
+	faults.RLock()
+	defer faults.RUnlock()
+	keys := faults.byDevice[id]
+	if len(keys) == 0 {
+		return nil
+	}
+	for key := range state {
+		if message, ok := keys[key]; ok {
+			return fmt.Errorf("%w: %s %s: %s", errDeviceFault, id, key, message)
+		}
+	}
+	return nil
+}
+
+func listFaults() []Fault {
+	faults.RLock()
+	defer faults.RUnlock()
+	list := []Fault{}
+	for id, keys := range faults.byDevice {
+		for key, message := range keys {
+			list = append(list, Fault{ID: id, Key: key, Error: message})
+		}
+	}
+	sortFaults(list)
+	return list
+}
+
+func injectFault(fault Fault) {
+	faults.Lock()
+	defer faults.Unlock()
+	if faults.byDevice[fault.ID] == nil {
+		faults.byDevice[fault.ID] = make(map[string]string)
+	}
+	faults.byDevice[fault.ID][fault.Key] = fault.Error
+}
+
+// clearFaults removes the fault on key of the device with id, every fault of
+// the device when key is empty, or every fault when id is empty too. It
+// returns the faults removed.
+func clearFaults(id, key string) []Fault {
+	faults.Lock()
+	defer faults.Unlock()
+	cleared := []Fault{}
+	for device, keys := range faults.byDevice {
+		if id != "" && device != id {
+			continue
+		}
+		for faultKey, message := range keys {
+			if key != "" && faultKey != key {
+				continue
+			}
+			cleared = append(cleared, Fault{ID: device, Key: faultKey, Error: message})
+			delete(keys, faultKey)
+		}
+		if len(keys) == 0 {
+			delete(faults.byDevice, device)
+		}
+	}
+	sortFaults(cleared)
+	return cleared
+}
+
+func sortFaults(list []Fault) {
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].ID != list[j].ID {
+			return list[i].ID < list[j].ID
+		}
+		return list[i].Key < list[j].Key
+	})
+}
+
+// handleFaults serves GET /api/faults, listing the injected faults, and
+// DELETE /api/faults, clearing them all and returning them.
+func handleFaults(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		writeJSON(w, http.StatusOK, clearFaults("", ""))
+		return
+	}
+	writeList(w, r, listFaults())
+}
+
+// handleFault serves PUT /api/faults/{id}/{key}, which injects a fault with
+// the body's {"error":...}, and DELETE /api/faults/{id}[/{key}], which clears
+// the fault or all of the device's faults and returns them.
+func handleFault(w http.ResponseWriter, r *http.Request) {
+	id, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/faults/"), "/")
+	if id == "" {
+		writeError(w, http.StatusNotFound, "device not found")
+		return
+	}
+	if r.Method == http.MethodDelete {
+		cleared := clearFaults(id, key)
+		if len(cleared) == 0 {
+			writeError(w, http.StatusNotFound, "fault not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, cleared)
+		return
+	}
+	if key == "" {
+		writeError(w, http.StatusNotFound, "fault needs a device id and key")
+		return
+	}
+	if _, ok := store.Get(id); !ok {
+		writeError(w, http.StatusNotFound, "device not found")
+		return
+	}
+	var payload struct {
+		Error string `json:"error"`
+	}
+	if err := decodeJSON(r.Body, &payload); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if strings.TrimSpace(payload.Error) == "" {
+		writeError(w, http.StatusBadRequest, "error is required")
+		return
+	}
+	fault := Fault{ID: id, Key: key, Error: payload.Error}
+	injectFault(fault)
+	writeJSON(w, http.StatusOK, fault)
+}
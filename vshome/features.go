@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+)
+
+// Optional subsystems -features can switch off. All are on unless -features
+// names a subset.
+const (
+	// featurePersistence covers the SQLite store (-db) and the prefs file
+	// (-prefs); without it both stay in memory.
+	featurePersistence = "persistence"
+	featureMetrics     = "metrics"
+	featureWebhooks    = "webhooks"
+	featureAudit       = "audit"
+	featureScenarios   = "scenarios"
+	featureReplays     = "replays"
+)
+
+var knownFeatures = []string{featurePersistence, featureMetrics, featureWebhooks, featureAudit, featureScenarios, featureReplays}
+
+// featureSet is the set of enabled optional subsystems.
+type featureSet map[string]bool
+
+// features is set from the config at startup.
+var features featureSet
+
+// parseFeatures reads a comma-separated feature list. An empty spec enables
+// every known feature and "none" disables them all. Unknown names are
+// logged and ignored so a config shared with newer builds still starts.
+func parseFeatures(spec string) featureSet {
+	enabled := make(featureSet)
+	if strings.TrimSpace(spec) == "" {
+		for _, name := range knownFeatures {
+			enabled[name] = true
+		}
+		return enabled
+	}
+	known := make(map[string]bool, len(knownFeatures))
+	for _, name := range knownFeatures {
+		known[name] = true
+	}
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch {
+		case name == "" || name == "none":
+		case known[name]:
+			enabled[name] = true
+		default:
+			log.Printf("ignoring unknown feature %q", name)
+		}
+	}
+	return enabled
+}
+
+func (f featureSet) enabled(name string) bool {
+	return f[name]
+}
+
+// list returns the enabled features, sorted.
+func (f featureSet) list() []string {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyFeatures clears the settings of disabled subsystems in config so main
+// does not start them, warning about any that were configured.
+func applyFeatures(config *Config, enabled featureSet) {
+	disable := func(feature, setting string, value *string) {
+		if enabled.enabled(feature) || *value == "" {
+			return
+		}
+		log.Printf("feature %s is disabled, ignoring %s", feature, setting)
+		*value = ""
+	}
+	disable(featurePersistence, "-db", &config.DBPath)
+	disable(featurePersistence, "-prefs", &config.PrefsPath)
+	disable(featureWebhooks, "-webhooks", &config.Webhooks)
+	disable(featureAudit, "-audit-log", &config.Audit.Path)
+	disable(featureScenarios, "-scenarios", &config.Scenarios)
+}
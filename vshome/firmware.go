@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// firmwareUpdateDuration is how long a simulated firmware update keeps a
+// device busy before it comes back on the new version.
+const firmwareUpdateDuration = 3 * time.Second
+
+var errFirmwareBusy = errors.New("firmware update in progress")
+
+// semverPattern is the semver.org 2.0.0 grammar: MAJOR.MINOR.PATCH with
+// optional -prerelease and +build parts.
+var semverPattern = regexp.MustCompile(`^(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)` +
+	`(?:-((?:0|[1-9]\d*|\d*[a-zA-Z-][0-9a-zA-Z-]*)(?:\.(?:0|[1-9]\d*|\d*[a-zA-Z-][0-9a-zA-Z-]*))*))?` +
+	`(?:\+([0-9a-zA-Z-]+(?:\.[0-9a-zA-Z-]+)*))?$`)
+
+func validSemver(field, version string) error {
+	if !semverPattern.MatchString(version) {
+		return fmt.Errorf("%w: %s %q is not a semantic version such as 1.4.2", errInvalidValue, field, version)
+	}
+	return nil
+}
+
+// validateFirmware checks the optional firmware versions of a catalog or
+// created device.
+func validateFirmware(device *Device) error {
+	if device.Firmware != "" {
+		if err := validSemver("firmware", device.Firmware); err != nil {
+			return err
+		}
+	}
+	if device.LatestFirmware != "" {
+		if err := validSemver("latest_firmware", device.LatestFirmware); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compareSemver orders two valid versions by semver precedence, returning -1,
+// 0, or 1. Build metadata is ignored.
+func compareSemver(a, b string) int {
+	ma, mb := semverPattern.FindStringSubmatch(a), semverPattern.FindStringSubmatch(b)
+	for i := 1; i <= 3; i++ {
+		x, _ := strconv.ParseUint(ma[i], 10, 64)
+		y, _ := strconv.ParseUint(mb[i], 10, 64)
+		if x != y {
+			return compareOrder(x < y)
+		}
+	}
+	switch {
+	case ma[4] == mb[4]:
+		return 0
+	case ma[4] == "":
+		return 1
+	case mb[4] == "":
+		return -1
+	}
+	pa, pb := strings.Split(ma[4], "."), strings.Split(mb[4], ".")
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		if pa[i] == pb[i] {
+			continue
+		}
+		x, errX := strconv.ParseUint(pa[i], 10, 64)
+		y, errY := strconv.ParseUint(pb[i], 10, 64)
+		switch {
+		case errX == nil && errY == nil:
+			return compareOrder(x < y)
+		case errX == nil:
+			return -1
+		case errY == nil:
+			return 1
+		}
+		return compareOrder(pa[i] < pb[i])
+	}
+	if len(pa) == len(pb) {
+		return 0
+	}
+	return compareOrder(len(pa) < len(pb))
+}
+
+func compareOrder(less bool) int {
+	if less {
+		return -1
+	}
+	return 1
+}
+
+// updateAvailable reports whether the device has a newer firmware to install.
+func (d Device) updateAvailable() bool {
+	return d.Firmware != "" && d.LatestFirmware != "" && compareSemver(d.LatestFirmware, d.Firmware) > 0
+}
+
+// handleUpdateFirmware serves POST /api/devices/{id}/update-firmware. The
+// device installs {"version":...}, or its latest_firmware when the body is
+// empty: it is marked updating, rejecting writes with 409, and comes back on
+// the new version after firmwareUpdateDuration. Both steps are
+// broadcast as "firmware" messages.
+func handleUpdateFirmware(w http.ResponseWriter, r *http.Request, id string) {
+	var payload struct {
+		Version string `json:"version"`
+	}
+	if r.ContentLength != 0 {
+		if err := decodeJSON(r.Body, &payload); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid json")
+			return
+		}
+	}
+	device, ok := store.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "device not found")
+		return
+	}
+	version := payload.Version
+	if version == "" {
+		version = device.LatestFirmware
+	}
+	if version == "" {
+		writeStoreError(w, fmt.Errorf("%w: %s has no latest_firmware, give a version", errInvalidValue, id))
+		return
+	}
+	if err := validSemver("version", version); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if device.Firmware != "" && compareSemver(version, device.Firmware) <= 0 {
+		writeError(w, http.StatusConflict, fmt.Sprintf("%s already runs firmware %s", id, device.Firmware))
+		return
+	}
+	updating, err := store.BeginFirmwareUpdate(id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	hub.PublishChange(r.Context(), WSMessage{Type: "firmware", Device: updating})
+	time.AfterFunc(firmwareUpdateDuration, func() {
+		updated, err := store.FinishFirmwareUpdate(id, version)
+		if err != nil {
+			log.Printf("firmware update of %s failed: %v", id, err)
+			return
+		}
+		hub.PublishChange(systemContext(), WSMessage{Type: "firmware", Device: updated})
+	})
+	writeJSON(w, http.StatusAccepted, visibleDevice(r, updating))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// wantsFlat reports whether the caller asked for ?flat=true.
+func wantsFlat(r *http.Request) bool {
+	return r.URL.Query().Get("flat") == "true"
+}
+
+// projectKeys returns device with only the state keys named by ?keys=,
+// comma-separated or repeated; keys it does not have are left out. Without
+// ?keys= the device is returned whole.
+func projectKeys(r *http.Request, device *Device) *Device {
+	var keys []string
+	for _, key := range queryValues(r.URL.Query()["keys"]) {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return device
+	}
+	projected := *device
+	projected.State = make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		if value, ok := device.State[key]; ok {
+			projected.State[key] = value
+		}
+	}
+	return &projected
+}
+
+// flattenDevices maps "<id>.<key>" to every leaf of each device's state, for
+// consumers that only take flat key-value pairs. Nested objects add dotted
+// segments and arrays add their index, so {"rgb":[255,0,0]} on lamp becomes
+// "lamp.rgb.0", "lamp.rgb.1", and "lamp.rgb.2".
+func flattenDevices(devices []*Device) map[string]interface{} {
+	flat := make(map[string]interface{})
+	for _, device := range devices {
+		flattenValue(flat, device.ID, device.State)
+	}
+	return flat
+}
+
+// flattenValue writes value under prefix. Empty objects and arrays are kept as
+// leaves so the key does not disappear.
+func flattenValue(flat map[string]interface{}, prefix string, value interface{}) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		if len(value) == 0 {
+			flat[prefix] = value
+			return
+		}
+		for key, nested := range value {
+			flattenValue(flat, prefix+"."+key, nested)
+		}
+	case []interface{}:
+		if len(value) == 0 {
+			flat[prefix] = value
+			return
+		}
+		for i, nested := range value {
+			flattenValue(flat, prefix+"."+strconv.Itoa(i), nested)
+		}
+	default:
+		flat[prefix] = value
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// groupDevices buckets devices by their room or kind, keeping their order
+// within each group. Devices without a room are grouped under "".
+func groupDevices(devices []*Device, by string) (map[string][]*Device, error) {
+	var key func(*Device) string
+	switch by {
+	case "room":
+		key = func(d *Device) string { return d.Room }
+	case "kind":
+		key = func(d *Device) string { return d.Kind }
+	default:
+		return nil, fmt.Errorf("group_by must be room or kind, not %q", by)
+	}
+	groups := make(map[string][]*Device)
+	for _, device := range devices {
+		groups[key(device)] = append(groups[key(device)], device)
+	}
+	return groups, nil
+}
+
+// devicesPayload is what GET /api/devices returns for r: the devices as a
+// flat map, grouped with ?group_by=, or as a list that may be paged.
+func devicesPayload(r *http.Request, devices []*Device) (interface{}, error) {
+	query := r.URL.Query()
+	by := query.Get("group_by")
+	if by == "" {
+		if wantsFlat(r) {
+			return flattenDevices(devices), nil
+		}
+		return listPayload(r, devices)
+	}
+	if wantsFlat(r) || query.Get("limit") != "" || query.Get("offset") != "" {
+		return nil, errors.New("group_by cannot be combined with flat, limit, or offset")
+	}
+	return groupDevices(devices, by)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultHistoryLimit = 100
+
+// defaultActivityLimit is how many entries GET /api/history returns when it
+// is not paged.
+const defaultActivityLimit = 50
+
+// StateChange is one key's transition within a history entry. Removed marks a
+// key deleted from the state, as opposed to one set to null.
+type StateChange struct {
+	Old     interface{} `json:"old"`
+	New     interface{} `json:"new"`
+	Removed bool        `json:"removed,omitempty"`
+}
+
+// HistoryEntry records only the keys an update changed.
+type HistoryEntry struct {
+	Time      time.Time              `json:"time"`
+	RequestID string                 `json:"request_id,omitempty"`
+	Changes   map[string]StateChange `json:"changes"`
+}
+
+// ActivityEntry is a history entry tagged with its device, for the feed of
+// changes across all devices.
+type ActivityEntry struct {
+	ID string `json:"id"`
+	HistoryEntry
+}
+
+// HistorySnapshot is the full state after an entry, rebuilt on demand.
+type HistorySnapshot struct {
+	Time      time.Time              `json:"time"`
+	RequestID string                 `json:"request_id,omitempty"`
+	State     map[string]interface{} `json:"state"`
+}
+
+// deviceHistory keeps the state as it was before the oldest retained entry,
+// so any snapshot can be rebuilt by replaying deltas over it.
+type deviceHistory struct {
+	base    map[string]interface{}
+	entries []HistoryEntry
+}
+
+// History keeps a bounded list of state deltas per device. Entries beyond the
+// limit are folded into the base state.
+type History struct {
+	mu      sync.RWMutex
+	limit   int
+	devices map[string]*deviceHistory
+}
+
+var history *History
+
+func NewHistory(limit int) *History {
+	return &History{limit: limit, devices: make(map[string]*deviceHistory)}
+}
+
+// Seed starts tracking device from its current state if it is not tracked yet.
+func (h *History) Seed(device *Device) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.devices[device.ID]; !ok {
+		h.devices[device.ID] = &deviceHistory{base: copyState(device.State)}
+	}
+}
+
+// Record appends the delta between previous and current. Updates that change
+// nothing are not recorded.
+func (h *History) Record(previous, current *Device, requestID string) {
+	if previous == nil {
+		h.Seed(current)
+		return
+	}
+	changes := diffState(previous.State, current.State)
+	if len(changes) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	tracked, ok := h.devices[current.ID]
+	if !ok {
+		tracked = &deviceHistory{base: copyState(previous.State)}
+		h.devices[current.ID] = tracked
+	}
+	if h.limit > 0 && len(tracked.entries) >= h.limit {
+		applyChanges(tracked.base, tracked.entries[0].Changes)
+		copy(tracked.entries, tracked.entries[1:])
+		tracked.entries = tracked.entries[:len(tracked.entries)-1]
+	}
+	tracked.entries = append(tracked.entries, HistoryEntry{
+		Time:      time.Now().UTC(),
+		RequestID: requestID,
+		Changes:   changes,
+	})
+}
+
+func (h *History) Forget(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.devices, id)
+}
+
+// Entries returns the deltas for id, oldest first.
+func (h *History) Entries(id string) ([]HistoryEntry, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	tracked, ok := h.devices[id]
+	if !ok {
+		return nil, false
+	}
+	entries := make([]HistoryEntry, len(tracked.entries))
+	copy(entries, tracked.entries)
+	return entries, true
+}
+
+// Recent returns the entries newer than since from the devices in ids, newest
+// first.
+func (h *History) Recent(ids map[string]bool, since time.Time) []ActivityEntry {
+	h.mu.RLock()
+	var recent []ActivityEntry
+	for id, tracked := range h.devices {
+		if !ids[id] {
+			continue
+		}
+		for _, entry := range tracked.entries {
+			if entry.Time.After(since) {
+				recent = append(recent, ActivityEntry{ID: id, HistoryEntry: entry})
+			}
+		}
+	}
+	h.mu.RUnlock()
+	sort.SliceStable(recent, func(i, j int) bool {
+		return recent[i].Time.After(recent[j].Time)
+	})
+	return recent
+}
+
+// Snapshots replays the deltas for id over its base state and returns the
+// full state after each entry, oldest first.
+func (h *History) Snapshots(id string) ([]HistorySnapshot, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	tracked, ok := h.devices[id]
+	if !ok {
+		return nil, false
+	}
+	state := copyState(tracked.base)
+	snapshots := make([]HistorySnapshot, 0, len(tracked.entries))
+	for _, entry := range tracked.entries {
+		applyChanges(state, entry.Changes)
+		snapshots = append(snapshots, HistorySnapshot{
+			Time:      entry.Time,
+			RequestID: entry.RequestID,
+			State:     copyState(state),
+		})
+	}
+	return snapshots, true
+}
+
+func diffState(old, new map[string]interface{}) map[string]StateChange {
+	changes := make(map[string]StateChange)
+	for key, value := range new {
+		previous, existed := old[key]
+		if !existed || !reflect.DeepEqual(previous, value) {
+			changes[key] = StateChange{Old: previous, New: value}
+		}
+	}
+	for key, value := range old {
+		if _, ok := new[key]; !ok {
+			changes[key] = StateChange{Old: value, Removed: true}
+		}
+	}
+	return changes
+}
+
+func applyChanges(state map[string]interface{}, changes map[string]StateChange) {
+	for key, change := range changes {
+		if change.Removed {
+			delete(state, key)
+			continue
+		}
+		state[key] = change.New
+	}
+}
+
+// handleDeviceHistory serves GET /api/devices/{id}/history with the recorded
+// deltas, or with ?full=true the reconstructed state after each change.
+func handleDeviceHistory(w http.ResponseWriter, r *http.Request, id string) {
+	device, ok := store.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "device not found")
+		return
+	}
+	private := showPrivate(r)
+	if r.URL.Query().Get("full") == "true" {
+		snapshots, ok := history.Snapshots(id)
+		if !ok {
+			snapshots = []HistorySnapshot{}
+		}
+		if !private {
+			for i := range snapshots {
+				snapshots[i].State = redactState(device.schemaKind(), snapshots[i].State)
+			}
+		}
+		writeJSON(w, http.StatusOK, snapshots)
+		return
+	}
+	entries, ok := history.Entries(id)
+	if !ok {
+		entries = []HistoryEntry{}
+	}
+	if !private {
+		entries = redactEntries(device.schemaKind(), entries)
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// redactEntries drops private keys from entries, and entries that changed
+// nothing else.
+func redactEntries(kind string, entries []HistoryEntry) []HistoryEntry {
+	redacted := make([]HistoryEntry, 0, len(entries))
+	for _, entry := range entries {
+		changes := make(map[string]StateChange, len(entry.Changes))
+		for key, change := range entry.Changes {
+			if !isPrivateKey(kind, key) {
+				changes[key] = change
+			}
+		}
+		if len(changes) == 0 {
+			continue
+		}
+		entry.Changes = changes
+		redacted = append(redacted, entry)
+	}
+	return redacted
+}
+
+// handleHistory serves GET /api/history: the most recent changes across all
+// devices, newest first, optionally limited to changes after ?since= (RFC
+// 3339) and to devices of a ?kind= or in a ?room=. Unpaged it returns the
+// newest defaultActivityLimit entries.
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var since time.Time
+	if raw := query.Get("since"); raw != "" {
+		parsed, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "since must be an RFC 3339 time")
+			return
+		}
+		since = parsed
+	}
+	kind, room := query.Get("kind"), query.Get("room")
+	kinds := make(map[string]string)
+	ids := make(map[string]bool)
+	for _, device := range store.List() {
+		if !matchesFilter(device, kind, room) {
+			continue
+		}
+		ids[device.ID] = true
+		kinds[device.ID] = device.schemaKind()
+	}
+	entries := history.Recent(ids, since)
+	if !showPrivate(r) {
+		redacted := make([]ActivityEntry, 0, len(entries))
+		for _, entry := range entries {
+			visible := redactEntries(kinds[entry.ID], []HistoryEntry{entry.HistoryEntry})
+			if len(visible) == 0 {
+				continue
+			}
+			entry.HistoryEntry = visible[0]
+			redacted = append(redacted, entry)
+		}
+		entries = redacted
+	}
+	if entries == nil {
+		entries = []ActivityEntry{}
+	}
+	if _, _, paged, _ := pageParams(r); !paged && len(entries) > defaultActivityLimit {
+		entries = entries[:defaultActivityLimit]
+	}
+	writeList(w, r, entries)
+}
@@ -0,0 +1,94 @@
+package main
+
+import "time"
+
+// holdTimeout is how long a hold lasts unless the client renews it with
+// another hold or ends it with a release.
+const holdTimeout = 5 * time.Second
+
+// holding reports whether c holds the device with id, in which case it is
+// left out of that device's broadcasts.
+func (c *client) holding(id string) bool {
+	c.holdMu.Lock()
+	defer c.holdMu.Unlock()
+	_, ok := c.holds[id]
+	return ok
+}
+
+// hold starts or renews c's hold on id, calling expire if it is neither
+// renewed nor released within holdTimeout.
+func (c *client) hold(id string, expire func()) {
+	c.holdMu.Lock()
+	defer c.holdMu.Unlock()
+	if timer, ok := c.holds[id]; ok {
+		timer.Stop()
+	}
+	if c.holds == nil {
+		c.holds = make(map[string]*time.Timer)
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(holdTimeout, func() {
+		c.holdMu.Lock()
+		current := c.holds[id] == timer
+		if current {
+			delete(c.holds, id)
+		}
+		c.holdMu.Unlock()
+		if current {
+			expire()
+		}
+	})
+	c.holds[id] = timer
+}
+
+// release ends c's hold on id and reports whether there was one.
+func (c *client) release(id string) bool {
+	c.holdMu.Lock()
+	defer c.holdMu.Unlock()
+	timer, ok := c.holds[id]
+	if ok {
+		timer.Stop()
+		delete(c.holds, id)
+	}
+	return ok
+}
+
+// releaseAll ends every hold c has, when it disconnects.
+func (c *client) releaseAll() {
+	c.holdMu.Lock()
+	defer c.holdMu.Unlock()
+	for id, timer := range c.holds {
+		timer.Stop()
+		delete(c.holds, id)
+	}
+}
+
+// handleHold starts or renews a hold for c and confirms it with a held
+// message. While it lasts c gets no broadcasts of the device, so a slider it
+// is dragging is not pulled back by the echoes of its own sets; everyone else
+// still does, and c still gets the acks and errors for its sets.
+func (h *Hub) handleHold(c *client, incoming WSClientMessage) {
+	if _, ok := h.store.Get(incoming.ID); !ok {
+		c.sendJSON(WSMessage{Type: "error", Error: "device not found", RequestID: incoming.RequestID})
+		return
+	}
+	id := incoming.ID
+	c.hold(id, func() { h.sendReleased(c, id, "") })
+	c.sendJSON(WSMessage{Type: "held", ID: id, RequestID: incoming.RequestID})
+}
+
+// handleRelease ends a hold for c. The released reply carries the device's
+// current state, which c may have missed broadcasts of.
+func (h *Hub) handleRelease(c *client, incoming WSClientMessage) {
+	c.release(incoming.ID)
+	h.sendReleased(c, incoming.ID, incoming.RequestID)
+}
+
+func (h *Hub) sendReleased(c *client, id, requestID string) {
+	device, ok := h.store.Get(id)
+	if !ok {
+		c.sendJSON(WSMessage{Type: "error", Error: "device not found", RequestID: requestID})
+		return
+	}
+	c.sendJSON(WSMessage{Type: "released", ID: id, Device: c.visible(device), RequestID: requestID})
+}
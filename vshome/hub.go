@@ -0,0 +1,1100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// defaultQueueSize is how many messages may wait for a client unless
+	// configured otherwise.
+	defaultQueueSize = 64
+	// defaultMessageLimit caps the size of a single WS message in either
+	// direction unless configured otherwise.
+	defaultMessageLimit = 64 << 10
+	writeWait           = 10 * time.Second
+	// wsSubprotocol is echoed to clients that offer it. Clients offering only
+	// unknown subprotocols still connect, without one.
+	wsSubprotocol = "vshome.v1"
+)
+
+type WSMessage struct {
+	Type       string                `json:"type"`
+	Device     *Device               `json:"device,omitempty"`
+	Devices    []*Device             `json:"devices,omitempty"`
+	Error      string                `json:"error,omitempty"`
+	Transition map[string]Transition `json:"transition,omitempty"`
+	// RequestID names the API request or WS command that caused the message.
+	RequestID string       `json:"request_id,omitempty"`
+	Session   *SessionInfo `json:"session,omitempty"`
+	// ResumeToken, sent in hello, restores this connection's subscription
+	// when presented as ?resume= on a reconnect.
+	ResumeToken string `json:"resume_token,omitempty"`
+	Resumed     bool   `json:"resumed,omitempty"`
+	// ClientID, sent in hello, identifies the connection in X-Client-ID.
+	ClientID string `json:"client_id,omitempty"`
+	// ID and Event describe a momentary event, such as a button press, that
+	// changes no state.
+	ID    string `json:"id,omitempty"`
+	Event string `json:"event,omitempty"`
+	// Reason and ReconnectAfter, in seconds, come with server_shutdown.
+	Reason         string  `json:"reason,omitempty"`
+	ReconnectAfter float64 `json:"reconnect_after,omitempty"`
+	// ClientSeq echoes the client_seq of the set that caused the message, and
+	// is only sent to the client that set it.
+	ClientSeq *int64 `json:"client_seq,omitempty"`
+	// All, IDs, and Rooms describe the subscription a subscribed message
+	// confirms; InvalidIDs and InvalidRooms are the requested ones that
+	// match no device and were left out.
+	All          bool     `json:"all,omitempty"`
+	IDs          []string `json:"ids,omitempty"`
+	Rooms        []string `json:"rooms,omitempty"`
+	InvalidIDs   []string `json:"invalid_ids,omitempty"`
+	InvalidRooms []string `json:"invalid_rooms,omitempty"`
+	// Seq numbers every broadcast, and in state and caught_up gives the last
+	// broadcast the client is up to date with; see backfill.go.
+	Seq uint64 `json:"seq,omitempty"`
+	// Messages are the updates a batch carries, each as it would have been
+	// sent on its own.
+	Messages []json.RawMessage `json:"messages,omitempty"`
+
+	// origin is the ID of the client that caused the change, if any.
+	origin string
+	// clientSeq is the origin's client_seq, copied into ClientSeq for it.
+	clientSeq *int64
+	// target is the device an event is about, for subscription filtering.
+	target         *Device
+	simulation     *simulation
+	simulatedValue float64
+}
+
+// WSClientMessage is any message a client sends; fields are used according to
+// Type.
+type WSClientMessage struct {
+	Type      string                 `json:"type"`
+	ID        string                 `json:"id"`
+	State     map[string]interface{} `json:"state"`
+	IDs       []string               `json:"ids"`
+	Rooms     []string               `json:"rooms"`
+	RequestID string                 `json:"request_id"`
+	ClientSeq *int64                 `json:"client_seq"`
+}
+
+// subscription limits which device messages a client receives. An empty
+// subscription matches every device, unless it was emptied incrementally.
+type subscription struct {
+	ids   map[string]struct{}
+	rooms map[string]struct{}
+	// incremental marks a subscription adjusted by subscribe_add or
+	// subscribe_remove; once emptied it matches nothing, so removing the
+	// last visible device does not subscribe a client to everything.
+	incremental bool
+}
+
+func newSubscription(ids, rooms []string) subscription {
+	sub := subscription{}
+	for _, id := range ids {
+		if id == "" {
+			continue
+		}
+		if sub.ids == nil {
+			sub.ids = make(map[string]struct{})
+		}
+		sub.ids[id] = struct{}{}
+	}
+	for _, room := range rooms {
+		room = strings.ToLower(strings.TrimSpace(room))
+		if room == "" {
+			continue
+		}
+		if sub.rooms == nil {
+			sub.rooms = make(map[string]struct{})
+		}
+		sub.rooms[room] = struct{}{}
+	}
+	return sub
+}
+
+// adjust returns a copy of s with ids and rooms added, or removed when add is
+// false. The copy is incremental.
+func (s subscription) adjust(ids, rooms []string, add bool) subscription {
+	changes := newSubscription(ids, rooms)
+	return subscription{
+		ids:         adjustSet(s.ids, changes.ids, add),
+		rooms:       adjustSet(s.rooms, changes.rooms, add),
+		incremental: true,
+	}
+}
+
+func adjustSet(set, changes map[string]struct{}, add bool) map[string]struct{} {
+	adjusted := make(map[string]struct{}, len(set)+len(changes))
+	for key := range set {
+		adjusted[key] = struct{}{}
+	}
+	for key := range changes {
+		if add {
+			adjusted[key] = struct{}{}
+		} else {
+			delete(adjusted, key)
+		}
+	}
+	return adjusted
+}
+
+func (s subscription) matches(device *Device) bool {
+	if len(s.ids) == 0 && len(s.rooms) == 0 {
+		return !s.incremental
+	}
+	if _, ok := s.ids[device.ID]; ok {
+		return true
+	}
+	_, ok := s.rooms[strings.ToLower(device.Room)]
+	return ok
+}
+
+// idList and roomList return the subscription's filters, sorted.
+func (s subscription) idList() []string {
+	return sortedKeys(s.ids)
+}
+
+func (s subscription) roomList() []string {
+	return sortedKeys(s.rooms)
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s subscription) filter(devices []*Device) []*Device {
+	filtered := make([]*Device, 0, len(devices))
+	for _, device := range devices {
+		if s.matches(device) {
+			filtered = append(filtered, device)
+		}
+	}
+	return filtered
+}
+
+// queryValues splits repeated and comma-separated query parameter values.
+func queryValues(values []string) []string {
+	var out []string
+	for _, value := range values {
+		out = append(out, strings.Split(value, ",")...)
+	}
+	return out
+}
+
+// client owns a single websocket connection. All writes go through the send
+// queue so that only writePump ever writes to the connection.
+type client struct {
+	conn        Conn
+	send        chan queuedMessage
+	done        chan struct{}
+	closeOnce   sync.Once
+	evictOnce   sync.Once
+	remoteAddr  string
+	connectedAt time.Time
+	ctx         context.Context
+	subMu       sync.RWMutex
+	sub         subscription
+	dropped     atomic.Uint64
+	bytesSent   atomic.Uint64
+	// showPrivate is set for admins connecting with ?private=true.
+	showPrivate bool
+	// unit is the temperature unit the client reads, fixed at connect.
+	unit string
+	// readOnly limits the client to readOnlyMessageTypes.
+	readOnly bool
+	// messageLimit is the largest message accepted from or meant for the
+	// client.
+	messageLimit int
+	resumeToken  string
+	id           string
+	// slowPolicy and queueMaxAge come from the hub; evictions is its counter.
+	slowPolicy  string
+	queueMaxAge time.Duration
+	evictions   *atomic.Uint64
+	// pingInterval is how often writePump pings a connection that needs it.
+	pingInterval time.Duration
+	// counts is the hub's message counter.
+	counts *messageCounts
+	// holds maps the devices the client holds to their expiry timers.
+	holdMu sync.Mutex
+	holds  map[string]*time.Timer
+	// batch holds updates during the hub's flush window; nil sends each
+	// update as it comes.
+	batch *updateBatch
+}
+
+// SessionInfo is the server's view of one connection, sent in reply to
+// whoami. Empty IDs and Rooms mean the client receives every device.
+type SessionInfo struct {
+	RemoteAddr    string    `json:"remote_addr"`
+	Identity      string    `json:"identity"`
+	Role          string    `json:"role,omitempty"`
+	IDs           []string  `json:"ids"`
+	Rooms         []string  `json:"rooms"`
+	Private       bool      `json:"private"`
+	Subprotocol   string    `json:"subprotocol,omitempty"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	UptimeSeconds float64   `json:"uptime_seconds"`
+	MessageLimit  int       `json:"message_limit"`
+	ReadOnly      bool      `json:"read_only,omitempty"`
+}
+
+type ClientStats struct {
+	ID            string    `json:"id"`
+	RemoteAddr    string    `json:"remote_addr"`
+	Identity      string    `json:"identity"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	UptimeSeconds float64   `json:"uptime_seconds"`
+	IDs           []string  `json:"ids"`
+	Rooms         []string  `json:"rooms"`
+	QueueDepth    int       `json:"queue_depth"`
+	QueueCapacity int       `json:"queue_capacity"`
+	Dropped       uint64    `json:"dropped"`
+	BytesSent     uint64    `json:"bytes_sent"`
+	Subprotocol   string    `json:"subprotocol,omitempty"`
+}
+
+func newClient(conn Conn, r *http.Request, queueSize int) *client {
+	return &client{
+		conn:        conn,
+		send:        make(chan queuedMessage, queueSize),
+		done:        make(chan struct{}),
+		remoteAddr:  r.RemoteAddr,
+		connectedAt: time.Now(),
+		ctx:         withIdentity(context.Background(), identityFrom(r.Context())),
+		showPrivate: showPrivate(r),
+		unit:        requestUnit(r),
+	}
+}
+
+// enqueue queues payload without blocking, after any batched updates. When
+// the queue is full the client is lagging, and the message is dropped or the
+// client evicted instead of stalling the broadcaster.
+func (c *client) enqueue(payload []byte) bool {
+	c.flushBatch()
+	return c.enqueueNow(payload)
+}
+
+func (c *client) enqueueNow(payload []byte) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	select {
+	case c.send <- queuedMessage{payload: payload, queued: time.Now()}:
+		return true
+	default:
+		c.lagging(fmt.Sprintf("send queue full (%d messages)", cap(c.send)))
+		return false
+	}
+}
+
+func (c *client) sendJSON(message WSMessage) {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("websocket encode failed: %v", err)
+		return
+	}
+	warnOversized(c.messageLimit, message.Type, payload)
+	if c.enqueue(payload) {
+		c.counts.sent(message.Type)
+	}
+}
+
+// warnOversized logs a message larger than limit. Clients are told the limit
+// through whoami and one enforcing it would drop the connection on receipt.
+func warnOversized(limit int, messageType string, payload []byte) {
+	if limit > 0 && len(payload) > limit {
+		log.Printf("websocket %s message is %d bytes, over the %d byte message limit", messageType, len(payload), limit)
+	}
+}
+
+func (c *client) writePump() {
+	var pings <-chan time.Time
+	if _, ok := c.conn.(pinger); ok && c.pingInterval > 0 {
+		ticker := time.NewTicker(c.pingInterval)
+		defer ticker.Stop()
+		pings = ticker.C
+	}
+	for {
+		select {
+		case <-pings:
+			if err := c.conn.(pinger).Ping(); err != nil {
+				log.Printf("websocket ping to %s failed: %v", c.remoteAddr, err)
+				c.close()
+				return
+			}
+		case message := <-c.send:
+			if age := time.Since(message.queued); c.queueMaxAge > 0 && age > c.queueMaxAge {
+				c.lagging(fmt.Sprintf("message queued for %s", age.Round(time.Millisecond)))
+				continue
+			}
+			if err := c.conn.WriteMessage(message.payload); err != nil {
+				log.Printf("websocket write to %s failed: %v", c.remoteAddr, err)
+				c.close()
+				return
+			}
+			c.bytesSent.Add(uint64(len(message.payload)))
+			if message.closeCode != 0 {
+				c.kick(message.closeCode, message.closeReason)
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// kick closes the connection with a close frame carrying code and reason, for
+// connections that support one.
+func (c *client) kick(code int, reason string) {
+	if framer, ok := c.conn.(closeFramer); ok {
+		_ = framer.WriteClose(code, reason)
+	}
+	c.close()
+}
+
+func (c *client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		_ = c.conn.Close()
+	})
+}
+
+func (c *client) currentSubscription() subscription {
+	c.subMu.RLock()
+	defer c.subMu.RUnlock()
+	return c.sub
+}
+
+func (c *client) setSubscription(sub subscription) {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	c.sub = sub
+}
+
+// adjustSubscription adds ids and rooms to the client's subscription, or
+// removes them when add is false.
+func (c *client) adjustSubscription(ids, rooms []string, add bool) {
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	c.sub = c.sub.adjust(ids, rooms, add)
+}
+
+// visible is device as c should see it; see visibleDevice.
+func (c *client) visible(device *Device) *Device {
+	if !c.showPrivate {
+		device = redactDevice(device)
+	}
+	return localizeDevice(device, c.unit)
+}
+
+func (c *client) wants(message WSMessage) bool {
+	device := message.Device
+	if device == nil {
+		device = message.target
+	}
+	if device == nil && message.Devices != nil {
+		return len(c.wantedDevices(message.Devices)) > 0
+	}
+	if device == nil {
+		return true
+	}
+	return c.currentSubscription().matches(device)
+}
+
+// wantedDevices returns those of the devices a broadcast carries that c is
+// subscribed to and not holding.
+func (c *client) wantedDevices(devices []*Device) []*Device {
+	sub := c.currentSubscription()
+	var wanted []*Device
+	for _, device := range devices {
+		if sub.matches(device) && !c.holding(device.ID) {
+			wanted = append(wanted, device)
+		}
+	}
+	return wanted
+}
+
+func (c *client) session() *SessionInfo {
+	identity := identityFrom(c.ctx)
+	sub := c.currentSubscription()
+	return &SessionInfo{
+		RemoteAddr:    c.remoteAddr,
+		Identity:      identity.Name,
+		Role:          identity.Role,
+		IDs:           sub.idList(),
+		Rooms:         sub.roomList(),
+		Private:       c.showPrivate,
+		Subprotocol:   c.conn.Subprotocol(),
+		ConnectedAt:   c.connectedAt.UTC(),
+		UptimeSeconds: time.Since(c.connectedAt).Seconds(),
+		MessageLimit:  c.messageLimit,
+		ReadOnly:      c.readOnly,
+	}
+}
+
+func (c *client) stats() ClientStats {
+	sub := c.currentSubscription()
+	return ClientStats{
+		ID:            c.id,
+		RemoteAddr:    c.remoteAddr,
+		Identity:      identityFrom(c.ctx).Name,
+		ConnectedAt:   c.connectedAt,
+		UptimeSeconds: time.Since(c.connectedAt).Seconds(),
+		IDs:           sub.idList(),
+		Rooms:         sub.roomList(),
+		QueueDepth:    len(c.send),
+		QueueCapacity: cap(c.send),
+		Dropped:       c.dropped.Load(),
+		BytesSent:     c.bytesSent.Load(),
+		Subprotocol:   c.conn.Subprotocol(),
+	}
+}
+
+type Hub struct {
+	mu        sync.Mutex
+	clients   map[*client]struct{}
+	upgrader  websocket.Upgrader
+	store     DeviceStore
+	broadcast chan WSMessage
+	events    chan Event
+
+	history *History
+	// messageLimit is the read limit for client messages and the size above
+	// which outgoing messages are logged; 0 disables both.
+	messageLimit int
+	resume       *resumeStore
+	// queueSize, queueMaxAge, and slowClient set how clients that fall behind
+	// are handled; evictions counts the ones disconnected for it.
+	queueSize   int
+	queueMaxAge time.Duration
+	slowClient  string
+	evictions   atomic.Uint64
+	counts      messageCounts
+	// pingInterval and pongWait set the heartbeat that detects dead
+	// connections; idleTimeout, when positive, closes connections whose
+	// client has sent no message for that long even if they answer pings.
+	pingInterval time.Duration
+	pongWait     time.Duration
+	idleTimeout  time.Duration
+	// batchWindow is how long updates wait to be sent together in one
+	// batch message, 0 for none.
+	batchWindow time.Duration
+	// anonymousReadOnly limits anonymous connections as it does viewers.
+	anonymousReadOnly bool
+	// echo is what a client receives for a change it caused: echoAll,
+	// echoSkip, or echoAck.
+	echo string
+	// skipNoops drops updates that leave a device's state as it was, apart
+	// from the echo to the client that made them.
+	skipNoops bool
+	// minDeltas holds back updates too small to be worth broadcasting.
+	minDeltas minDeltaTable
+	// recent numbers broadcasts and keeps the latest for backfill.
+	recent *backfillRing
+	// eventLog, if set, gets every broadcast as a JSON line; see eventlog.go.
+	eventLog io.Writer
+
+	// Owned by the Run goroutine.
+	transitions transitionTable
+	lastDevice  map[string]*Device
+	simulations map[string]*simulation
+	// lastSent is each device as last broadcast, kept while minDeltas has
+	// entries.
+	lastSent map[string]*Device
+	// hysteresis are the catalog's hysteresis rules, whose actions go to
+	// runHysteresis through fired.
+	hysteresis []*hysteresisRule
+	fired      chan firedRule
+}
+
+func NewHub(store DeviceStore, transitions transitionTable, history *History) *Hub {
+	return &Hub{
+		clients: make(map[*client]struct{}),
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+			Subprotocols: []string{wsSubprotocol},
+		},
+		store:     store,
+		broadcast: make(chan WSMessage, 32),
+		events:    make(chan Event, hubEventBuffer),
+
+		history:      history,
+		messageLimit: defaultMessageLimit,
+		resume:       newResumeStore(defaultResumeTTL),
+		recent:       newBackfillRing(defaultBackfillSize),
+		queueSize:    defaultQueueSize,
+		slowClient:   slowClientDrop,
+		pingInterval: defaultPingInterval,
+		pongWait:     defaultPongWait,
+		echo:         echoAll,
+		transitions:  transitions,
+		lastDevice:   make(map[string]*Device),
+		simulations:  make(map[string]*simulation),
+		lastSent:     make(map[string]*Device),
+	}
+}
+
+func (h *Hub) Run() {
+	if len(h.hysteresis) > 0 {
+		h.fired = make(chan firedRule, hysteresisQueueSize)
+		go h.runHysteresis()
+	}
+	for _, device := range h.store.List() {
+		h.lastDevice[device.ID] = device
+		h.history.Seed(device)
+		if !h.minDeltas.empty() {
+			h.lastSent[device.ID] = device
+		}
+	}
+	for message := range h.broadcast {
+		switch {
+		case message.simulation != nil:
+			if message.Device = h.simulatedFrame(message); message.Device == nil {
+				continue
+			}
+		case message.Type == "update" && message.Device != nil:
+			if h.skipNoops && h.unchanged(message.Device) {
+				h.answerOrigin(message)
+				continue
+			}
+			h.history.Record(h.lastDevice[message.Device.ID], message.Device, message.RequestID)
+			h.checkHysteresis(message.Device)
+			h.applyTransitions(&message)
+			if h.belowMinDelta(message.Device) {
+				continue
+			}
+		case message.Type == "added" && message.Device != nil:
+			h.history.Seed(message.Device)
+			h.lastDevice[message.Device.ID] = cloneDevice(message.Device)
+		case (message.Type == "liveness" || message.Type == "renamed") && message.Device != nil:
+			h.lastDevice[message.Device.ID] = cloneDevice(message.Device)
+		case message.Type == "removed" && message.Device != nil:
+			h.history.Forget(message.Device.ID)
+			h.forgetDevice(message.Device.ID)
+		case message.Type == "reset":
+			// Resets jump straight to the initial state, so they stop any
+			// transitions rather than start new ones.
+			for _, device := range message.Devices {
+				h.history.Record(h.lastDevice[device.ID], device, message.RequestID)
+				h.checkHysteresis(device)
+				h.stopSimulations(device.ID)
+				h.lastDevice[device.ID] = cloneDevice(device)
+			}
+		}
+		h.broadcastMessage(message)
+		h.trackSent(message)
+		if message.Type == "update" && message.Device != nil && message.simulation == nil {
+			h.emit(Event{Type: EventDeviceUpdated, Device: message.Device})
+		}
+		if message.Type == "reset" {
+			for _, device := range message.Devices {
+				h.emit(Event{Type: EventDeviceUpdated, Device: device})
+			}
+		}
+		if message.Type == "event" && message.Event == "pressed" {
+			h.emit(Event{Type: EventDevicePressed, Device: message.target})
+		}
+	}
+}
+
+// trackSent remembers the device a message carried for belowMinDelta.
+func (h *Hub) trackSent(message WSMessage) {
+	if h.minDeltas.empty() {
+		return
+	}
+	for _, device := range message.Devices {
+		h.lastSent[device.ID] = cloneDevice(device)
+	}
+	if message.Device == nil {
+		return
+	}
+	if message.Type == "removed" {
+		delete(h.lastSent, message.Device.ID)
+		return
+	}
+	h.lastSent[message.Device.ID] = cloneDevice(message.Device)
+}
+
+// Publish queues message for delivery to every connected client.
+func (h *Hub) Publish(message WSMessage) {
+	h.broadcast <- message
+}
+
+// PublishChange records a device change made on behalf of ctx in the audit log
+// and broadcasts it tagged with the request ID and origin client from ctx.
+func (h *Hub) PublishChange(ctx context.Context, message WSMessage) {
+	message.RequestID = requestIDFrom(ctx)
+	message.origin = originClientFrom(ctx)
+	audit(ctx, message.Type, message.Device)
+	for _, device := range message.Devices {
+		audit(ctx, message.Type, device)
+	}
+	h.Publish(message)
+}
+
+// clientView is what decides how a client sees a device, and which of the
+// devices a message carries it gets.
+type clientView struct {
+	private bool
+	unit    string
+	ids     string
+}
+
+// broadcastMessage encodes message once per view of the device among the
+// clients it goes to: with or without private keys, and per temperature unit.
+// The client that caused the change gets it according to the echo mode.
+// Clients holding the device get no update of it.
+func (h *Hub) broadcastMessage(message WSMessage) {
+	payloads := make(map[clientView][]byte)
+	encode := func(c *client) ([]byte, error) {
+		view := clientView{private: c.showPrivate, unit: c.unit}
+		for _, device := range c.wantedDevices(message.Devices) {
+			view.ids += device.ID + "\x00"
+		}
+		if payload, ok := payloads[view]; ok {
+			return payload, nil
+		}
+		payload, err := json.Marshal(c.visibleMessage(message))
+		if err != nil {
+			return nil, err
+		}
+		if len(payloads) == 0 {
+			warnOversized(h.messageLimit, message.Type, payload)
+		}
+		payloads[view] = payload
+		return payload, nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.recent.record(&message)
+	h.logEvent(message)
+	for c := range h.clients {
+		if !c.wants(message) {
+			continue
+		}
+		held := message.Type == "update" && message.Device != nil && c.holding(message.Device.ID)
+		if message.origin != "" && c.id == message.origin {
+			switch h.echo {
+			case echoAck:
+				h.sendAck(c, message)
+				continue
+			case echoSkip:
+				continue
+			}
+			if message.clientSeq != nil && !held {
+				h.sendOwnEcho(c, message)
+				continue
+			}
+		}
+		if held {
+			continue
+		}
+		payload, err := encode(c)
+		if err != nil {
+			log.Printf("broadcast encode failed: %v", err)
+			continue
+		}
+		if c.batches(message) {
+			c.addToBatch(message.Device.ID, payload)
+			continue
+		}
+		if c.enqueue(payload) {
+			h.counts.sent(message.Type)
+		}
+	}
+}
+
+// visibleMessage is message as c reads it: its device redacted and in c's
+// temperature unit, and of the devices it carries only those c wants.
+func (c *client) visibleMessage(message WSMessage) WSMessage {
+	visible := message
+	visible.Device = c.visible(message.Device)
+	if message.Device != nil {
+		kind := message.Device.schemaKind()
+		if !c.showPrivate {
+			visible.Transition = redactTransitions(kind, visible.Transition)
+		}
+		visible.Transition = localizeTransitions(kind, visible.Transition, c.unit)
+	}
+	if message.Devices != nil {
+		visible.Devices = nil
+		for _, device := range c.wantedDevices(message.Devices) {
+			visible.Devices = append(visible.Devices, c.visible(device))
+		}
+	}
+	return visible
+}
+
+// sendAck tells c its change was applied, with the resulting device, in an
+// "ack" rather than the broadcast.
+func (h *Hub) sendAck(c *client, message WSMessage) {
+	visible := c.visibleMessage(message)
+	c.sendJSON(WSMessage{Type: "ack", Device: visible.Device, Devices: visible.Devices, RequestID: message.RequestID, ClientSeq: message.clientSeq})
+}
+
+// sendOwnEcho sends c the broadcast of a change it made with client_seq,
+// carrying that client_seq so c can reconcile its optimistic state.
+func (h *Hub) sendOwnEcho(c *client, message WSMessage) {
+	message.ClientSeq = message.clientSeq
+	message.Device = c.visible(message.Device)
+	c.sendJSON(message)
+}
+
+// ClientStats returns per-connection queue and throughput counters, oldest
+// connection first.
+func (h *Hub) ClientStats() []ClientStats {
+	h.mu.Lock()
+	stats := make([]ClientStats, 0, len(h.clients))
+	for c := range h.clients {
+		stats = append(stats, c.stats())
+	}
+	h.mu.Unlock()
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].ConnectedAt.Before(stats[j].ConnectedAt)
+	})
+	return stats
+}
+
+// Shutdown tells every client the server is going away with a
+// server_shutdown message, then closes each connection with a 1001 close
+// frame once the message is written. It returns when all clients are gone,
+// or closes the rest without ceremony when ctx is done.
+func (h *Hub) Shutdown(ctx context.Context, reason string, reconnectAfter time.Duration) {
+	payload, err := json.Marshal(WSMessage{Type: "server_shutdown", Reason: reason, ReconnectAfter: reconnectAfter.Seconds()})
+	if err != nil {
+		log.Printf("websocket encode failed: %v", err)
+		return
+	}
+	h.mu.Lock()
+	clients := make([]*client, 0, len(h.clients))
+	for c := range h.clients {
+		clients = append(clients, c)
+	}
+	h.mu.Unlock()
+	for _, c := range clients {
+		c.flushBatch()
+		select {
+		case c.send <- queuedMessage{payload: payload, queued: time.Now(), closeCode: websocket.CloseGoingAway, closeReason: reason}:
+			h.counts.sent("server_shutdown")
+		default:
+			c.kick(websocket.CloseGoingAway, reason)
+		}
+	}
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		h.mu.Lock()
+		remaining := len(h.clients)
+		h.mu.Unlock()
+		if remaining == 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			for _, c := range clients {
+				c.close()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Disconnect closes the connection whose client ID is id with a 1008 close
+// frame and returns its last stats, or false if it is not connected.
+func (h *Hub) Disconnect(id string) (ClientStats, bool) {
+	h.mu.Lock()
+	var target *client
+	for c := range h.clients {
+		if c.id == id {
+			target = c
+			break
+		}
+	}
+	h.mu.Unlock()
+	if target == nil {
+		return ClientStats{}, false
+	}
+	stats := target.stats()
+	log.Printf("websocket client %s (%s) disconnected by an admin", id, target.remoteAddr)
+	target.kick(websocket.ClosePolicyViolation, "disconnected by admin")
+	return stats, true
+}
+
+// HandleWS upgrades r to a websocket. The server's read and write timeouts
+// are lifted first; the connection keeps its own deadlines from then on.
+func (h *Hub) HandleWS(w http.ResponseWriter, r *http.Request) {
+	controller := http.NewResponseController(w)
+	_ = controller.SetReadDeadline(time.Time{})
+	_ = controller.SetWriteDeadline(time.Time{})
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("websocket upgrade failed: %v", err)
+		return
+	}
+	h.Serve(newWebsocketConn(conn, h.messageLimit, h.pingInterval, h.pongWait), r)
+}
+
+// Serve runs a client session on conn until it closes. r is the request that
+// opened the connection; its query and identity set the initial subscription
+// and permissions.
+func (h *Hub) Serve(conn Conn, r *http.Request) {
+	c := newClient(conn, r, h.queueSize)
+	c.messageLimit = h.messageLimit
+	c.slowPolicy = h.slowClient
+	c.queueMaxAge = h.queueMaxAge
+	c.pingInterval = h.pingInterval
+	c.evictions = &h.evictions
+	c.counts = &h.counts
+	c.readOnly = h.isReadOnly(identityFrom(r.Context()))
+	if h.batchWindow > 0 {
+		c.batch = &updateBatch{window: h.batchWindow}
+	}
+	c.resumeToken = newRequestID()
+	c.id = newRequestID()
+	query := r.URL.Query()
+	sub, resumed := h.resume.claim(query.Get("resume"), identityFrom(c.ctx).Name)
+	if !resumed {
+		sub = newSubscription(queryValues(query["id"]), queryValues(query["room"]))
+	}
+	c.setSubscription(sub)
+	go c.writePump()
+	c.sendJSON(WSMessage{Type: "hello", ResumeToken: c.resumeToken, Resumed: resumed, ClientID: c.id})
+
+	caughtUp, seq := h.register(c, query.Get("since"))
+	defer h.unregister(c)
+	if !caughtUp {
+		devices := c.currentSubscription().filter(h.store.List())
+		if !c.showPrivate {
+			devices = redactDevices(devices)
+		}
+		c.sendJSON(WSMessage{Type: "state", Devices: localizeDevices(devices, c.unit), Seq: seq})
+	}
+
+	var idle *time.Timer
+	if h.idleTimeout > 0 {
+		idle = time.AfterFunc(h.idleTimeout, func() {
+			log.Printf("websocket client %s idle for %s, closing", c.remoteAddr, h.idleTimeout)
+			c.kick(websocket.CloseNormalClosure, "idle timeout")
+		})
+		defer idle.Stop()
+	}
+	for {
+		var raw json.RawMessage
+		reader, err := conn.NextReader()
+		if err == nil {
+			err = decodeJSON(reader, &raw)
+		}
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("websocket read error: %v", err)
+			}
+			return
+		}
+		if idle != nil {
+			idle.Reset(h.idleTimeout)
+		}
+		var incoming WSClientMessage
+		if err := decodeJSON(bytes.NewReader(raw), &incoming); err != nil {
+			h.counts.undecodable()
+			c.sendJSON(WSMessage{Type: "error", Error: describeDecodeError(err), RequestID: rawRequestID(raw)})
+			continue
+		}
+		h.counts.received(incoming.Type)
+		if c.refuses(incoming.Type, incoming.RequestID) {
+			continue
+		}
+		switch incoming.Type {
+		case "set":
+			h.handleSet(c, incoming)
+		case "get":
+			h.handleGet(c, incoming)
+		case "subscribe", "subscribe_add", "subscribe_remove":
+			h.handleSubscribe(c, incoming)
+		case "whoami":
+			c.sendJSON(WSMessage{Type: "session", Session: c.session(), RequestID: incoming.RequestID})
+		case "hold":
+			h.handleHold(c, incoming)
+		case "release":
+			h.handleRelease(c, incoming)
+		default:
+			c.sendJSON(WSMessage{Type: "error", Error: "unsupported message type", RequestID: incoming.RequestID})
+		}
+	}
+}
+
+// handleSubscribe applies a subscribe, subscribe_add, or subscribe_remove and
+// confirms the resulting subscription with a subscribed message. IDs and rooms
+// that match no device are reported rather than subscribed to; a subscribe
+// naming nothing else matches no device instead of every device.
+func (h *Hub) handleSubscribe(c *client, incoming WSClientMessage) {
+	var invalidIDs, invalidRooms []string
+	ids, rooms := incoming.IDs, incoming.Rooms
+	if incoming.Type != "subscribe_remove" {
+		ids, rooms, invalidIDs, invalidRooms = h.resolveSubscription(incoming.IDs, incoming.Rooms)
+	}
+	switch incoming.Type {
+	case "subscribe":
+		sub := newSubscription(ids, rooms)
+		sub.incremental = len(ids) == 0 && len(rooms) == 0 && (len(invalidIDs) > 0 || len(invalidRooms) > 0)
+		c.setSubscription(sub)
+	case "subscribe_add":
+		c.adjustSubscription(ids, rooms, true)
+	case "subscribe_remove":
+		c.adjustSubscription(ids, rooms, false)
+	}
+	sub := c.currentSubscription()
+	c.sendJSON(WSMessage{
+		Type:         "subscribed",
+		All:          len(sub.ids) == 0 && len(sub.rooms) == 0 && !sub.incremental,
+		IDs:          sub.idList(),
+		Rooms:        sub.roomList(),
+		InvalidIDs:   invalidIDs,
+		InvalidRooms: invalidRooms,
+		RequestID:    incoming.RequestID,
+	})
+}
+
+// resolveSubscription splits ids and rooms into those that match a device
+// and those that do not. Rooms compare case-insensitively.
+func (h *Hub) resolveSubscription(ids, rooms []string) (validIDs, validRooms, invalidIDs, invalidRooms []string) {
+	known := make(map[string]bool)
+	for _, device := range h.store.List() {
+		known[strings.ToLower(device.Room)] = true
+	}
+	for _, id := range ids {
+		if id == "" {
+			continue
+		}
+		if _, ok := h.store.Get(id); ok {
+			validIDs = append(validIDs, id)
+		} else {
+			invalidIDs = append(invalidIDs, id)
+		}
+	}
+	for _, room := range rooms {
+		if strings.TrimSpace(room) == "" {
+			continue
+		}
+		if known[strings.ToLower(strings.TrimSpace(room))] {
+			validRooms = append(validRooms, room)
+		} else {
+			invalidRooms = append(invalidRooms, room)
+		}
+	}
+	return validIDs, validRooms, invalidIDs, invalidRooms
+}
+
+// describeDecodeError explains why a well-formed client message did not fit
+// WSClientMessage, naming the field when it had the wrong type.
+func describeDecodeError(err error) string {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return fmt.Sprintf("invalid message: %s must be %s, got %s", typeErr.Field, jsonTypeName(typeErr.Type), typeErr.Value)
+	}
+	return "invalid message: expected a JSON object"
+}
+
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	case reflect.Slice:
+		return "an array"
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Pointer:
+		return jsonTypeName(t.Elem())
+	}
+	return "a number"
+}
+
+// rawRequestID digs request_id out of a message that failed to decode, so the
+// error can still be matched to its request.
+func rawRequestID(raw json.RawMessage) string {
+	var message struct {
+		RequestID string `json:"request_id"`
+	}
+	_ = json.Unmarshal(raw, &message)
+	return message.RequestID
+}
+
+func (h *Hub) handleSet(c *client, incoming WSClientMessage) {
+	requestID := requestIDOrNew(incoming.RequestID)
+	if incoming.ID == "" {
+		c.sendJSON(WSMessage{Type: "error", Error: "missing device id", RequestID: requestID})
+		return
+	}
+	ctx := withOriginClient(withRequestID(c.ctx, requestID), c.id)
+	updated, err := h.store.Update(ctx, incoming.ID, incoming.State)
+	if err != nil {
+		c.sendJSON(WSMessage{Type: "error", Error: err.Error(), RequestID: requestID, ClientSeq: incoming.ClientSeq})
+		return
+	}
+	h.PublishChange(ctx, WSMessage{Type: "update", Device: updated, clientSeq: incoming.ClientSeq})
+}
+
+// handleGet replies to c alone with the current state of one device.
+func (h *Hub) handleGet(c *client, incoming WSClientMessage) {
+	device, ok := h.store.Get(incoming.ID)
+	if !ok {
+		c.sendJSON(WSMessage{Type: "error", Error: "device not found", RequestID: incoming.RequestID})
+		return
+	}
+	c.sendJSON(WSMessage{Type: "device", Device: c.visible(device), RequestID: incoming.RequestID})
+}
+
+// register adds c to the clients broadcasts go to. When since names a
+// broadcast still held for backfill, c is sent what it missed since then and
+// caughtUp is set; otherwise it needs a state snapshot, as of seq.
+func (h *Hub) register(c *client, since string) (caughtUp bool, seq uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clients[c] = struct{}{}
+	h.emit(Event{Type: EventClientConnected, RemoteAddr: c.remoteAddr})
+	if last, ok := parseSince(since); ok {
+		caughtUp = h.backfill(c, last)
+	}
+	return caughtUp, h.recent.seq
+}
+
+func (h *Hub) unregister(c *client) {
+	h.mu.Lock()
+	delete(h.clients, c)
+	h.mu.Unlock()
+	c.close()
+	c.releaseAll()
+	h.resume.save(c.resumeToken, identityFrom(c.ctx).Name, c.currentSubscription())
+	h.emit(Event{Type: EventClientDisconnected, RemoteAddr: c.remoteAddr})
+}
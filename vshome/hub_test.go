@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func testCatalog() []*Device {
+	return []*Device{
+		{ID: "light_kitchen", Name: "Kitchen Lights", Kind: "toggle", Room: "Kitchen", State: map[string]interface{}{"on": false}},
+		{ID: "blinds_living", Name: "Living Room Blinds", Kind: "blind", Room: "Living Room", State: map[string]interface{}{"position": 45}},
+	}
+}
+
+// newTestHub runs a hub over an in-memory store of testCatalog.
+func newTestHub(t *testing.T) (*Hub, *Store) {
+	t.Helper()
+	store := NewStore(testCatalog())
+	hub := NewHub(store, nil, NewHistory(10))
+	go hub.Run()
+	t.Cleanup(func() { close(hub.broadcast) })
+	return hub, store
+}
+
+// publishUpdate writes state to id and broadcasts the result, as the REST
+// handlers do.
+func publishUpdate(t *testing.T, hub *Hub, store DeviceStore, id string, state map[string]interface{}) {
+	t.Helper()
+	updated, err := store.Update(context.Background(), id, state)
+	if err != nil {
+		t.Fatalf("update %s: %v", id, err)
+	}
+	hub.Publish(WSMessage{Type: "update", Device: updated})
+}
+
+func TestHubServeSendsHelloAndState(t *testing.T) {
+	hub, _ := newTestHub(t)
+	conn := serveFake(t, hub, "/ws")
+
+	if hello := conn.next(t); hello.Type != "hello" || hello.ClientID == "" || hello.ResumeToken == "" {
+		t.Fatalf("first frame = %+v, want a hello with a client ID and resume token", hello)
+	}
+	state := conn.next(t)
+	if state.Type != "state" || len(state.Devices) != 2 {
+		t.Fatalf("second frame = %+v, want the state of both devices", state)
+	}
+}
+
+func TestHubBroadcastsToEveryClient(t *testing.T) {
+	hub, store := newTestHub(t)
+	first := serveFake(t, hub, "/ws")
+	second := serveFake(t, hub, "/ws")
+	first.nextOf(t, "state")
+	second.nextOf(t, "state")
+
+	publishUpdate(t, hub, store, "light_kitchen", map[string]interface{}{"on": true})
+	for _, conn := range []*fakeConn{first, second} {
+		update := conn.next(t)
+		if update.Type != "update" || update.Device == nil || update.Device.ID != "light_kitchen" || update.Device.State["on"] != true {
+			t.Fatalf("broadcast = %+v, want light_kitchen turned on", update)
+		}
+	}
+}
+
+func TestHubSubscribeFiltersBroadcasts(t *testing.T) {
+	hub, store := newTestHub(t)
+	conn := serveFake(t, hub, "/ws")
+	conn.nextOf(t, "state")
+
+	conn.send(t, map[string]interface{}{"type": "subscribe", "ids": []string{"blinds_living", "missing"}, "request_id": "r1"})
+	subscribed := conn.next(t)
+	if subscribed.Type != "subscribed" || subscribed.RequestID != "r1" {
+		t.Fatalf("reply = %+v, want subscribed to r1", subscribed)
+	}
+	if len(subscribed.IDs) != 1 || subscribed.IDs[0] != "blinds_living" || len(subscribed.InvalidIDs) != 1 || subscribed.InvalidIDs[0] != "missing" {
+		t.Fatalf("subscribed ids = %v invalid = %v, want blinds_living and missing", subscribed.IDs, subscribed.InvalidIDs)
+	}
+
+	publishUpdate(t, hub, store, "light_kitchen", map[string]interface{}{"on": true})
+	publishUpdate(t, hub, store, "blinds_living", map[string]interface{}{"position": 80})
+	update := conn.next(t)
+	if update.Type != "update" || update.Device == nil || update.Device.ID != "blinds_living" {
+		t.Fatalf("frame = %+v, want only the subscribed blinds_living update", update)
+	}
+	conn.quiet(t, 50*time.Millisecond)
+}
+
+func TestHubSubscribeAtConnect(t *testing.T) {
+	hub, store := newTestHub(t)
+	conn := serveFake(t, hub, "/ws?room=kitchen")
+	state := conn.nextOf(t, "state")
+	if len(state.Devices) != 1 || state.Devices[0].ID != "light_kitchen" {
+		t.Fatalf("state = %v, want only the kitchen's device", deviceIDs(state.Devices))
+	}
+
+	publishUpdate(t, hub, store, "blinds_living", map[string]interface{}{"position": 10})
+	conn.quiet(t, 50*time.Millisecond)
+}
+
+func TestHubSetBroadcastsChange(t *testing.T) {
+	hub, _ := newTestHub(t)
+	setter := serveFake(t, hub, "/ws")
+	watcher := serveFake(t, hub, "/ws")
+	setter.nextOf(t, "state")
+	watcher.nextOf(t, "state")
+
+	setter.send(t, map[string]interface{}{"type": "set", "id": "blinds_living", "state": map[string]interface{}{"position": 20}, "request_id": "r2"})
+	update := watcher.next(t)
+	if update.Type != "update" || update.RequestID != "r2" {
+		t.Fatalf("watcher got %+v, want the update tagged r2", update)
+	}
+	if position, _ := toFloat(update.Device.State["position"]); position != 20 {
+		t.Fatalf("broadcast position = %v, want 20", update.Device.State["position"])
+	}
+}
+
+// bigInteger is 2^53+1, the first integer a float64 cannot hold.
+const bigInteger = "9007199254740993"
+
+func TestHubBroadcastKeepsIntegers(t *testing.T) {
+	hub, _ := newTestHub(t)
+	setter := serveFake(t, hub, "/ws")
+	watcher := serveFake(t, hub, "/ws")
+	setter.nextOf(t, "state")
+	watcher.nextOf(t, "state")
+
+	setter.incoming <- []byte(`{"type":"set","id":"blinds_living","state":{"position":100,"count":` + bigInteger + `}}`)
+	var payload []byte
+	select {
+	case payload = <-watcher.written:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no broadcast")
+	}
+	for _, want := range []string{`"position":100[,}]`, `"count":` + bigInteger + `[,}]`} {
+		if !regexp.MustCompile(want).Match(payload) {
+			t.Errorf("broadcast %s does not match %s", payload, want)
+		}
+	}
+}
+
+func deviceIDs(devices []*Device) []string {
+	ids := make([]string, 0, len(devices))
+	for _, device := range devices {
+		ids = append(ids, device.ID)
+	}
+	return ids
+}
+
+// stateEquals reports whether device holds number at key, whatever numeric
+// type the backend decoded it as.
+func stateEquals(device *Device, key string, number float64) bool {
+	value, ok := toFloat(device.State[key])
+	return ok && value == number
+}
+
+func TestHubResetIsOneBroadcast(t *testing.T) {
+	testHub, testStore := newTestHub(t)
+	previousHub, previousStore := hub, store
+	hub, store = testHub, testStore
+	t.Cleanup(func() { hub, store = previousHub, previousStore })
+	everything := serveFake(t, hub, "/ws")
+	kitchen := serveFake(t, hub, "/ws?room=kitchen")
+	everything.nextOf(t, "state")
+	kitchen.nextOf(t, "state")
+	publishUpdate(t, hub, store, "light_kitchen", map[string]interface{}{"on": true})
+	publishUpdate(t, hub, store, "blinds_living", map[string]interface{}{"position": 90})
+	everything.nextOf(t, "update")
+	everything.nextOf(t, "update")
+	kitchen.nextOf(t, "update")
+
+	recorder := httptest.NewRecorder()
+	handleReset(recorder, httptest.NewRequest(http.MethodPost, "/api/devices/reset", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("reset status %d: %s", recorder.Code, recorder.Body)
+	}
+	reset := everything.next(t)
+	if reset.Type != "reset" || len(reset.Devices) != 2 || reset.Devices[0].State["on"] != false || !stateEquals(reset.Devices[1], "position", 45) {
+		t.Fatalf("frame = %+v, want one reset of both devices", reset)
+	}
+	everything.quiet(t, 50*time.Millisecond)
+	if reset := kitchen.next(t); reset.Type != "reset" || len(reset.Devices) != 1 || reset.Devices[0].ID != "light_kitchen" {
+		t.Fatalf("kitchen frame = %+v, want a reset of only the kitchen's device", reset)
+	}
+	kitchen.quiet(t, 50*time.Millisecond)
+}
+
+func TestHubRedactsPrivateTransitions(t *testing.T) {
+	store := NewStore([]*Device{
+		{ID: "thermostat_hall", Name: "Hall Thermostat", Kind: "thermostat", State: map[string]interface{}{"temperature": 20.0, "calibration": 0.0}},
+	})
+	transitions := transitionTable{"thermostat": {
+		"temperature": {Kind: "thermostat", Key: "temperature", Rate: 1},
+		"calibration": {Kind: "thermostat", Key: "calibration", Rate: 1},
+	}}
+	hub := NewHub(store, transitions, NewHistory(10))
+	go hub.Run()
+	t.Cleanup(func() { close(hub.broadcast) })
+	conn := serveFake(t, hub, "/ws")
+	conn.nextOf(t, "state")
+	// Wait for the hub to have seen the device as it starts, so the update
+	// below transitions from there.
+	device, _ := store.Get("thermostat_hall")
+	hub.Publish(WSMessage{Type: "liveness", Device: device})
+	conn.nextOf(t, "liveness")
+
+	publishUpdate(t, hub, store, "thermostat_hall", map[string]interface{}{"temperature": 22.0, "calibration": 2.0})
+	update := conn.nextOf(t, "update")
+	if _, ok := update.Transition["temperature"]; !ok {
+		t.Fatalf("transition = %v, want temperature's", update.Transition)
+	}
+	if _, ok := update.Transition["calibration"]; ok {
+		t.Fatalf("transition = %v, want calibration's left out", update.Transition)
+	}
+}
+
+func TestHubUnsupportedTypeCarriesRequestID(t *testing.T) {
+	hub, _ := newTestHub(t)
+	conn := serveFake(t, hub, "/ws")
+	conn.nextOf(t, "state")
+
+	conn.send(t, map[string]interface{}{"type": "dance", "request_id": "r3"})
+	if reply := conn.next(t); reply.Type != "error" || reply.RequestID != "r3" {
+		t.Fatalf("reply = %+v, want an error tagged r3", reply)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// HysteresisRule watches a numeric key of the device ID and applies Above
+// when the value rises past Upper and Below when it falls under Lower. While
+// the value stays between the two nothing happens, so a reading hovering at
+// one threshold does not flap the target on and off.
+type HysteresisRule struct {
+	Name  string            `yaml:"name"`
+	ID    string            `yaml:"id"`
+	Key   string            `yaml:"key"`
+	Upper float64           `yaml:"upper"`
+	Lower float64           `yaml:"lower"`
+	Above *HysteresisAction `yaml:"above"`
+	Below *HysteresisAction `yaml:"below"`
+}
+
+// HysteresisAction is the state a rule writes to the device ID.
+type HysteresisAction struct {
+	ID    string                 `yaml:"id"`
+	State map[string]interface{} `yaml:"state"`
+}
+
+// hysteresisQueueSize bounds the actions waiting to be applied; the hub drops
+// and logs any beyond it rather than block.
+const hysteresisQueueSize = 32
+
+// hysteresisRule is a rule and the side of its band the value was last seen
+// on. Owned by the hub's Run goroutine.
+type hysteresisRule struct {
+	HysteresisRule
+	side hysteresisSide
+}
+
+type hysteresisSide int
+
+const (
+	sideUnknown hysteresisSide = iota
+	sideAbove
+	sideBelow
+)
+
+func loadHysteresisRules(configs []HysteresisRule, devices []*Device) ([]*hysteresisRule, error) {
+	kinds := make(map[string]string, len(devices))
+	for _, device := range devices {
+		kinds[device.ID] = device.schemaKind()
+	}
+	checkAction := func(name, direction string, action *HysteresisAction) error {
+		if action == nil {
+			return nil
+		}
+		kind, ok := kinds[action.ID]
+		if !ok {
+			return fmt.Errorf("hysteresis rule %s: %s: unknown device %q", name, direction, action.ID)
+		}
+		if len(action.State) == 0 {
+			return fmt.Errorf("hysteresis rule %s: %s has no state", name, direction)
+		}
+		if _, err := normalizeState(kind, action.State); err != nil {
+			return fmt.Errorf("hysteresis rule %s: %s: %w", name, direction, err)
+		}
+		return nil
+	}
+	rules := make([]*hysteresisRule, 0, len(configs))
+	for _, config := range configs {
+		name := config.Name
+		if name == "" {
+			name = config.ID + "." + config.Key
+		}
+		kind, ok := kinds[config.ID]
+		if !ok {
+			return nil, fmt.Errorf("hysteresis rule %s: unknown device %q", name, config.ID)
+		}
+		if !isNumericKey(kind, config.Key) {
+			return nil, fmt.Errorf("hysteresis rule %s: %s is not a numeric key of %s", name, config.Key, config.ID)
+		}
+		if config.Upper <= config.Lower {
+			return nil, fmt.Errorf("hysteresis rule %s: upper must be above lower", name)
+		}
+		if config.Above == nil && config.Below == nil {
+			return nil, fmt.Errorf("hysteresis rule %s: needs above, below, or both", name)
+		}
+		if err := checkAction(name, "above", config.Above); err != nil {
+			return nil, err
+		}
+		if err := checkAction(name, "below", config.Below); err != nil {
+			return nil, err
+		}
+		config.Name = name
+		rules = append(rules, &hysteresisRule{HysteresisRule: config})
+	}
+	return rules, nil
+}
+
+// crossed returns the action for a value of the rule's key, if the value has
+// left the band on the side opposite the one last seen. The first value past
+// either threshold fires too.
+func (r *hysteresisRule) crossed(value float64) *HysteresisAction {
+	switch {
+	case value > r.Upper && r.side != sideAbove:
+		r.side = sideAbove
+		return r.Above
+	case value < r.Lower && r.side != sideBelow:
+		r.side = sideBelow
+		return r.Below
+	}
+	return nil
+}
+
+type firedRule struct {
+	name   string
+	action *HysteresisAction
+}
+
+// checkHysteresis runs on the hub goroutine for every stored update and
+// queues the actions of the rules it makes cross.
+func (h *Hub) checkHysteresis(device *Device) {
+	for _, rule := range h.hysteresis {
+		if rule.ID != device.ID {
+			continue
+		}
+		value, ok := toFloat(device.State[rule.Key])
+		if !ok {
+			continue
+		}
+		action := rule.crossed(value)
+		if action == nil {
+			continue
+		}
+		select {
+		case h.fired <- firedRule{name: rule.Name, action: action}:
+		default:
+			log.Printf("hysteresis rule %s: action queue full, dropped", rule.Name)
+		}
+	}
+}
+
+// runHysteresis applies fired rule actions in order, as the system, so they
+// never hold up the hub.
+func (h *Hub) runHysteresis() {
+	for fired := range h.fired {
+		ctx := withRequestID(systemContext(), newRequestID())
+		updated, err := h.store.Update(ctx, fired.action.ID, fired.action.State)
+		if err != nil {
+			log.Printf("hysteresis rule %s: %v", fired.name, err)
+			continue
+		}
+		h.PublishChange(ctx, WSMessage{Type: "update", Device: updated})
+	}
+}
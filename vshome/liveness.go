@@ -0,0 +1,40 @@
+package main
+
+import "net/http"
+
+// handleTouch records a heartbeat from a device. Only a "liveness" message is
+// broadcast, tagged like any change; the state is untouched, so nothing is
+// audited as a change.
+func handleTouch(w http.ResponseWriter, r *http.Request, id string) {
+	device, err := store.Touch(id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	message := WSMessage{Type: "liveness", Device: device, RequestID: requestIDFrom(r.Context())}
+	message.origin = originClientFrom(r.Context())
+	hub.Publish(message)
+	writeJSON(w, http.StatusOK, visibleDevice(r, device))
+}
+
+// handleSetOffline simulates the device dropping off the network or coming
+// back. Reads keep returning the last known state while it is offline.
+func handleSetOffline(offline bool) func(w http.ResponseWriter, r *http.Request, id string) {
+	return func(w http.ResponseWriter, r *http.Request, id string) {
+		device, err := store.SetOffline(id, offline)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		hub.PublishChange(r.Context(), WSMessage{Type: "liveness", Device: device})
+		writeJSON(w, http.StatusOK, visibleDevice(r, device))
+	}
+}
+
+func requireAdminAction(next func(w http.ResponseWriter, r *http.Request, id string)) func(w http.ResponseWriter, r *http.Request, id string) {
+	return func(w http.ResponseWriter, r *http.Request, id string) {
+		requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+			next(w, r, id)
+		})(w, r)
+	}
+}
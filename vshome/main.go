@@ -1,18 +1,26 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"mime"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"gopkg.in/yaml.v3"
 )
 
@@ -22,320 +30,301 @@ type Device struct {
 	Kind  string                 `yaml:"kind" json:"kind"`
 	Room  string                 `yaml:"room" json:"room"`
 	State map[string]interface{} `yaml:"state" json:"state"`
+	// SensorType and Unit describe what a sensor measures; see sensor.go.
+	SensorType string `yaml:"sensor_type" json:"sensor_type,omitempty"`
+	Unit       string `yaml:"unit" json:"unit,omitempty"`
+	// Firmware is the installed version and LatestFirmware the newest one
+	// available, both semver; see firmware.go.
+	Firmware       string `yaml:"firmware" json:"firmware,omitempty"`
+	LatestFirmware string `yaml:"latest_firmware" json:"latest_firmware,omitempty"`
+	// Travel lets a blind's position be written in meters or encoder counts;
+	// see units.go.
+	Travel *Travel `yaml:"travel" json:"travel,omitempty"`
+
+	// Liveness is tracked at runtime and never read from the catalog.
+	LastSeen *time.Time `yaml:"-" json:"last_seen,omitempty"`
+	Offline  bool       `yaml:"-" json:"offline,omitempty"`
+	// Updating is set while a simulated firmware update runs.
+	Updating bool `yaml:"-" json:"updating,omitempty"`
 }
 
 type DeviceCatalog struct {
-	Devices []*Device `yaml:"devices"`
+	Devices     []*Device          `yaml:"devices"`
+	Scenes      []*Scene           `yaml:"scenes"`
+	WriteRules  []WriteRuleConfig  `yaml:"write_rules"`
+	Transitions []TransitionConfig `yaml:"transitions"`
+	Replays     []ReplayConfig     `yaml:"replays"`
+	MinDeltas   []MinDeltaConfig   `yaml:"min_deltas"`
+	// PollIntervals override the poll interval advised to clients without a
+	// WebSocket; see poll.go.
+	PollIntervals []PollIntervalConfig `yaml:"poll_intervals"`
+	// AutoIDs derives missing device IDs from their names, at load time and
+	// for devices created through the API.
+	AutoIDs bool `yaml:"auto_ids"`
+	// CommandAllowlist maps a device ID to the only state keys it accepts.
+	CommandAllowlist map[string][]string `yaml:"command_allowlist"`
+	// ButtonScenes maps a button's ID to the scene a press triggers.
+	ButtonScenes map[string]string `yaml:"button_scenes"`
+	// HysteresisRules switch devices when a reading leaves a band; see
+	// hysteresis.go.
+	HysteresisRules []HysteresisRule `yaml:"hysteresis_rules"`
 }
 
-type Store struct {
-	mu      sync.RWMutex
-	devices map[string]*Device
-	order   []string
+type DeviceUpdate struct {
+	ID    string                 `json:"id"`
+	State map[string]interface{} `json:"state"`
 }
 
-var store *Store
-var hub *Hub
-
-func NewStore(devices []*Device) *Store {
-	deviceMap := make(map[string]*Device, len(devices))
-	order := make([]string, 0, len(devices))
-	for _, device := range devices {
-		copyDevice := *device
-		copyDevice.State = copyState(device.State)
-		deviceMap[device.ID] = &copyDevice
-		order = append(order, device.ID)
-	}
-	return &Store{devices: deviceMap, order: order}
+// BulkResult reports the outcome of a single entry of a bulk update.
+type BulkResult struct {
+	ID     string  `json:"id"`
+	Status int     `json:"status"`
+	Error  string  `json:"error,omitempty"`
+	Device *Device `json:"device,omitempty"`
 }
 
-func (s *Store) List() []*Device {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	devices := make([]*Device, 0, len(s.order))
-	for _, id := range s.order {
-		device, ok := s.devices[id]
-		if !ok {
-			continue
-		}
-		copyDevice := *device
-		copyDevice.State = copyState(device.State)
-		devices = append(devices, &copyDevice)
-	}
-	return devices
+type NormalizeResult struct {
+	ID    string                 `json:"id"`
+	Input map[string]interface{} `json:"input"`
+	State map[string]interface{} `json:"state,omitempty"`
+	Error string                 `json:"error,omitempty"`
 }
 
-func (s *Store) Get(id string) (*Device, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	device, ok := s.devices[id]
-	if !ok {
-		return nil, false
-	}
-	copyDevice := *device
-	copyDevice.State = copyState(device.State)
-	return &copyDevice, true
-}
+var store DeviceStore
+var hub *Hub
 
-func (s *Store) Update(id string, state map[string]interface{}) (*Device, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	device, ok := s.devices[id]
-	if !ok {
-		return nil, fmt.Errorf("device not found: %s", id)
+// version is overridden at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+const (
+	catalogFetchTimeout = 10 * time.Second
+	maxCatalogBytes     = 1 << 20
+	// shutdownTimeout bounds how long a graceful shutdown waits for WebSocket
+	// clients and in-flight requests.
+	shutdownTimeout = 10 * time.Second
+)
+
+func main() {
+	config, err := LoadConfig(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
 	}
-	for key, value := range state {
-		device.State[key] = normalizeValue(device.Kind, key, value)
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
 	}
-	copyDevice := *device
-	copyDevice.State = copyState(device.State)
-	return &copyDevice, nil
-}
+	features = parseFeatures(config.Features)
+	applyFeatures(config, features)
 
-func copyState(state map[string]interface{}) map[string]interface{} {
-	if state == nil {
-		return map[string]interface{}{}
+	catalog, err := loadDevices(config.DevicesPath, config.MaxDevices, config.AllowEmpty && config.AllowCreate, config.DefaultRoom)
+	if err != nil {
+		log.Fatalf("failed to load devices: %v", err)
 	}
-	copyMap := make(map[string]interface{}, len(state))
-	for key, value := range state {
-		copyMap[key] = value
+	setLoadedDevices(catalog.Devices)
+	apiKeys, err = parseAPIKeys(config.APIKeys)
+	if err != nil {
+		log.Fatalf("failed to load api keys: %v", err)
 	}
-	return copyMap
-}
-
-func normalizeValue(kind, key string, value interface{}) interface{} {
-	switch kind {
-	case "blind", "humidifier":
-		if key == "position" || key == "level" {
-			return clampToInt(value, 0, 100)
-		}
-	case "thermostat":
-		if key == "temperature" {
-			return clampToFloat(value, 10, 30)
-		}
-	case "toggle", "lock", "sensor", "toaster", "doors", "vacuum":
-		if key == "on" || key == "open" || key == "locked" {
-			return toBool(value)
-		}
-		if key == "mode" {
-			if mode, ok := value.(string); ok {
-				return strings.TrimSpace(mode)
-			}
-		}
+	auditFile, err := openAuditLog(config.Audit)
+	if err != nil {
+		log.Fatalf("failed to open audit log: %v", err)
 	}
-	return value
-}
-
-func clampToInt(value interface{}, min, max int) int {
-	switch number := value.(type) {
-	case int:
-		return clampInt(number, min, max)
-	case int64:
-		return clampInt(int(number), min, max)
-	case float64:
-		return clampInt(int(number+0.5), min, max)
-	case float32:
-		return clampInt(int(number+0.5), min, max)
-	case json.Number:
-		if parsed, err := number.Int64(); err == nil {
-			return clampInt(int(parsed), min, max)
-		}
+	if auditFile != nil {
+		defer auditFile.Close()
 	}
-	return min
-}
-
-func clampToFloat(value interface{}, min, max float64) float64 {
-	switch number := value.(type) {
-	case float64:
-		return clampFloat(number, min, max)
-	case float32:
-		return clampFloat(float64(number), min, max)
-	case int:
-		return clampFloat(float64(number), min, max)
-	case int64:
-		return clampFloat(float64(number), min, max)
-	case json.Number:
-		if parsed, err := number.Float64(); err == nil {
-			return clampFloat(parsed, min, max)
-		}
+	webhookURLs, err := parseWebhookURLs(config.Webhooks)
+	if err != nil {
+		log.Fatalf("failed to load webhooks: %v", err)
 	}
-	return min
-}
-
-func clampInt(value, min, max int) int {
-	if value < min {
-		return min
+	deadLetters, err = openDeadLetterLog(config.Webhook.DeadLetter)
+	if err != nil {
+		log.Fatalf("failed to open dead letter log: %v", err)
 	}
-	if value > max {
-		return max
+	defer deadLetters.Close()
+	writeRules, err := writeRulesFromConfig(catalog.WriteRules)
+	if err != nil {
+		log.Fatalf("failed to load write rules: %v", err)
 	}
-	return value
-}
-
-func clampFloat(value, min, max float64) float64 {
-	if value < min {
-		return min
+	addCommandAllowlist(writeRules, catalog.CommandAllowlist)
+	writeAuthorizer = writeRules
+	transitions, err := newTransitionTable(catalog.Transitions)
+	if err != nil {
+		log.Fatalf("failed to load transitions: %v", err)
 	}
-	if value > max {
-		return max
+	replays, err := loadReplays(catalog.Replays, catalog.Devices)
+	if err != nil {
+		log.Fatalf("failed to load replays: %v", err)
 	}
-	return value
-}
-
-func toBool(value interface{}) bool {
-	switch v := value.(type) {
-	case bool:
-		return v
-	case string:
-		return strings.EqualFold(v, "true") || v == "1" || strings.EqualFold(v, "on")
-	case int:
-		return v != 0
-	case int64:
-		return v != 0
-	case float64:
-		return v != 0
-	default:
-		return false
+	minDeltas, err := newMinDeltaTable(catalog.MinDeltas, catalog.Devices)
+	if err != nil {
+		log.Fatalf("failed to load min deltas: %v", err)
 	}
-}
-
-type WSMessage struct {
-	Type    string    `json:"type"`
-	Device  *Device   `json:"device,omitempty"`
-	Devices []*Device `json:"devices,omitempty"`
-	Error   string    `json:"error,omitempty"`
-}
-
-type WSSetMessage struct {
-	Type  string                 `json:"type"`
-	ID    string                 `json:"id"`
-	State map[string]interface{} `json:"state"`
-}
-
-type Hub struct {
-	mu        sync.Mutex
-	clients   map[*websocket.Conn]struct{}
-	upgrader  websocket.Upgrader
-	store     *Store
-	broadcast chan *Device
-}
-
-func NewHub(store *Store) *Hub {
-	return &Hub{
-		clients: make(map[*websocket.Conn]struct{}),
-		upgrader: websocket.Upgrader{
-			ReadBufferSize:  1024,
-			WriteBufferSize: 1024,
-			CheckOrigin: func(r *http.Request) bool {
-				return true
-			},
-		},
-		store:     store,
-		broadcast: make(chan *Device, 32),
+	pollIntervals, err = newPollIntervalTable(catalog.PollIntervals, catalog.Devices)
+	if err != nil {
+		log.Fatalf("failed to load poll intervals: %v", err)
 	}
-}
-
-func (h *Hub) Run() {
-	for device := range h.broadcast {
-		message := WSMessage{Type: "update", Device: device}
-		h.broadcastMessage(message)
+	hysteresisRules, err := loadHysteresisRules(catalog.HysteresisRules, catalog.Devices)
+	if err != nil {
+		log.Fatalf("failed to load hysteresis rules: %v", err)
 	}
-}
-
-func (h *Hub) broadcastMessage(message WSMessage) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	for client := range h.clients {
-		if err := client.WriteJSON(message); err != nil {
-			_ = client.Close()
-			delete(h.clients, client)
+	if config.DBPath != "" {
+		sqliteStore, err := OpenSQLiteStore(config.DBPath, catalog.Devices, config.MaxDevices)
+		if err != nil {
+			log.Fatalf("failed to open sqlite store: %v", err)
 		}
+		defer sqliteStore.Close()
+		sqliteStore.authorizer = writeRules
+		sqliteStore.autoIDs = catalog.AutoIDs
+		store = sqliteStore
+	} else {
+		memoryStore := NewStore(catalog.Devices)
+		memoryStore.maxDevices = config.MaxDevices
+		memoryStore.authorizer = writeRules
+		memoryStore.autoIDs = catalog.AutoIDs
+		store = memoryStore
 	}
-}
-
-func (h *Hub) HandleWS(w http.ResponseWriter, r *http.Request) {
-	conn, err := h.upgrader.Upgrade(w, r, nil)
+	prefs, err = openPrefsStore(config.PrefsPath, config.PrefsMaxBytes)
 	if err != nil {
-		log.Printf("websocket upgrade failed: %v", err)
-		return
-	}
-	h.register(conn)
-	defer h.unregister(conn)
-
-	initial := WSMessage{Type: "state", Devices: h.store.List()}
-	if err := conn.WriteJSON(initial); err != nil {
-		log.Printf("websocket initial send failed: %v", err)
-		return
+		log.Fatalf("failed to open prefs: %v", err)
 	}
-
-	conn.SetReadLimit(4096)
-	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
-	conn.SetPongHandler(func(string) error {
-		return conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
-	})
-
-	for {
-		var incoming WSSetMessage
-		if err := conn.ReadJSON(&incoming); err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("websocket read error: %v", err)
-			}
-			return
+	metricsMaxSeries = config.MetricsSeries
+	temperatureUnit = config.TempUnit
+	maxStateKeys = config.MaxStateKeys
+	setMOTD(config.MOTD)
+	scenes = NewSceneRegistry(catalog.Scenes)
+	if saver, ok := store.(sceneSaver); ok {
+		if err := restoreCapturedScenes(saver, store.List()); err != nil {
+			log.Fatalf("failed to load captured scenes: %v", err)
 		}
-		if incoming.Type != "set" {
-			_ = conn.WriteJSON(WSMessage{Type: "error", Error: "unsupported message type"})
-			continue
+	}
+	buttonScenes = catalog.ButtonScenes
+	scenarioList, err := loadScenarios(config.Scenarios, catalog.Devices)
+	if err != nil {
+		log.Fatalf("failed to load scenarios: %v", err)
+	}
+	scenarioRunner = NewScenarioRunner(scenarioList)
+	history = NewHistory(defaultHistoryLimit)
+	hub = NewHub(store, transitions, history)
+	hub.messageLimit = config.WSMessageLimit
+	hub.resume = newResumeStore(config.WSResumeTTL)
+	hub.echo = config.WSEcho
+	hub.skipNoops = config.WSSkipNoops
+	hub.queueSize = config.WSQueueSize
+	hub.pingInterval = config.WSPing
+	hub.pongWait = config.WSPongWait
+	hub.idleTimeout = config.WSIdleTimeout
+	hub.batchWindow = config.WSBatchWindow
+	hub.anonymousReadOnly = config.WSAnonReadOnly
+	if config.DebugEventLog != "" {
+		eventLog, err := openEventLog(config.DebugEventLog)
+		if err != nil {
+			log.Fatalf("failed to open event log: %v", err)
 		}
-		if incoming.ID == "" {
-			_ = conn.WriteJSON(WSMessage{Type: "error", Error: "missing device id"})
-			continue
+		defer eventLog.Close()
+		hub.eventLog = eventLog
+		eventLogPath = config.DebugEventLog
+	}
+	hub.recent = newBackfillRing(config.WSBackfill)
+	hub.queueMaxAge = config.WSQueueMaxAge
+	hub.slowClient = config.WSSlowClient
+	hub.minDeltas = minDeltas
+	hub.hysteresis = hysteresisRules
+	go hub.Run()
+	startWebhooks(hub, webhookURLs, WebhookOptions{
+		MaxAttempts: config.Webhook.MaxAttempts,
+		Backoff:     config.Webhook.Backoff,
+		MaxBackoff:  config.Webhook.MaxBackoff,
+	})
+	if features.enabled(featureReplays) {
+		for _, replay := range replays {
+			go replay.run()
 		}
-		updated, err := h.store.Update(incoming.ID, incoming.State)
-		if err != nil {
-			_ = conn.WriteJSON(WSMessage{Type: "error", Error: err.Error()})
-			continue
+	}
+	if config.Watch {
+		if err := watchCatalog(config.DevicesPath, config.MaxDevices, config.AllowEmpty && config.AllowCreate, config.DefaultRoom); err != nil {
+			log.Fatalf("failed to watch catalog: %v", err)
 		}
-		h.broadcast <- updated
 	}
-}
-
-func (h *Hub) register(conn *websocket.Conn) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	h.clients[conn] = struct{}{}
-}
-
-func (h *Hub) unregister(conn *websocket.Conn) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	delete(h.clients, conn)
-	_ = conn.Close()
-}
-
-func main() {
-	devices, err := loadDevices("devices.yaml")
-	if err != nil {
-		log.Fatalf("failed to load devices: %v", err)
+	if !config.AllowCreate {
+		delete(deviceActions, "clone")
 	}
-	store = NewStore(devices)
-	hub = NewHub(store)
-	go hub.Run()
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/ws", hub.HandleWS)
 	mux.HandleFunc("/api/devices", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		allowed := []string{http.MethodGet, http.MethodPost}
+		if !config.AllowCreate {
+			allowed = allowed[:1]
+		}
+		if handleOptions(w, r, allowed...) {
 			return
 		}
-		writeJSON(w, http.StatusOK, store.List())
+		switch r.Method {
+		case http.MethodGet:
+			payload, err := devicesPayload(r, visibleDevices(r, store.List()))
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			writeConditionalJSON(w, r, payload)
+		case http.MethodPost:
+			if !config.AllowCreate {
+				methodNotAllowed(w, allowed...)
+				return
+			}
+			var device Device
+			if err := decodeJSON(r.Body, &device); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid json")
+				return
+			}
+			created, err := store.Add(&device)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			hub.PublishChange(r.Context(), WSMessage{Type: "added", Device: created})
+			writeJSON(w, http.StatusCreated, visibleDevice(r, created))
+		default:
+			methodNotAllowed(w, allowed...)
+		}
 	})
+	deviceMethods := []string{http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete}
+	if !config.AllowCreate {
+		deviceMethods = deviceMethods[:3]
+	}
 	mux.HandleFunc("/api/devices/", func(w http.ResponseWriter, r *http.Request) {
-		id := strings.TrimPrefix(r.URL.Path, "/api/devices/")
+		id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/devices/"), "/")
+		if id == "bulk" && action == "" {
+			allowMethods(handleBulkUpdate, http.MethodPost)(w, r)
+			return
+		}
+		if id == "reset" && action == "" {
+			allowMethods(handleReset, http.MethodPost)(w, r)
+			return
+		}
+		if id == "diff" && action == "" {
+			allowMethods(handleDiffs, http.MethodGet)(w, r)
+			return
+		}
+		if id == "by-name" {
+			allowMethods(func(w http.ResponseWriter, r *http.Request) {
+				handleDeviceByName(w, r, action)
+			}, http.MethodGet)(w, r)
+			return
+		}
 		if id == "" {
 			writeError(w, http.StatusBadRequest, "missing device id")
 			return
 		}
+		if action != "" {
+			handleDeviceAction(w, r, id, action)
+			return
+		}
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Accept-Patch", mergePatchContentType+", application/json")
+		}
+		if handleOptions(w, r, deviceMethods...) {
+			return
+		}
 		switch r.Method {
 		case http.MethodGet:
 			device, ok := store.Get(id)
@@ -343,12 +332,17 @@ func main() {
 				writeError(w, http.StatusNotFound, "device not found")
 				return
 			}
+			device = projectKeys(r, visibleDevice(r, device))
+			if wantsFlat(r) {
+				writeJSON(w, http.StatusOK, flattenDevices([]*Device{device}))
+				return
+			}
 			writeJSON(w, http.StatusOK, device)
 		case http.MethodPut:
 			var payload struct {
 				State map[string]interface{} `json:"state"`
 			}
-			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			if err := decodeJSON(r.Body, &payload); err != nil {
 				writeError(w, http.StatusBadRequest, "invalid json")
 				return
 			}
@@ -356,47 +350,434 @@ func main() {
 				writeError(w, http.StatusBadRequest, "missing state")
 				return
 			}
-			updated, err := store.Update(id, payload.State)
+			updated, err := store.Update(r.Context(), id, payload.State)
 			if err != nil {
-				writeError(w, http.StatusNotFound, err.Error())
+				writeStoreError(w, err)
 				return
 			}
-			hub.broadcast <- updated
-			writeJSON(w, http.StatusOK, updated)
+			hub.PublishChange(r.Context(), WSMessage{Type: "update", Device: updated})
+			writeJSON(w, http.StatusOK, visibleDevice(r, updated))
+		case http.MethodPatch:
+			handlePatch(w, r, id)
+		case http.MethodDelete:
+			if !config.AllowCreate {
+				methodNotAllowed(w, deviceMethods...)
+				return
+			}
+			removed, err := store.Delete(r.Context(), id)
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			hub.PublishChange(r.Context(), WSMessage{Type: "removed", Device: removed})
+			writeJSON(w, http.StatusOK, visibleDevice(r, removed))
 		default:
-			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			methodNotAllowed(w, deviceMethods...)
 		}
 	})
 
-	webDir := http.Dir("web")
-	mux.Handle("/", http.FileServer(webDir))
+	if features.enabled(featureMetrics) {
+		mux.HandleFunc("/metrics", allowMethods(handleMetrics, http.MethodGet))
+	}
+	mux.HandleFunc("/api/devices.ndjson", allowMethods(handleDevicesNDJSON, http.MethodGet))
+	mux.HandleFunc("/api/devices.csv", allowMethods(handleDevicesCSV, http.MethodGet))
+	mux.HandleFunc("/api/history", allowMethods(handleHistory, http.MethodGet))
+	mux.HandleFunc("/api/kinds", allowMethods(handleKinds, http.MethodGet))
+	mux.HandleFunc("/api/scenes", allowMethods(handleScenes, http.MethodGet))
+	mux.HandleFunc("/api/scenes/", handleScene)
+	mux.HandleFunc("/api/scenarios", allowMethods(handleScenarios, http.MethodGet))
+	mux.HandleFunc("/api/scenarios/", handleScenario)
+	mux.HandleFunc("/api/prefs/", handlePrefs)
+	mux.HandleFunc("/api/normalize", allowMethods(handleNormalize, http.MethodPost))
+	mux.HandleFunc("/api/version", allowMethods(handleVersion, http.MethodGet))
+	mux.HandleFunc("/api/bootstrap", allowMethods(handleBootstrap, http.MethodGet))
+	mux.HandleFunc("/api/motd", allowMethods(handleMOTD, http.MethodGet))
+	mux.HandleFunc("/api/stats", allowMethods(handleStats, http.MethodGet))
+	mux.HandleFunc("/api/ws/clients", allowMethods(requireAdmin(handleWSClients), http.MethodGet))
+	mux.HandleFunc("/api/ws/clients/", allowMethods(requireAdmin(handleWSClient), http.MethodDelete))
+	mux.HandleFunc("/api/ws/stats", allowMethods(requireAdmin(handleWSStats), http.MethodGet))
+	mux.HandleFunc("/api/config", allowMethods(requireAdmin(handleConfig(config)), http.MethodGet))
+	mux.HandleFunc("/api/config/devices", allowMethods(requireAdmin(handleLoadedDevices), http.MethodGet))
+	if eventLogPath != "" {
+		mux.HandleFunc("/api/debug/event-log", allowMethods(requireAdmin(handleEventLog), http.MethodGet))
+		mux.HandleFunc("/api/debug/event-log/replay", allowMethods(requireAdmin(handleReplayEventLog), http.MethodPost))
+	}
+	mux.HandleFunc("/api/faults", allowMethods(requireAdmin(handleFaults), http.MethodGet, http.MethodDelete))
+	mux.HandleFunc("/api/faults/", allowMethods(requireAdmin(handleFault), http.MethodPut, http.MethodDelete))
+	mux.HandleFunc("/api/webhooks/dead-letters", allowMethods(requireAdmin(handleDeadLetters), http.MethodGet))
 
-	addr := ":8080"
-	log.Printf("virtual smart home running at http://localhost%s", addr)
-	if err := http.ListenAndServe(addr, logRequests(mux)); err != nil {
+	webVersion, err := hashDir(config.WebDir)
+	if err != nil {
+		log.Fatalf("failed to hash web assets: %v", err)
+	}
+	mux.HandleFunc("/api/web-version", allowMethods(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+		writeJSON(w, http.StatusOK, map[string]string{"hash": webVersion})
+	}, http.MethodGet))
+
+	// Unmatched API paths get a JSON 404 instead of falling through to the
+	// static file server.
+	unknownAPIPath := func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "unknown api path")
+	}
+	mux.HandleFunc("/api", unknownAPIPath)
+	mux.HandleFunc("/api/", unknownAPIPath)
+
+	mux.Handle("/", http.FileServer(http.Dir(config.WebDir)))
+
+	server := &http.Server{
+		Addr:              config.Addr,
+		Handler:           assignRequestIDs(tagOriginClient(logRequests(limitRate(config.RateLimit, config.RateBurst, authenticate(overrideMethod(config.MethodOverride, mux)))))),
+		ReadHeaderTimeout: config.HTTP.ReadHeaderTimeout,
+		ReadTimeout:       config.HTTP.ReadTimeout,
+		WriteTimeout:      config.HTTP.WriteTimeout,
+		IdleTimeout:       config.HTTP.IdleTimeout,
+	}
+	if config.ClientCA != "" {
+		server.TLSConfig, err = clientCertTLS(config.ClientCA)
+		if err != nil {
+			log.Fatalf("failed to load client ca: %v", err)
+		}
+	}
+	stopped, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go reloadOnHangup()
+	serveErr := make(chan error, 1)
+	go func() {
+		if config.TLSCert != "" {
+			log.Printf("virtual smart home running at https://localhost%s", config.Addr)
+			serveErr <- server.ListenAndServeTLS(config.TLSCert, config.TLSKey)
+		} else {
+			log.Printf("virtual smart home running at http://localhost%s", config.Addr)
+			serveErr <- server.ListenAndServe()
+		}
+	}()
+	select {
+	case err := <-serveErr:
 		log.Fatalf("server error: %v", err)
+	case <-stopped.Done():
 	}
+
+	// WebSocket connections are hijacked and invisible to server.Shutdown, so
+	// the hub says goodbye to them first.
+	log.Printf("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	hub.Shutdown(ctx, "server shutting down", config.WSReconnect)
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+}
+
+// handleDeviceByName serves GET /api/devices/by-name/{name} with the device
+// named exactly name. Names need not be unique; when several devices share
+// one the response is 409 listing them as candidates.
+func handleDeviceByName(w http.ResponseWriter, r *http.Request, name string) {
+	if name == "" {
+		writeError(w, http.StatusBadRequest, "missing device name")
+		return
+	}
+	devices := store.GetByName(name)
+	switch len(devices) {
+	case 0:
+		writeError(w, http.StatusNotFound, "device not found")
+	case 1:
+		writeJSON(w, http.StatusOK, visibleDevice(r, devices[0]))
+	default:
+		writeJSON(w, http.StatusConflict, map[string]interface{}{
+			"error":      "device name is ambiguous",
+			"candidates": visibleDevices(r, devices),
+		})
+	}
+}
+
+// handleDevicesNDJSON streams the catalog in store order, one device per line,
+// flushing after each so line-oriented consumers can start immediately.
+func handleDevicesNDJSON(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	for _, device := range store.List() {
+		if err := encoder.Encode(visibleDevice(r, device)); err != nil {
+			log.Printf("write ndjson error: %v", err)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// deviceAction is a /api/devices/{id}/{action} endpoint and the one method it
+// accepts.
+type deviceAction struct {
+	method  string
+	handler func(w http.ResponseWriter, r *http.Request, id string)
+}
+
+var deviceActions = map[string]deviceAction{
+	"touch":           {http.MethodPost, handleTouch},
+	"step":            {http.MethodPost, handleStep},
+	"disconnect":      {http.MethodPost, requireAdminAction(handleSetOffline(true))},
+	"reconnect":       {http.MethodPost, requireAdminAction(handleSetOffline(false))},
+	"history":         {http.MethodGet, handleDeviceHistory},
+	"scenes":          {http.MethodGet, handleDeviceScenes},
+	"diff":            {http.MethodGet, handleDeviceDiff},
+	"press":           {http.MethodPost, handlePress},
+	"update-firmware": {http.MethodPost, handleUpdateFirmware},
+	"test":            {http.MethodPost, handleSelfTest},
+	"stop-test":       {http.MethodPost, handleStopSelfTest},
+	"capabilities":    {http.MethodGet, handleDeviceCapabilities},
+	"clone":           {http.MethodPost, handleClone},
+}
+
+func handleDeviceAction(w http.ResponseWriter, r *http.Request, id, name string) {
+	action, ok := deviceActions[name]
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown device action")
+		return
+	}
+	if handleOptions(w, r, action.method) {
+		return
+	}
+	if r.Method != action.method {
+		methodNotAllowed(w, action.method)
+		return
+	}
+	action.handler(w, r, id)
+}
+
+const mergePatchContentType = "application/merge-patch+json"
+
+// handlePatch applies an RFC 7386 merge patch body to the device state, where
+// a null value removes the key. A plain JSON body renames the device instead.
+func handlePatch(w http.ResponseWriter, r *http.Request, id string) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		handleRename(w, r, id)
+		return
+	}
+	if mediaType != mergePatchContentType {
+		w.Header().Set("Accept-Patch", mergePatchContentType+", application/json")
+		writeError(w, http.StatusUnsupportedMediaType, "content type must be "+mergePatchContentType+" or application/json")
+		return
+	}
+	var patch map[string]interface{}
+	if err := decodeJSON(r.Body, &patch); err != nil || patch == nil {
+		writeError(w, http.StatusBadRequest, "patch must be a json object")
+		return
+	}
+	updated, err := store.Patch(r.Context(), id, patch)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	hub.PublishChange(r.Context(), WSMessage{Type: "update", Device: updated})
+	writeJSON(w, http.StatusOK, visibleDevice(r, updated))
+}
+
+// handleReset serves POST /api/devices/reset: every device matching ?kind= and
+// ?room=, or every device without them, goes back to its catalog state in one
+// operation. Nothing is reset if any match is offline or the write is denied.
+func handleReset(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	reset, err := store.Reset(r.Context(), query.Get("kind"), query.Get("room"))
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if len(reset) > 0 {
+		hub.PublishChange(r.Context(), WSMessage{Type: "reset", Devices: reset})
+	}
+	writeJSON(w, http.StatusOK, visibleDevices(r, reset))
+}
+
+// handleBulkUpdate applies a list of device updates, all-or-nothing unless
+// ?partial=true asks for a multi-status response.
+func handleBulkUpdate(w http.ResponseWriter, r *http.Request) {
+	var updates []DeviceUpdate
+	if err := decodeJSON(r.Body, &updates); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if len(updates) == 0 {
+		writeError(w, http.StatusBadRequest, "missing updates")
+		return
+	}
+	partial := r.URL.Query().Get("partial") == "true"
+	results, err := store.UpdateMany(r.Context(), updates, partial)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	devices := make([]*Device, 0, len(results))
+	for i, result := range results {
+		if result.Device != nil {
+			hub.PublishChange(r.Context(), WSMessage{Type: "update", Device: result.Device})
+			results[i].Device = visibleDevice(r, result.Device)
+			devices = append(devices, results[i].Device)
+		}
+	}
+	if partial {
+		writeJSON(w, http.StatusMultiStatus, results)
+		return
+	}
+	writeJSON(w, http.StatusOK, devices)
+}
+
+// handleNormalize previews how each submitted state would be normalized for its
+// device without applying anything to the store.
+func handleNormalize(w http.ResponseWriter, r *http.Request) {
+	var updates []DeviceUpdate
+	if err := decodeJSON(r.Body, &updates); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	results := make([]NormalizeResult, 0, len(updates))
+	for _, update := range updates {
+		result := NormalizeResult{ID: update.ID, Input: copyState(update.State)}
+		device, ok := store.Get(update.ID)
+		if !ok {
+			result.Error = "device not found"
+		} else if state, err := normalizeDeviceState(device, update.State); err != nil {
+			result.Error = err.Error()
+		} else {
+			result.State = state
+		}
+		results = append(results, result)
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, versionInfo())
+}
+
+func versionInfo() map[string]interface{} {
+	return map[string]interface{}{
+		"version":     version,
+		"devices":     store.Count(),
+		"max_devices": store.MaxDevices(),
+		"features":    features.list(),
+	}
+}
+
+// Stats summarizes the device list for dashboard tiles.
+type Stats struct {
+	Total     int            `json:"total"`
+	ByKind    map[string]int `json:"by_kind"`
+	ByRoom    map[string]int `json:"by_room"`
+	TogglesOn int            `json:"toggles_on"`
+}
+
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	devices := store.List()
+	stats := Stats{
+		Total:  len(devices),
+		ByKind: make(map[string]int),
+		ByRoom: make(map[string]int),
+	}
+	for _, device := range devices {
+		stats.ByKind[device.Kind]++
+		stats.ByRoom[device.Room]++
+		if device.Kind == "toggle" && toBool(device.State["on"]) {
+			stats.TogglesOn++
+		}
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func handleWSClients(w http.ResponseWriter, r *http.Request) {
+	writeList(w, r, hub.ClientStats())
+}
+
+// handleWSClient serves DELETE /api/ws/clients/{id}, closing that connection.
+func handleWSClient(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/ws/clients/")
+	stats, ok := hub.Disconnect(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "client not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// loadedCatalog holds the devices as last parsed from the catalog, before any
+// runtime changes. Catalog reloads replace it.
+var loadedCatalog struct {
+	sync.RWMutex
+	devices []*Device
+}
+
+func setLoadedDevices(devices []*Device) {
+	copies := make([]*Device, 0, len(devices))
+	for _, device := range devices {
+		copies = append(copies, cloneDevice(device))
+	}
+	loadedCatalog.Lock()
+	defer loadedCatalog.Unlock()
+	loadedCatalog.devices = copies
+}
+
+// loadedDeviceIDs returns the IDs of the devices in loadedCatalog.
+func loadedDeviceIDs() map[string]bool {
+	loadedCatalog.RLock()
+	defer loadedCatalog.RUnlock()
+	ids := make(map[string]bool, len(loadedCatalog.devices))
+	for _, device := range loadedCatalog.devices {
+		ids[device.ID] = true
+	}
+	return ids
+}
+
+// handleLoadedDevices serves GET /api/config/devices: what the server loaded
+// from the catalog, as opposed to the current state in GET /api/devices.
+func handleLoadedDevices(w http.ResponseWriter, r *http.Request) {
+	loadedCatalog.RLock()
+	devices := make([]*Device, 0, len(loadedCatalog.devices))
+	for _, device := range loadedCatalog.devices {
+		devices = append(devices, cloneDevice(device))
+	}
+	loadedCatalog.RUnlock()
+	writeList(w, r, visibleDevices(r, devices))
 }
 
-func loadDevices(path string) ([]*Device, error) {
-	file, err := os.Open(filepath.Clean(path))
+// loadDevices reads and validates the catalog at path. An empty device list is
+// an error unless allowEmpty is set, for installs that add devices at runtime.
+// Devices without a room are put in defaultRoom, if it is set.
+func loadDevices(path string, maxDevices int, allowEmpty bool, defaultRoom string) (*DeviceCatalog, error) {
+	source, err := openCatalog(path)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+
+	data, err := io.ReadAll(io.LimitReader(source, maxCatalogBytes+1))
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	if len(data) > maxCatalogBytes {
+		return nil, fmt.Errorf("catalog exceeds %d bytes", maxCatalogBytes)
+	}
 
 	var catalog DeviceCatalog
-	decoder := yaml.NewDecoder(file)
-	if err := decoder.Decode(&catalog); err != nil {
+	if err := yaml.Unmarshal(data, &catalog); err != nil {
 		return nil, err
 	}
-	if len(catalog.Devices) == 0 {
+	if len(catalog.Devices) == 0 && !allowEmpty {
 		return nil, errors.New("no devices defined")
 	}
+	if maxDevices > 0 && len(catalog.Devices) > maxDevices {
+		return nil, fmt.Errorf("catalog defines %d devices, limit is %d", len(catalog.Devices), maxDevices)
+	}
+	if catalog.AutoIDs {
+		assignMissingIDs(catalog.Devices)
+	}
 	seen := make(map[string]struct{}, len(catalog.Devices))
 	for _, device := range catalog.Devices {
-		if device.ID == "" || device.Name == "" || device.Kind == "" {
-			return nil, errors.New("device missing id, name, or kind")
+		if err := validateDevice(device); err != nil {
+			return nil, err
 		}
 		if _, ok := seen[device.ID]; ok {
 			return nil, fmt.Errorf("duplicate device id: %s", device.ID)
@@ -405,8 +786,107 @@ func loadDevices(path string) ([]*Device, error) {
 		if device.State == nil {
 			device.State = map[string]interface{}{}
 		}
+		if strings.TrimSpace(device.Room) == "" {
+			device.Room = defaultRoom
+		}
 	}
-	return catalog.Devices, nil
+	if err := validateScenes(catalog.Scenes, catalog.Devices); err != nil {
+		return nil, err
+	}
+	if err := validateButtonScenes(catalog.ButtonScenes, catalog.Devices, catalog.Scenes); err != nil {
+		return nil, err
+	}
+	return &catalog, nil
+}
+
+// assignMissingIDs gives every device without an ID a slug of its name that
+// does not collide with the IDs set explicitly in the catalog.
+func assignMissingIDs(devices []*Device) {
+	taken := make(map[string]bool, len(devices))
+	for _, device := range devices {
+		if device.ID != "" {
+			taken[device.ID] = true
+		}
+	}
+	for _, device := range devices {
+		if device.ID != "" || device.Name == "" {
+			continue
+		}
+		device.ID = uniqueSlug(device.Name, func(id string) bool { return taken[id] })
+		taken[device.ID] = true
+	}
+}
+
+// openCatalog returns a reader for the catalog at path, which may be a local file
+// or an http(s) URL fetched with a timeout.
+func openCatalog(path string) (io.ReadCloser, error) {
+	if !isCatalogURL(path) {
+		return os.Open(filepath.Clean(path))
+	}
+	client := &http.Client{Timeout: catalogFetchTimeout}
+	resp, err := client.Get(path)
+	if err != nil {
+		return nil, fmt.Errorf("fetch catalog %s: %w", path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("fetch catalog %s: unexpected status %s", path, resp.Status)
+	}
+	if resp.ContentLength > maxCatalogBytes {
+		resp.Body.Close()
+		return nil, fmt.Errorf("fetch catalog %s: body too large (%d bytes)", path, resp.ContentLength)
+	}
+	if err := checkCatalogContentType(resp.Header.Get("Content-Type")); err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("fetch catalog %s: %w", path, err)
+	}
+	return resp.Body, nil
+}
+
+func isCatalogURL(path string) bool {
+	lower := strings.ToLower(path)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+func checkCatalogContentType(contentType string) error {
+	if contentType == "" {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("invalid content type %q", contentType)
+	}
+	switch mediaType {
+	case "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml", "text/plain", "application/octet-stream":
+		return nil
+	}
+	return fmt.Errorf("unsupported content type %q", mediaType)
+}
+
+// hashDir returns a SHA-256 over the relative paths and contents of every file
+// under dir, visited in lexical order.
+func hashDir(dir string) (string, error) {
+	hash := sha256.New()
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hash, "%s\x00%d\x00", filepath.ToSlash(rel), len(data))
+		hash.Write(data)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
 func writeJSON(w http.ResponseWriter, status int, payload interface{}) {
@@ -417,13 +897,45 @@ func writeJSON(w http.ResponseWriter, status int, payload interface{}) {
 	}
 }
 
+// decodeJSON decodes a request body keeping numbers as json.Number, so
+// normalization sees integers exactly as the client sent them.
+func decodeJSON(body io.Reader, v interface{}) error {
+	decoder := json.NewDecoder(body)
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
 func writeError(w http.ResponseWriter, status int, message string) {
 	writeJSON(w, status, map[string]string{"error": message})
 }
 
+// statusForError maps store errors onto HTTP status codes.
+func statusForError(err error) int {
+	switch {
+	case errors.Is(err, errDeviceNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, errDeviceExists), errors.Is(err, errDeviceLimit), errors.Is(err, errStateLimit), errors.Is(err, errFirmwareBusy),
+		errors.Is(err, errSceneExists):
+		return http.StatusConflict
+	case errors.Is(err, errInvalidDevice), errors.Is(err, errMissingState), errors.Is(err, errInvalidValue):
+		return http.StatusBadRequest
+	case errors.Is(err, errDeviceOffline):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, errDeviceFault):
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+func writeStoreError(w http.ResponseWriter, err error) {
+	writeError(w, statusForError(err), err.Error())
+}
+
 func logRequests(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("%s %s", r.Method, r.URL.Path)
+		log.Printf("%s %s request_id=%s", r.Method, r.URL.Path, requestIDFrom(r.Context()))
 		next.ServeHTTP(w, r)
 	})
 }
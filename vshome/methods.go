@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// methodNotAllowed rejects r with 405 and advertises the methods the route
+// does support.
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// handleOptions answers an OPTIONS request with the route's Allow header and
+// reports whether it did.
+func handleOptions(w http.ResponseWriter, r *http.Request, allowed ...string) bool {
+	if r.Method != http.MethodOptions {
+		return false
+	}
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// allowMethods restricts next to the given methods, answering OPTIONS and
+// rejecting anything else with the matching Allow header.
+func allowMethods(next http.HandlerFunc, allowed ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if handleOptions(w, r, allowed...) {
+			return
+		}
+		for _, method := range allowed {
+			if r.Method == method {
+				next(w, r)
+				return
+			}
+		}
+		methodNotAllowed(w, allowed...)
+	}
+}
+
+// methodOverrides are the methods X-HTTP-Method-Override may turn a POST into.
+var methodOverrides = map[string]bool{http.MethodPut: true, http.MethodPatch: true, http.MethodDelete: true}
+
+// overrideMethod lets clients behind proxies that block PUT, PATCH, and DELETE
+// send them as a POST to an /api/ route with X-HTTP-Method-Override. It does
+// nothing unless enabled.
+func overrideMethod(enabled bool, next http.Handler) http.Handler {
+	if !enabled {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		override := r.Header.Get("X-HTTP-Method-Override")
+		if override == "" || r.Method != http.MethodPost || !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		method := strings.ToUpper(strings.TrimSpace(override))
+		if !methodOverrides[method] {
+			writeError(w, http.StatusBadRequest, "X-HTTP-Method-Override must be PUT, PATCH, or DELETE")
+			return
+		}
+		r.Method = method
+		next.ServeHTTP(w, r)
+	})
+}
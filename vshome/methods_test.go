@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAllowMethods(t *testing.T) {
+	handler := allowMethods(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}, http.MethodGet, http.MethodPut)
+
+	tests := []struct {
+		method string
+		status int
+		allow  string
+	}{
+		{http.MethodGet, http.StatusOK, ""},
+		{http.MethodPut, http.StatusOK, ""},
+		{http.MethodOptions, http.StatusNoContent, "GET, PUT"},
+		{http.MethodPost, http.StatusMethodNotAllowed, "GET, PUT"},
+		{http.MethodDelete, http.StatusMethodNotAllowed, "GET, PUT"},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest(test.method, "/api/devices/light_kitchen", nil))
+		if recorder.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.method, recorder.Code, test.status)
+		}
+		if allow := recorder.Header().Get("Allow"); allow != test.allow {
+			t.Errorf("%s: Allow %q, want %q", test.method, allow, test.allow)
+		}
+	}
+}
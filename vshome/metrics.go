@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultMetricsMaxSeries caps how many vshome_device_state series /metrics
+// exports unless configured otherwise, so a large catalog or devices with
+// many keys cannot blow up the scraper's cardinality.
+const defaultMetricsMaxSeries = 1000
+
+// metricsMaxSeries is set from the config at startup.
+var metricsMaxSeries = defaultMetricsMaxSeries
+
+// handleMetrics serves GET /metrics in the Prometheus text format: aggregate
+// device and WebSocket counts, then one vshome_device_state gauge per numeric
+// or boolean state key. Private keys are never exported. Series past the
+// limit are left out and counted in vshome_device_state_dropped.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	devices := store.List()
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].ID < devices[j].ID
+	})
+	byKind := make(map[string]int)
+	for _, device := range devices {
+		byKind[device.Kind]++
+	}
+	kinds := make([]string, 0, len(byKind))
+	for kind := range byKind {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	wsStats := hub.Stats()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	fmt.Fprintln(out, "# HELP vshome_devices Devices in the store by kind.")
+	fmt.Fprintln(out, "# TYPE vshome_devices gauge")
+	for _, kind := range kinds {
+		fmt.Fprintf(out, "vshome_devices{kind=%s} %d\n", quoteLabel(kind), byKind[kind])
+	}
+	fmt.Fprintln(out, "# HELP vshome_ws_clients Connected WebSocket clients.")
+	fmt.Fprintln(out, "# TYPE vshome_ws_clients gauge")
+	fmt.Fprintf(out, "vshome_ws_clients %d\n", wsStats.Clients)
+	fmt.Fprintln(out, "# HELP vshome_ws_evicted_total WebSocket clients disconnected for falling behind.")
+	fmt.Fprintln(out, "# TYPE vshome_ws_evicted_total counter")
+	fmt.Fprintf(out, "vshome_ws_evicted_total %d\n", wsStats.Evicted)
+	fmt.Fprintln(out, "# HELP vshome_ws_messages_total WebSocket messages received from and queued for clients, by type.")
+	fmt.Fprintln(out, "# TYPE vshome_ws_messages_total counter")
+	writeMessageCounts(out, "in", wsStats.Messages.In)
+	writeMessageCounts(out, "out", wsStats.Messages.Out)
+
+	fmt.Fprintln(out, "# HELP vshome_device_state Numeric and boolean (0/1) device state values.")
+	fmt.Fprintln(out, "# TYPE vshome_device_state gauge")
+	series, dropped := 0, 0
+	for _, device := range devices {
+		keys := make([]string, 0, len(device.State))
+		for key := range device.State {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if isPrivateKey(device.schemaKind(), key) {
+				continue
+			}
+			value, ok := gaugeValue(device.State[key])
+			if !ok {
+				continue
+			}
+			if series >= metricsMaxSeries {
+				dropped++
+				continue
+			}
+			series++
+			fmt.Fprintf(out, "vshome_device_state{id=%s,kind=%s,room=%s,key=%s} %s\n",
+				quoteLabel(device.ID), quoteLabel(device.Kind), quoteLabel(device.Room), quoteLabel(key),
+				strconv.FormatFloat(value, 'g', -1, 64))
+		}
+	}
+	fmt.Fprintln(out, "# HELP vshome_device_state_dropped Device state series left out by -metrics-max-series.")
+	fmt.Fprintln(out, "# TYPE vshome_device_state_dropped gauge")
+	fmt.Fprintf(out, "vshome_device_state_dropped %d\n", dropped)
+}
+
+func writeMessageCounts(out io.Writer, direction string, counts map[string]uint64) {
+	types := make([]string, 0, len(counts))
+	for messageType := range counts {
+		types = append(types, messageType)
+	}
+	sort.Strings(types)
+	for _, messageType := range types {
+		fmt.Fprintf(out, "vshome_ws_messages_total{direction=%s,type=%s} %d\n", quoteLabel(direction), quoteLabel(messageType), counts[messageType])
+	}
+}
+
+// gaugeValue returns value as a gauge sample: numbers as they are, booleans
+// as 0 or 1. Other values are not exported.
+func gaugeValue(value interface{}) (float64, bool) {
+	if on, ok := value.(bool); ok {
+		if on {
+			return 1, true
+		}
+		return 0, true
+	}
+	if !isNumber(value) {
+		return 0, false
+	}
+	return toFloat(value)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// MinDeltaConfig holds back update broadcasts for a numeric key until it has
+// moved at least MinDelta from the value last broadcast. It applies to every
+// device of Kind, or to the single device ID, which takes precedence.
+type MinDeltaConfig struct {
+	Kind     string  `yaml:"kind"`
+	ID       string  `yaml:"id"`
+	Key      string  `yaml:"key"`
+	MinDelta float64 `yaml:"min_delta"`
+}
+
+// minDeltaTolerance keeps float rounding from holding back a change of
+// exactly the threshold, such as 21.2 to 21.4 with a min delta of 0.2.
+const minDeltaTolerance = 1e-9
+
+type minDeltaTable struct {
+	byKind map[string]map[string]float64
+	byID   map[string]map[string]float64
+}
+
+func newMinDeltaTable(configs []MinDeltaConfig, devices []*Device) (minDeltaTable, error) {
+	table := minDeltaTable{byKind: map[string]map[string]float64{}, byID: map[string]map[string]float64{}}
+	kinds := make(map[string]string, len(devices))
+	for _, device := range devices {
+		kinds[device.ID] = device.schemaKind()
+	}
+	for _, config := range configs {
+		if (config.Kind == "") == (config.ID == "") {
+			return minDeltaTable{}, fmt.Errorf("min delta for %s: needs exactly one of kind or id", config.Key)
+		}
+		target, kind, thresholds := config.Kind, config.Kind, table.byKind
+		if config.ID != "" {
+			var ok bool
+			if kind, ok = kinds[config.ID]; !ok {
+				return minDeltaTable{}, fmt.Errorf("min delta: unknown device %q", config.ID)
+			}
+			target, thresholds = config.ID, table.byID
+		}
+		if !isNumericKey(kind, config.Key) {
+			return minDeltaTable{}, fmt.Errorf("min delta for %s.%s: not a numeric key", target, config.Key)
+		}
+		if config.MinDelta <= 0 {
+			return minDeltaTable{}, fmt.Errorf("min delta for %s.%s: min_delta must be positive", target, config.Key)
+		}
+		if thresholds[target] == nil {
+			thresholds[target] = map[string]float64{}
+		}
+		thresholds[target][config.Key] = config.MinDelta
+	}
+	return table, nil
+}
+
+// isNumericKey reports whether key is an int or float key of kind, or, for a
+// bare "sensor", of any sensor type.
+func isNumericKey(kind, key string) bool {
+	numeric := func(schema KindSchema) bool {
+		keySchema, ok := schema.Keys[key]
+		return ok && (keySchema.Type == typeInt || keySchema.Type == typeFloat)
+	}
+	schema, ok := schemaFor(kind)
+	if !ok {
+		return false
+	}
+	if numeric(schema) {
+		return true
+	}
+	for _, typed := range schema.SensorTypes {
+		if numeric(typed) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t minDeltaTable) empty() bool {
+	return len(t.byKind) == 0 && len(t.byID) == 0
+}
+
+func (t minDeltaTable) threshold(device *Device, key string) (float64, bool) {
+	if delta, ok := t.byID[device.ID][key]; ok {
+		return delta, true
+	}
+	delta, ok := t.byKind[device.Kind][key]
+	return delta, ok
+}
+
+// belowMinDelta runs on the hub goroutine and reports whether an update only
+// moved keys with a min delta, each by less than its threshold, since the
+// device was last broadcast. Such an update is stored but not broadcast; later
+// updates are compared with the last broadcast value, so small moves add up.
+func (h *Hub) belowMinDelta(device *Device) bool {
+	sent := h.lastSent[device.ID]
+	if h.minDeltas.empty() || sent == nil {
+		return false
+	}
+	if sent.Name != device.Name || sent.Room != device.Room || sent.Offline != device.Offline {
+		return false
+	}
+	changed := false
+	for key := range unionKeys(sent.State, device.State) {
+		before, after := sent.State[key], device.State[key]
+		if reflect.DeepEqual(before, after) {
+			continue
+		}
+		changed = true
+		delta, ok := h.minDeltas.threshold(device, key)
+		if !ok {
+			return false
+		}
+		from, okFrom := toFloat(before)
+		to, okTo := toFloat(after)
+		if !okFrom || !okTo || math.Abs(to-from) >= delta-minDeltaTolerance {
+			return false
+		}
+	}
+	return changed
+}
+
+func unionKeys(a, b map[string]interface{}) map[string]struct{} {
+	keys := make(map[string]struct{}, len(a)+len(b))
+	for key := range a {
+		keys[key] = struct{}{}
+	}
+	for key := range b {
+		keys[key] = struct{}{}
+	}
+	return keys
+}
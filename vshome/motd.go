@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// MOTDConfig is the branding served by GET /api/motd for the dashboard to
+// show. It is the one part of the config a SIGHUP reloads.
+type MOTDConfig struct {
+	ServerName string `yaml:"server_name" json:"server_name"`
+	Message    string `yaml:"message" json:"message,omitempty"`
+	LogoURL    string `yaml:"logo_url" json:"logo_url,omitempty"`
+}
+
+// motdMaxAge is how long clients may cache /api/motd before revalidating.
+const motdMaxAge = 60
+
+var currentMOTD struct {
+	sync.RWMutex
+	motd MOTDConfig
+	etag string
+}
+
+func validLogoURL(logo string) error {
+	if logo == "" {
+		return nil
+	}
+	parsed, err := url.Parse(logo)
+	if err != nil || (parsed.Scheme != "" && parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return fmt.Errorf("logo url %q must be an http(s) URL or a path", logo)
+	}
+	return nil
+}
+
+func setMOTD(motd MOTDConfig) {
+	body, _ := json.Marshal(motd)
+	sum := sha256.Sum256(body)
+	currentMOTD.Lock()
+	defer currentMOTD.Unlock()
+	currentMOTD.motd = motd
+	currentMOTD.etag = `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// handleMOTD serves GET /api/motd. It needs no API key, and clients may cache
+// it for motdMaxAge seconds and revalidate with If-None-Match after that.
+func handleMOTD(w http.ResponseWriter, r *http.Request) {
+	currentMOTD.RLock()
+	motd, etag := currentMOTD.motd, currentMOTD.etag
+	currentMOTD.RUnlock()
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", motdMaxAge))
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeJSON(w, http.StatusOK, motd)
+}
+
+// reloadOnHangup rereads the config on every SIGHUP and applies its MOTD.
+// Everything else still needs a restart.
+func reloadOnHangup() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	for range hangups {
+		reloaded, err := LoadConfig(os.Args[1:], os.Getenv)
+		if err != nil {
+			log.Printf("config reload skipped, keeping last good config: %v", err)
+			continue
+		}
+		setMOTD(reloaded.MOTD)
+		log.Printf("config reloaded: motd")
+	}
+}
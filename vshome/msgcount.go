@@ -0,0 +1,70 @@
+package main
+
+import "sync"
+
+// clientMessageTypes are the inbound types counted by name. Anything else is
+// counted as "unsupported", and frames that fail to decode as "invalid", so
+// clients cannot grow the counters without bound.
+var clientMessageTypes = map[string]bool{
+	"set": true, "get": true, "subscribe": true, "subscribe_add": true, "subscribe_remove": true,
+	"whoami": true, "hold": true, "release": true,
+}
+
+// messageCounts counts WebSocket messages by type, received from clients and
+// queued for them.
+type messageCounts struct {
+	mu  sync.Mutex
+	in  map[string]uint64
+	out map[string]uint64
+}
+
+// MessageCounts is a snapshot of messageCounts for /api/ws/stats.
+type MessageCounts struct {
+	In  map[string]uint64 `json:"in"`
+	Out map[string]uint64 `json:"out"`
+}
+
+func (m *messageCounts) received(messageType string) {
+	if !clientMessageTypes[messageType] {
+		messageType = "unsupported"
+	}
+	m.add(true, messageType)
+}
+
+// undecodable counts a client message that did not fit any message shape.
+func (m *messageCounts) undecodable() {
+	m.add(true, "invalid")
+}
+
+func (m *messageCounts) sent(messageType string) {
+	m.add(false, messageType)
+}
+
+func (m *messageCounts) add(inbound bool, messageType string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.in == nil {
+		m.in, m.out = make(map[string]uint64), make(map[string]uint64)
+	}
+	if inbound {
+		m.in[messageType]++
+	} else {
+		m.out[messageType]++
+	}
+}
+
+func (m *messageCounts) snapshot() MessageCounts {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	snapshot := MessageCounts{In: make(map[string]uint64, len(m.in)), Out: make(map[string]uint64, len(m.out))}
+	for messageType, count := range m.in {
+		snapshot.In[messageType] = count
+	}
+	for messageType, count := range m.out {
+		snapshot.Out[messageType] = count
+	}
+	return snapshot
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+)
+
+// defaultPageLimit and maxPageLimit bound the ?limit= of a paged list.
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 1000
+)
+
+// Page is the envelope a list endpoint answers with when the request asks
+// for a page: one window of the items, and the total to page through.
+type Page struct {
+	Items  interface{} `json:"items"`
+	Total  int         `json:"total"`
+	Limit  int         `json:"limit"`
+	Offset int         `json:"offset"`
+}
+
+// pageParams reads ?limit= and ?offset=. paged reports whether either was
+// given; a missing limit defaults to defaultPageLimit.
+func pageParams(r *http.Request) (limit, offset int, paged bool, err error) {
+	query := r.URL.Query()
+	limit = defaultPageLimit
+	if raw := query.Get("limit"); raw != "" {
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			return 0, 0, true, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+		paged = true
+	}
+	if raw := query.Get("offset"); raw != "" {
+		offset, err = strconv.Atoi(raw)
+		if err != nil || offset < 0 {
+			return 0, 0, true, errors.New("offset must be a non-negative integer")
+		}
+		paged = true
+	}
+	return limit, offset, paged, nil
+}
+
+// writeList writes the slice items as a bare JSON array, or, when r asks for
+// a page with ?limit= or ?offset=, that window of it in a Page.
+func writeList(w http.ResponseWriter, r *http.Request, items interface{}) {
+	payload, err := listPayload(r, items)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, payload)
+}
+
+// listPayload is what writeList would write for items.
+func listPayload(r *http.Request, items interface{}) (interface{}, error) {
+	limit, offset, paged, err := pageParams(r)
+	if err != nil || !paged {
+		return items, err
+	}
+	return paginate(items, limit, offset), nil
+}
+
+// paginate cuts the window of limit items from offset out of the slice items.
+func paginate(items interface{}, limit, offset int) Page {
+	list := reflect.ValueOf(items)
+	total := list.Len()
+	start := offset
+	if start > total {
+		start = total
+	}
+	end := start + limit
+	if end > total {
+		end = total
+	}
+	return Page{Items: list.Slice(start, end).Interface(), Total: total, Limit: limit, Offset: offset}
+}
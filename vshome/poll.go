@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// PollIntervalConfig overrides how often clients without a WebSocket are
+// advised to poll every device of Kind, or the single device ID, which takes
+// precedence.
+type PollIntervalConfig struct {
+	Kind     string        `yaml:"kind"`
+	ID       string        `yaml:"id"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// fallbackPollInterval is advised for kinds without a default.
+const fallbackPollInterval = 30 * time.Second
+
+// defaultPollIntervals follow how often each kind changes on its own:
+// sensors report constantly, while toggles only change when someone sets
+// them.
+var defaultPollIntervals = map[string]time.Duration{
+	"sensor":     5 * time.Second,
+	"doors":      5 * time.Second,
+	"button":     5 * time.Second,
+	"vacuum":     10 * time.Second,
+	"blind":      10 * time.Second,
+	"thermostat": 15 * time.Second,
+	"humidifier": 15 * time.Second,
+	"lock":       30 * time.Second,
+	"toggle":     60 * time.Second,
+	"toaster":    60 * time.Second,
+}
+
+type pollIntervalTable struct {
+	byKind map[string]time.Duration
+	byID   map[string]time.Duration
+}
+
+// pollIntervals is set from the catalog at startup.
+var pollIntervals = pollIntervalTable{byKind: defaultPollIntervals}
+
+func newPollIntervalTable(configs []PollIntervalConfig, devices []*Device) (pollIntervalTable, error) {
+	table := pollIntervalTable{byKind: make(map[string]time.Duration, len(defaultPollIntervals)), byID: make(map[string]time.Duration)}
+	for kind, interval := range defaultPollIntervals {
+		table.byKind[kind] = interval
+	}
+	known := make(map[string]bool, len(devices))
+	for _, device := range devices {
+		known[device.ID] = true
+	}
+	for _, config := range configs {
+		if (config.Kind == "") == (config.ID == "") {
+			return pollIntervalTable{}, fmt.Errorf("poll interval %s: needs exactly one of kind or id", config.Interval)
+		}
+		if config.Interval <= 0 {
+			return pollIntervalTable{}, fmt.Errorf("poll interval for %s%s: interval must be positive", config.Kind, config.ID)
+		}
+		if config.ID != "" {
+			if !known[config.ID] {
+				return pollIntervalTable{}, fmt.Errorf("poll interval: unknown device %q", config.ID)
+			}
+			table.byID[config.ID] = config.Interval
+			continue
+		}
+		if _, ok := kindSchemas[config.Kind]; !ok {
+			return pollIntervalTable{}, fmt.Errorf("poll interval: unknown kind %q", config.Kind)
+		}
+		table.byKind[config.Kind] = config.Interval
+	}
+	return table, nil
+}
+
+func (t pollIntervalTable) forKind(kind string) time.Duration {
+	if interval, ok := t.byKind[kind]; ok {
+		return interval
+	}
+	return fallbackPollInterval
+}
+
+// pollInterval is how often a client without a WebSocket is advised to poll
+// d, in seconds.
+func (d Device) pollInterval() float64 {
+	if interval, ok := pollIntervals.byID[d.ID]; ok {
+		return interval.Seconds()
+	}
+	return pollIntervals.forKind(d.Kind).Seconds()
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const defaultPrefsMaxBytes = 16 << 10
+
+// prefsSnapshotEvery is how many changes the delta log takes before it is
+// folded into a new base snapshot.
+const prefsSnapshotEvery = 256
+
+// PrefsStore holds opaque per-client UI preferences, such as collapsed tiles
+// or the theme, so they follow a user across browsers. With a path set, the
+// file there is a base snapshot and each change is appended to a delta log
+// beside it, path + ".log", rather than rewriting the whole file.
+type PrefsStore struct {
+	mu       sync.RWMutex
+	path     string
+	maxBytes int
+	prefs    map[string]json.RawMessage
+	// deltas is the open delta log and logged the changes in it.
+	deltas *os.File
+	logged int
+	// torn is set when a failed append could not be cut back off the log;
+	// the next append compacts first rather than land after the torn line.
+	torn bool
+}
+
+// prefsDelta is one line of the delta log: the prefs a client was set to.
+type prefsDelta struct {
+	Client string          `json:"client"`
+	Prefs  json.RawMessage `json:"prefs"`
+}
+
+var prefs *PrefsStore
+
+// openPrefsStore loads the prefs file at path, starting empty when it does
+// not exist yet, replays the delta log over it, and compacts the two into a
+// new base. An empty path keeps prefs in memory only.
+func openPrefsStore(path string, maxBytes int) (*PrefsStore, error) {
+	s := &PrefsStore{path: path, maxBytes: maxBytes, prefs: make(map[string]json.RawMessage)}
+	if path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &s.prefs); err != nil {
+			return nil, fmt.Errorf("parse prefs %s: %w", path, err)
+		}
+	}
+	if s.deltas, err = os.OpenFile(s.logPath(), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600); err != nil {
+		return nil, err
+	}
+	if err := s.replay(); err != nil {
+		s.deltas.Close()
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		s.deltas.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *PrefsStore) logPath() string {
+	return filepath.Clean(s.path) + ".log"
+}
+
+// replay applies the delta log in order. A last line that does not parse was
+// cut short by a crash mid-append and is dropped; a bad line before it means
+// the log is corrupt.
+func (s *PrefsStore) replay() error {
+	scanner := bufio.NewScanner(s.deltas)
+	scanner.Buffer(make([]byte, 0, 64<<10), 2*s.maxBytes+(64<<10))
+	var torn error
+	for line := 1; scanner.Scan(); line++ {
+		if torn != nil {
+			return torn
+		}
+		var delta prefsDelta
+		err := json.Unmarshal(scanner.Bytes(), &delta)
+		if err == nil && delta.Client == "" {
+			err = errors.New("missing client")
+		}
+		if err != nil {
+			torn = fmt.Errorf("parse prefs log %s line %d: %w", s.logPath(), line, err)
+			continue
+		}
+		s.prefs[delta.Client] = delta.Prefs
+	}
+	if torn != nil {
+		log.Printf("dropping the torn last entry of %s", s.logPath())
+	}
+	return scanner.Err()
+}
+
+func (s *PrefsStore) Get(clientID string) (json.RawMessage, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok := s.prefs[clientID]
+	return value, ok
+}
+
+// Set replaces the prefs of clientID. The change is on disk, appended to the
+// delta log and synced, before Set returns.
+func (s *PrefsStore) Set(clientID string, value json.RawMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.append(prefsDelta{Client: clientID, Prefs: value}); err != nil {
+		return err
+	}
+	s.prefs[clientID] = value
+	if s.logged >= prefsSnapshotEvery {
+		if err := s.compact(); err != nil {
+			log.Printf("prefs snapshot failed, keeping the delta log: %v", err)
+		}
+	}
+	return nil
+}
+
+// append writes delta to the log and syncs it. A write or sync that fails
+// is cut back off, so the log never holds a partial line before a whole one.
+// Callers hold mu.
+func (s *PrefsStore) append(delta prefsDelta) error {
+	if s.deltas == nil {
+		return nil
+	}
+	if s.torn {
+		if err := s.compact(); err != nil {
+			return fmt.Errorf("prefs log has a torn entry: %w", err)
+		}
+		s.torn = false
+	}
+	line, err := json.Marshal(delta)
+	if err != nil {
+		return err
+	}
+	offset, err := s.deltas.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	_, err = s.deltas.Write(append(line, '\n'))
+	if err == nil {
+		err = s.deltas.Sync()
+	}
+	if err != nil {
+		if truncErr := s.deltas.Truncate(offset); truncErr != nil {
+			log.Printf("prefs log %s: cannot remove failed entry: %v", s.logPath(), truncErr)
+			s.torn = true
+		}
+		return err
+	}
+	s.logged++
+	return nil
+}
+
+// compact writes every client's prefs as a new base snapshot and empties the
+// delta log. The base goes to a temporary file that is synced and renamed
+// over the old one, so a crash leaves either snapshot whole; the log is only
+// emptied once the rename is durable, and replaying it over the new base
+// changes nothing. Callers hold mu.
+func (s *PrefsStore) compact() error {
+	data, err := json.Marshal(s.prefs)
+	if err != nil {
+		return err
+	}
+	path := filepath.Clean(s.path)
+	if err := writeFileSynced(path+".tmp", data); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	if err := s.deltas.Truncate(0); err != nil {
+		return err
+	}
+	s.logged = 0
+	return s.deltas.Sync()
+}
+
+func writeFileSynced(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// handlePrefs serves GET and PUT /api/prefs/{clientId}. The body may be any
+// JSON value up to the configured size.
+func handlePrefs(w http.ResponseWriter, r *http.Request) {
+	clientID := strings.TrimPrefix(r.URL.Path, "/api/prefs/")
+	if !validRequestID(clientID) {
+		writeError(w, http.StatusBadRequest, "client id must be printable ascii without spaces, up to 128 characters")
+		return
+	}
+	if handleOptions(w, r, http.MethodGet, http.MethodPut) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		value, ok := prefs.Get(clientID)
+		if !ok {
+			writeError(w, http.StatusNotFound, "no prefs for client")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(value)
+	case http.MethodPut:
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(prefs.maxBytes)))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("prefs exceed %d bytes", prefs.maxBytes))
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "failed to read body")
+			return
+		}
+		body = bytes.TrimSpace(body)
+		if !json.Valid(body) {
+			writeError(w, http.StatusBadRequest, "invalid json")
+			return
+		}
+		if err := prefs.Set(clientID, json.RawMessage(body)); err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to save prefs")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(body)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPut)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestPrefs(t *testing.T, path string) *PrefsStore {
+	t.Helper()
+	store, err := openPrefsStore(path, defaultPrefsMaxBytes)
+	if err != nil {
+		t.Fatalf("open prefs: %v", err)
+	}
+	t.Cleanup(func() { store.deltas.Close() })
+	return store
+}
+
+func wantPrefs(t *testing.T, store *PrefsStore, client, want string) {
+	t.Helper()
+	if got, ok := store.Get(client); !ok || string(got) != want {
+		t.Fatalf("prefs of %s = %s, want %s", client, got, want)
+	}
+}
+
+func TestPrefsSurviveReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prefs.json")
+	store := openTestPrefs(t, path)
+	if err := store.Set("a", json.RawMessage(`{"theme":"dark"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set("a", json.RawMessage(`{"theme":"light"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set("b", json.RawMessage(`[1,2]`)); err != nil {
+		t.Fatal(err)
+	}
+	store.deltas.Close()
+
+	reopened := openTestPrefs(t, path)
+	wantPrefs(t, reopened, "a", `{"theme":"light"}`)
+	wantPrefs(t, reopened, "b", `[1,2]`)
+}
+
+func TestPrefsDropTornLastEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prefs.json")
+	store := openTestPrefs(t, path)
+	if err := store.Set("a", json.RawMessage(`1`)); err != nil {
+		t.Fatal(err)
+	}
+	store.deltas.WriteString(`{"client":"a","pre`)
+	store.deltas.Close()
+
+	reopened := openTestPrefs(t, path)
+	wantPrefs(t, reopened, "a", `1`)
+}
+
+func TestPrefsCompactOverTornEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prefs.json")
+	store := openTestPrefs(t, path)
+	// As left by an append whose failure could not be cut back off.
+	store.deltas.WriteString(`{"client":"a","pre`)
+	store.torn = true
+	if err := store.Set("a", json.RawMessage(`2`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set("b", json.RawMessage(`3`)); err != nil {
+		t.Fatal(err)
+	}
+	store.deltas.Close()
+
+	data, err := os.ReadFile(path + ".log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened := openTestPrefs(t, path)
+	wantPrefs(t, reopened, "a", `2`)
+	wantPrefs(t, reopened, "b", `3`)
+	if !bytes.HasPrefix(data, []byte(`{"client":"a","prefs":2}`)) {
+		t.Fatalf("log is %q, want it to start with a whole entry", data)
+	}
+}
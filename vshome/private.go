@@ -0,0 +1,76 @@
+package main
+
+import "net/http"
+
+// redactDevice returns device without the private keys of its kind, or device
+// itself when it holds none.
+func redactDevice(device *Device) *Device {
+	if device == nil {
+		return nil
+	}
+	for key := range device.State {
+		if isPrivateKey(device.schemaKind(), key) {
+			redacted := *device
+			redacted.State = redactState(device.schemaKind(), device.State)
+			return &redacted
+		}
+	}
+	return device
+}
+
+// redactState returns a copy of state without the private keys of kind.
+func redactState(kind string, state map[string]interface{}) map[string]interface{} {
+	redacted := make(map[string]interface{}, len(state))
+	for key, value := range state {
+		if !isPrivateKey(kind, key) {
+			redacted[key] = value
+		}
+	}
+	return redacted
+}
+
+// redactTransitions returns transitions without those of the private keys of
+// kind.
+func redactTransitions(kind string, transitions map[string]Transition) map[string]Transition {
+	var redacted map[string]Transition
+	for key, transition := range transitions {
+		if isPrivateKey(kind, key) {
+			continue
+		}
+		if redacted == nil {
+			redacted = make(map[string]Transition, len(transitions))
+		}
+		redacted[key] = transition
+	}
+	return redacted
+}
+
+func redactDevices(devices []*Device) []*Device {
+	redacted := make([]*Device, 0, len(devices))
+	for _, device := range devices {
+		redacted = append(redacted, redactDevice(device))
+	}
+	return redacted
+}
+
+// showPrivate reports whether r asked for private keys with ?private=true and
+// was authenticated as an admin.
+func showPrivate(r *http.Request) bool {
+	return r.URL.Query().Get("private") == "true" && identityFrom(r.Context()).Role == roleAdmin
+}
+
+// visibleDevice is device as r should see it: redacted unless r asked for
+// private keys, with temperatures in r's unit.
+func visibleDevice(r *http.Request, device *Device) *Device {
+	if !showPrivate(r) {
+		device = redactDevice(device)
+	}
+	return localizeDevice(device, requestUnit(r))
+}
+
+func visibleDevices(r *http.Request, devices []*Device) []*Device {
+	if !showPrivate(r) {
+		devices = redactDevices(devices)
+	}
+	return localizeDevices(devices, requestUnit(r))
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// safeMethods are the HTTP methods a viewer may use: they read and change
+// nothing.
+var safeMethods = map[string]bool{http.MethodGet: true, http.MethodHead: true, http.MethodOptions: true}
+
+// readOnlyMessageTypes are the client messages a read-only connection may
+// send: those that only choose or fetch what it reads.
+var readOnlyMessageTypes = map[string]bool{
+	"get": true, "subscribe": true, "subscribe_add": true, "subscribe_remove": true, "whoami": true,
+}
+
+// isReadOnly reports whether a connection by identity may only read: viewers
+// always, and anonymous clients when the hub is configured so.
+func (h *Hub) isReadOnly(identity Identity) bool {
+	return identity.Role == roleViewer || (h.anonymousReadOnly && identity == anonymousIdentity)
+}
+
+// refuses reports whether c may not send a message of messageType, answering
+// it with an error if so. Unknown types are left to the usual reply.
+func (c *client) refuses(messageType, requestID string) bool {
+	if !c.readOnly || !clientMessageTypes[messageType] || readOnlyMessageTypes[messageType] {
+		return false
+	}
+	c.sendJSON(WSMessage{Type: "error", Error: fmt.Sprintf("%s is not allowed on a read-only connection", messageType), RequestID: requestID})
+	return true
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const maxDisplayNameLength = 100
+
+// validDisplayName checks a device name or room: at most
+// maxDisplayNameLength characters of printable text. Only rooms may be empty.
+func validDisplayName(field, value string, allowEmpty bool) error {
+	if value == "" && !allowEmpty {
+		return fmt.Errorf("%w: %s must not be empty", errInvalidValue, field)
+	}
+	if utf8.RuneCountInString(value) > maxDisplayNameLength {
+		return fmt.Errorf("%w: %s must be at most %d characters", errInvalidValue, field, maxDisplayNameLength)
+	}
+	for _, r := range value {
+		if !unicode.IsPrint(r) {
+			return fmt.Errorf("%w: %s must be printable text", errInvalidValue, field)
+		}
+	}
+	return nil
+}
+
+// handleRename serves PATCH /api/devices/{id} with a plain JSON body of
+// {"name":...,"room":...}. Either field may be left out to keep it; the
+// device's ID and state are untouched.
+func handleRename(w http.ResponseWriter, r *http.Request, id string) {
+	var payload struct {
+		Name *string `json:"name"`
+		Room *string `json:"room"`
+	}
+	if err := decodeJSON(r.Body, &payload); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if payload.Name == nil && payload.Room == nil {
+		writeError(w, http.StatusBadRequest, "body needs name or room")
+		return
+	}
+	device, ok := store.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "device not found")
+		return
+	}
+	name, room := device.Name, device.Room
+	if payload.Name != nil {
+		name = strings.TrimSpace(*payload.Name)
+	}
+	if payload.Room != nil {
+		room = strings.TrimSpace(*payload.Room)
+	}
+	if err := validDisplayName("name", name, false); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if err := validDisplayName("room", room, true); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	renamed, err := store.SetInfo(id, name, room)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	hub.PublishChange(r.Context(), WSMessage{Type: "renamed", Device: renamed})
+	writeJSON(w, http.StatusOK, visibleDevice(r, renamed))
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReplayConfig feeds a device key from a CSV time series of timestamp,value
+// rows, replayed in a loop. Timestamps are either seconds from the start of
+// the series or RFC 3339 times; only the gaps between rows matter. Speed
+// scales playback, 2 plays twice as fast.
+type ReplayConfig struct {
+	ID    string  `yaml:"id"`
+	Key   string  `yaml:"key"`
+	File  string  `yaml:"file"`
+	Speed float64 `yaml:"speed"`
+}
+
+type replaySample struct {
+	offset time.Duration
+	value  interface{}
+}
+
+type replay struct {
+	config  ReplayConfig
+	samples []replaySample
+}
+
+// loadReplays validates the configs against the catalog and reads every
+// series up front so a bad file fails at startup rather than mid-demo.
+func loadReplays(configs []ReplayConfig, devices []*Device) ([]*replay, error) {
+	kinds := make(map[string]string, len(devices))
+	for _, device := range devices {
+		kinds[device.ID] = device.schemaKind()
+	}
+	replays := make([]*replay, 0, len(configs))
+	for _, config := range configs {
+		kind, ok := kinds[config.ID]
+		if !ok {
+			return nil, fmt.Errorf("replay: unknown device %q", config.ID)
+		}
+		if _, ok := lookupKey(kind, config.Key); !ok {
+			return nil, fmt.Errorf("replay for %s: unknown key %q for kind %s", config.ID, config.Key, kind)
+		}
+		if config.Speed < 0 {
+			return nil, fmt.Errorf("replay for %s: speed must be positive", config.ID)
+		}
+		if config.Speed == 0 {
+			config.Speed = 1
+		}
+		samples, err := readReplayFile(config.File)
+		if err != nil {
+			return nil, fmt.Errorf("replay for %s: %w", config.ID, err)
+		}
+		replays = append(replays, &replay{config: config, samples: samples})
+	}
+	return replays, nil
+}
+
+// readReplayFile parses path, skipping a header and any malformed or
+// out-of-order rows with a warning.
+func readReplayFile(path string) ([]replaySample, error) {
+	file, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+
+	var samples []replaySample
+	var start time.Time
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			log.Printf("replay %s line %d skipped: %v", path, line, err)
+			continue
+		}
+		if len(record) != 2 {
+			log.Printf("replay %s line %d skipped: expected timestamp,value", path, line)
+			continue
+		}
+		offset, at, err := parseReplayTimestamp(record[0], start)
+		if err != nil {
+			if line > 1 || len(samples) > 0 {
+				log.Printf("replay %s line %d skipped: %v", path, line, err)
+			}
+			continue
+		}
+		if start.IsZero() && !at.IsZero() {
+			start = at
+		}
+		if len(samples) > 0 && offset < samples[len(samples)-1].offset {
+			log.Printf("replay %s line %d skipped: timestamp goes backwards", path, line)
+			continue
+		}
+		samples = append(samples, replaySample{offset: offset, value: parseReplayValue(record[1])})
+	}
+	if len(samples) == 0 {
+		return nil, fmt.Errorf("%s has no valid rows", path)
+	}
+	return samples, nil
+}
+
+// parseReplayTimestamp returns the offset of raw from the series start. For
+// RFC 3339 values it also returns the absolute time so the first row can set
+// the start.
+func parseReplayTimestamp(raw string, start time.Time) (time.Duration, time.Time, error) {
+	raw = strings.TrimSpace(raw)
+	if seconds, err := strconv.ParseFloat(raw, 64); err == nil {
+		if seconds < 0 {
+			return 0, time.Time{}, fmt.Errorf("negative timestamp %q", raw)
+		}
+		return time.Duration(seconds * float64(time.Second)), time.Time{}, nil
+	}
+	at, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("invalid timestamp %q", raw)
+	}
+	if start.IsZero() {
+		return 0, at, nil
+	}
+	return at.Sub(start), at, nil
+}
+
+// parseReplayValue reads numbers and booleans; anything else is passed on as a
+// string and left to normalization.
+func parseReplayValue(raw string) interface{} {
+	raw = strings.TrimSpace(raw)
+	if number, err := strconv.ParseFloat(raw, 64); err == nil {
+		return number
+	}
+	if flag, err := strconv.ParseBool(raw); err == nil {
+		return flag
+	}
+	return raw
+}
+
+// run applies each sample through the normal update path, looping forever.
+func (r *replay) run() {
+	for {
+		var elapsed time.Duration
+		for _, sample := range r.samples {
+			time.Sleep(time.Duration(float64(sample.offset-elapsed) / r.config.Speed))
+			elapsed = sample.offset
+			r.apply(sample.value)
+		}
+		// Leave the average gap before starting over so the loop point does not
+		// produce two updates at once.
+		gap := time.Second
+		if last := r.samples[len(r.samples)-1].offset; len(r.samples) > 1 && last > 0 {
+			gap = last / time.Duration(len(r.samples)-1)
+		}
+		time.Sleep(time.Duration(float64(gap) / r.config.Speed))
+	}
+}
+
+func (r *replay) apply(value interface{}) {
+	ctx := systemContext()
+	updated, err := store.Update(ctx, r.config.ID, map[string]interface{}{r.config.Key: value})
+	if err != nil {
+		log.Printf("replay %s.%s failed: %v", r.config.ID, r.config.Key, err)
+		return
+	}
+	hub.PublishChange(ctx, WSMessage{Type: "update", Device: updated})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultResumeTTL = 2 * time.Minute
+
+// resumeStore remembers the subscription of recently disconnected clients by
+// the resume token they were given in their hello frame, so a client that
+// reconnects with ?resume= within the TTL gets it back without resubscribing.
+type resumeStore struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	sessions map[string]resumeSession
+}
+
+type resumeSession struct {
+	identity string
+	sub      subscription
+	expires  time.Time
+}
+
+func newResumeStore(ttl time.Duration) *resumeStore {
+	return &resumeStore{ttl: ttl, sessions: make(map[string]resumeSession)}
+}
+
+// save keeps sub under token until the TTL passes. Tokens are single use, so
+// a token that was already claimed is never saved again.
+func (s *resumeStore) save(token, identity string, sub subscription) {
+	if s.ttl <= 0 || token == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for key, session := range s.sessions {
+		if now.After(session.expires) {
+			delete(s.sessions, key)
+		}
+	}
+	s.sessions[token] = resumeSession{identity: identity, sub: sub, expires: now.Add(s.ttl)}
+}
+
+// claim returns and forgets the subscription saved under token. The token
+// only resumes for the identity it was issued to.
+func (s *resumeStore) claim(token, identity string) (subscription, bool) {
+	if token == "" {
+		return subscription{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[token]
+	if !ok || session.identity != identity || time.Now().After(session.expires) {
+		return subscription{}, false
+	}
+	delete(s.sessions, token)
+	return session.sub, true
+}
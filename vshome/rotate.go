@@ -0,0 +1,194 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const rotatedTimeFormat = "20060102T150405.000000000"
+
+// RotateOptions controls when a RotatingFile rolls over and what it keeps.
+// Zero values disable the corresponding limit.
+type RotateOptions struct {
+	MaxSize  int64
+	MaxAge   time.Duration
+	MaxFiles int
+	Compress bool
+}
+
+// RotatingFile is an append-only io.Writer that rolls the file over once it
+// reaches MaxSize bytes or MaxAge. Writes and rotation share one mutex, so a
+// record is never split across files or lost while rolling over.
+type RotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	options  RotateOptions
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	// finishing serializes compressing and pruning rotated files, and
+	// finishers lets Close wait for them.
+	finishing sync.Mutex
+	finishers sync.WaitGroup
+}
+
+func OpenRotatingFile(path string, options RotateOptions) (*RotatingFile, error) {
+	f := &RotatingFile{path: filepath.Clean(path), options: options}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.openedAt = time.Now()
+	return nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.shouldRotate(int64(len(p))) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) shouldRotate(incoming int64) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.options.MaxSize > 0 && f.size+incoming > f.options.MaxSize {
+		return true
+	}
+	return f.options.MaxAge > 0 && time.Since(f.openedAt) > f.options.MaxAge
+}
+
+// rotate rolls the file over. If that fails, it keeps appending to the
+// current file rather than leave writes with nowhere to go, and only reports
+// an error when not even that can be reopened.
+func (f *RotatingFile) rotate() error {
+	rotated := f.path + "." + time.Now().Format(rotatedTimeFormat)
+	err := f.file.Close()
+	if err == nil {
+		err = os.Rename(f.path, rotated)
+		if err == nil {
+			if err = f.open(); err == nil {
+				f.finishers.Add(1)
+				go f.finishRotation(rotated)
+				return nil
+			}
+			if restoreErr := os.Rename(rotated, f.path); restoreErr != nil {
+				log.Printf("restore %s failed: %v", f.path, restoreErr)
+			}
+		}
+	}
+	if openErr := f.open(); openErr != nil {
+		return fmt.Errorf("rotate %s: %v; reopen: %w", f.path, err, openErr)
+	}
+	log.Printf("rotate %s failed, appending to it instead: %v", f.path, err)
+	return nil
+}
+
+// finishRotation compresses and prunes old files outside the write lock, one
+// rotation at a time.
+func (f *RotatingFile) finishRotation(rotated string) {
+	defer f.finishers.Done()
+	f.finishing.Lock()
+	defer f.finishing.Unlock()
+	if f.options.Compress {
+		// An earlier rotation's prune may already have removed it.
+		if err := gzipFile(rotated); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("compress %s failed: %v", rotated, err)
+		}
+	}
+	if f.options.MaxFiles > 0 {
+		f.prune()
+	}
+}
+
+func (f *RotatingFile) prune() {
+	matches, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return
+	}
+	var rotated []string
+	for _, match := range matches {
+		if !strings.HasSuffix(match, ".tmp") {
+			rotated = append(rotated, match)
+		}
+	}
+	// Timestamps sort lexically, so the oldest files come first.
+	sort.Strings(rotated)
+	for len(rotated) > f.options.MaxFiles {
+		if err := os.Remove(rotated[0]); err != nil && !os.IsNotExist(err) {
+			log.Printf("remove %s failed: %v", rotated[0], err)
+		}
+		rotated = rotated[1:]
+	}
+}
+
+// Close closes the file once rotated files are compressed and pruned.
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.finishers.Wait()
+	return f.file.Close()
+}
+
+func gzipFile(path string) error {
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	tmp := path + ".gz.tmp"
+	target, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(target)
+	if _, err := io.Copy(writer, source); err != nil {
+		target.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		target.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := target.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		return fmt.Errorf("rename compressed file: %w", err)
+	}
+	return os.Remove(path)
+}
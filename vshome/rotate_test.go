@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRotatingFileKeepsConcurrentWrites(t *testing.T) {
+	const writers, records = 8, 200
+	path := filepath.Join(t.TempDir(), "audit.log")
+	file, err := OpenRotatingFile(path, RotateOptions{MaxSize: 512, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for writer := 0; writer < writers; writer++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			for record := 0; record < records; record++ {
+				if _, err := fmt.Fprintf(file, "writer %d record %d\n", writer, record); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(writer)
+	}
+	wg.Wait()
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	paths, err := filepath.Glob(path + "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) < 2 {
+		t.Fatalf("files = %v, want the log to have rotated", paths)
+	}
+	seen := make(map[string]bool)
+	for _, name := range paths {
+		if strings.HasSuffix(name, ".tmp") {
+			t.Fatalf("compression left %s behind", name)
+		}
+		for _, line := range readLogLines(t, name) {
+			if seen[line] {
+				t.Fatalf("%q written twice", line)
+			}
+			seen[line] = true
+		}
+	}
+	for writer := 0; writer < writers; writer++ {
+		for record := 0; record < records; record++ {
+			if line := fmt.Sprintf("writer %d record %d", writer, record); !seen[line] {
+				t.Fatalf("%q was lost", line)
+			}
+		}
+	}
+	if len(seen) != writers*records {
+		t.Fatalf("%d records, want %d", len(seen), writers*records)
+	}
+}
+
+// readLogLines returns the lines of the log at name, decompressing it if it
+// was gzipped.
+func readLogLines(t *testing.T, name string) []string {
+	t.Helper()
+	source, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	var reader io.Reader = source
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(source)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		reader = gz
+	}
+	var lines []string
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return lines
+}
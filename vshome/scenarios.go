@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Scenario is a one-shot script of state changes, each applied at an offset
+// from the moment the scenario is started.
+type Scenario struct {
+	Name  string          `yaml:"name"`
+	Steps []*ScenarioStep `yaml:"steps"`
+}
+
+type ScenarioStep struct {
+	At    time.Duration          `yaml:"at"`
+	ID    string                 `yaml:"id"`
+	State map[string]interface{} `yaml:"state"`
+}
+
+// ScenarioStatus reports the current or last run of a scenario.
+type ScenarioStatus struct {
+	Name       string     `json:"name"`
+	Running    bool       `json:"running"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Stopped    bool       `json:"stopped,omitempty"`
+	Applied    int        `json:"steps_applied"`
+	Failed     int        `json:"steps_failed"`
+	Total      int        `json:"steps_total"`
+	LastError  string     `json:"last_error,omitempty"`
+}
+
+var errScenarioRunning = errors.New("scenario already running")
+
+// ScenarioRunner owns the loaded scenarios and at most one run of each.
+type ScenarioRunner struct {
+	mu        sync.Mutex
+	scenarios map[string]*Scenario
+	order     []string
+	status    map[string]*ScenarioStatus
+	cancel    map[string]context.CancelFunc
+}
+
+var scenarioRunner = NewScenarioRunner(nil)
+
+func NewScenarioRunner(list []*Scenario) *ScenarioRunner {
+	runner := &ScenarioRunner{
+		scenarios: make(map[string]*Scenario, len(list)),
+		status:    make(map[string]*ScenarioStatus, len(list)),
+		cancel:    make(map[string]context.CancelFunc),
+	}
+	for _, scenario := range list {
+		runner.scenarios[scenario.Name] = scenario
+		runner.order = append(runner.order, scenario.Name)
+		runner.status[scenario.Name] = &ScenarioStatus{Name: scenario.Name, Total: len(scenario.Steps)}
+	}
+	return runner
+}
+
+// loadScenarios reads the scenario file at path and checks every step against
+// the catalog. Steps are sorted by offset.
+func loadScenarios(path string, devices []*Device) ([]*Scenario, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Scenarios []*Scenario `yaml:"scenarios"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	kinds := make(map[string]string, len(devices))
+	for _, device := range devices {
+		kinds[device.ID] = device.schemaKind()
+	}
+	seen := make(map[string]struct{}, len(file.Scenarios))
+	for _, scenario := range file.Scenarios {
+		if scenario.Name == "" {
+			return nil, errors.New("scenario missing name")
+		}
+		if _, ok := seen[scenario.Name]; ok {
+			return nil, fmt.Errorf("duplicate scenario name: %s", scenario.Name)
+		}
+		seen[scenario.Name] = struct{}{}
+		if len(scenario.Steps) == 0 {
+			return nil, fmt.Errorf("scenario %s has no steps", scenario.Name)
+		}
+		for _, step := range scenario.Steps {
+			kind, ok := kinds[step.ID]
+			if !ok {
+				return nil, fmt.Errorf("scenario %s: unknown device %q", scenario.Name, step.ID)
+			}
+			if step.At < 0 {
+				return nil, fmt.Errorf("scenario %s: step for %s has a negative offset", scenario.Name, step.ID)
+			}
+			if len(step.State) == 0 {
+				return nil, fmt.Errorf("scenario %s: step for %s has no state", scenario.Name, step.ID)
+			}
+			if _, err := normalizeState(kind, step.State); err != nil {
+				return nil, fmt.Errorf("scenario %s: step for %s: %w", scenario.Name, step.ID, err)
+			}
+		}
+		sort.SliceStable(scenario.Steps, func(i, j int) bool {
+			return scenario.Steps[i].At < scenario.Steps[j].At
+		})
+	}
+	return file.Scenarios, nil
+}
+
+func (r *ScenarioRunner) Get(name string) (*Scenario, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	scenario, ok := r.scenarios[name]
+	return scenario, ok
+}
+
+// Statuses returns the status of every scenario in file order.
+func (r *ScenarioRunner) Statuses() []ScenarioStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	statuses := make([]ScenarioStatus, 0, len(r.order))
+	for _, name := range r.order {
+		statuses = append(statuses, *r.status[name])
+	}
+	return statuses
+}
+
+func (r *ScenarioRunner) Status(name string) ScenarioStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return *r.status[name]
+}
+
+// Start runs scenario in the background, applying each step with the identity
+// and request ID in ctx. Starting a scenario that is already running fails.
+func (r *ScenarioRunner) Start(ctx context.Context, scenario *Scenario) (ScenarioStatus, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.status[scenario.Name].Running {
+		return *r.status[scenario.Name], fmt.Errorf("%w: %s", errScenarioRunning, scenario.Name)
+	}
+	// The run outlives the request that started it, so only its values are
+	// carried over.
+	runCtx, cancel := context.WithCancel(withRequestID(withIdentity(context.Background(), identityFrom(ctx)), requestIDFrom(ctx)))
+	now := time.Now().UTC()
+	r.status[scenario.Name] = &ScenarioStatus{Name: scenario.Name, Running: true, StartedAt: &now, Total: len(scenario.Steps)}
+	r.cancel[scenario.Name] = cancel
+	go r.run(runCtx, scenario, now)
+	return *r.status[scenario.Name], nil
+}
+
+// Stop cancels a running scenario. Steps already applied are not undone.
+func (r *ScenarioRunner) Stop(name string) ScenarioStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cancel, ok := r.cancel[name]; ok {
+		cancel()
+		r.finishLocked(name, true)
+	}
+	return *r.status[name]
+}
+
+func (r *ScenarioRunner) finishLocked(name string, stopped bool) {
+	delete(r.cancel, name)
+	status := r.status[name]
+	now := time.Now().UTC()
+	status.Running = false
+	status.Stopped = stopped
+	status.FinishedAt = &now
+}
+
+func (r *ScenarioRunner) run(ctx context.Context, scenario *Scenario, start time.Time) {
+	for _, step := range scenario.Steps {
+		wait := time.NewTimer(time.Until(start.Add(step.At)))
+		select {
+		case <-ctx.Done():
+			wait.Stop()
+			return
+		case <-wait.C:
+		}
+		err := applyScenarioStep(ctx, step)
+		r.mu.Lock()
+		if ctx.Err() != nil {
+			r.mu.Unlock()
+			return
+		}
+		status := r.status[scenario.Name]
+		if err != nil {
+			log.Printf("scenario %s: step for %s failed: %v", scenario.Name, step.ID, err)
+			status.Failed++
+			status.LastError = err.Error()
+		} else {
+			status.Applied++
+		}
+		r.mu.Unlock()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ctx.Err() == nil {
+		r.finishLocked(scenario.Name, false)
+	}
+}
+
+func applyScenarioStep(ctx context.Context, step *ScenarioStep) error {
+	updated, err := store.Update(ctx, step.ID, step.State)
+	if err != nil {
+		return err
+	}
+	hub.PublishChange(ctx, WSMessage{Type: "update", Device: updated})
+	return nil
+}
+
+func handleScenarios(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, scenarioRunner.Statuses())
+}
+
+// handleScenario serves GET /api/scenarios/{name} with the run status, and
+// POST /api/scenarios/{name}/run and /stop.
+func handleScenario(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/scenarios/")
+	name, action, _ := strings.Cut(path, "/")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, "missing scenario name")
+		return
+	}
+	scenario, ok := scenarioRunner.Get(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, "scenario not found")
+		return
+	}
+	if action != "" && action != "run" && action != "stop" {
+		writeError(w, http.StatusNotFound, "unknown scenario action")
+		return
+	}
+	allowed := http.MethodGet
+	if action != "" {
+		allowed = http.MethodPost
+	}
+	if handleOptions(w, r, allowed) {
+		return
+	}
+	if r.Method != allowed {
+		methodNotAllowed(w, allowed)
+		return
+	}
+	switch action {
+	case "":
+		writeJSON(w, http.StatusOK, scenarioRunner.Status(name))
+	case "run":
+		status, err := scenarioRunner.Start(r.Context(), scenario)
+		if err != nil {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusAccepted, status)
+	case "stop":
+		writeJSON(w, http.StatusOK, scenarioRunner.Stop(name))
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Scene is a named set of actions applied together.
+type Scene struct {
+	Name    string         `yaml:"name" json:"name"`
+	Actions []*SceneAction `yaml:"actions" json:"actions"`
+}
+
+// SceneAction either merges State into a device or, when Toggle is set, flips
+// that boolean key based on the device's state at trigger time.
+type SceneAction struct {
+	ID     string                 `yaml:"id" json:"id"`
+	State  map[string]interface{} `yaml:"state,omitempty" json:"state,omitempty"`
+	Toggle string                 `yaml:"toggle,omitempty" json:"toggle,omitempty"`
+}
+
+var (
+	errSceneNotFound = errors.New("scene not found")
+	errSceneExists   = errors.New("scene already exists")
+)
+
+// SceneMembership is what one scene does to one device: the state it sets or
+// the key it toggles.
+type SceneMembership struct {
+	Scene  string                 `json:"scene"`
+	State  map[string]interface{} `json:"state,omitempty"`
+	Toggle string                 `json:"toggle,omitempty"`
+}
+
+type SceneRegistry struct {
+	mu     sync.RWMutex
+	scenes map[string]*Scene
+	order  []string
+	// byDevice indexes scene actions by target device, in scene order.
+	byDevice map[string][]SceneMembership
+	// captured names the scenes added at runtime by Capture; the rest come
+	// from the catalog and cannot be replaced.
+	captured map[string]bool
+}
+
+var scenes *SceneRegistry
+
+func NewSceneRegistry(list []*Scene) *SceneRegistry {
+	registry := &SceneRegistry{
+		scenes:   make(map[string]*Scene, len(list)),
+		captured: make(map[string]bool),
+	}
+	for _, scene := range list {
+		registry.scenes[scene.Name] = scene
+		registry.order = append(registry.order, scene.Name)
+	}
+	registry.index()
+	return registry
+}
+
+// index rebuilds byDevice from the scenes in order.
+func (r *SceneRegistry) index() {
+	r.byDevice = make(map[string][]SceneMembership)
+	for _, name := range r.order {
+		for _, action := range r.scenes[name].Actions {
+			r.byDevice[action.ID] = append(r.byDevice[action.ID], SceneMembership{
+				Scene:  name,
+				State:  action.State,
+				Toggle: action.Toggle,
+			})
+		}
+	}
+}
+
+// Capture adds scene, replacing an earlier capture of the same name. Catalog
+// scenes cannot be replaced. save, when set, persists the scene first and
+// nothing changes if it fails.
+func (r *SceneRegistry) Capture(scene *Scene, save func(*Scene) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.scenes[scene.Name]; ok && !r.captured[scene.Name] {
+		return fmt.Errorf("%w: %s is defined in the catalog", errSceneExists, scene.Name)
+	}
+	if save != nil {
+		if err := save(scene); err != nil {
+			return err
+		}
+	}
+	if !r.captured[scene.Name] {
+		r.order = append(r.order, scene.Name)
+	}
+	r.scenes[scene.Name] = scene
+	r.captured[scene.Name] = true
+	r.index()
+	return nil
+}
+
+func (r *SceneRegistry) List() []*Scene {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	list := make([]*Scene, 0, len(r.order))
+	for _, name := range r.order {
+		list = append(list, r.scenes[name])
+	}
+	return list
+}
+
+func (r *SceneRegistry) Get(name string) (*Scene, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	scene, ok := r.scenes[name]
+	return scene, ok
+}
+
+// ForDevice returns every scene action that targets id.
+func (r *SceneRegistry) ForDevice(id string) []SceneMembership {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	memberships := make([]SceneMembership, len(r.byDevice[id]))
+	copy(memberships, r.byDevice[id])
+	return memberships
+}
+
+// validateScenes checks scene names and that every action targets a known
+// device with a well-formed state or boolean toggle key.
+func validateScenes(list []*Scene, devices []*Device) error {
+	kinds := make(map[string]string, len(devices))
+	for _, device := range devices {
+		kinds[device.ID] = device.schemaKind()
+	}
+	seen := make(map[string]struct{}, len(list))
+	for _, scene := range list {
+		if scene.Name == "" {
+			return errors.New("scene missing name")
+		}
+		if _, ok := seen[scene.Name]; ok {
+			return fmt.Errorf("duplicate scene name: %s", scene.Name)
+		}
+		seen[scene.Name] = struct{}{}
+		if len(scene.Actions) == 0 {
+			return fmt.Errorf("scene %s has no actions", scene.Name)
+		}
+		for _, action := range scene.Actions {
+			kind, ok := kinds[action.ID]
+			if !ok {
+				return fmt.Errorf("scene %s: unknown device %q", scene.Name, action.ID)
+			}
+			if err := validateSceneAction(kind, action); err != nil {
+				return fmt.Errorf("scene %s: %w", scene.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func validateSceneAction(kind string, action *SceneAction) error {
+	hasState := len(action.State) > 0
+	hasToggle := action.Toggle != ""
+	if hasState == hasToggle {
+		return fmt.Errorf("action for %s needs exactly one of state or toggle", action.ID)
+	}
+	if hasToggle && !isBoolKey(kind, action.Toggle) {
+		return fmt.Errorf("cannot toggle %q on %s: not a boolean key for kind %s", action.Toggle, action.ID, kind)
+	}
+	if _, err := normalizeState(kind, action.State); err != nil {
+		return fmt.Errorf("action for %s: %w", action.ID, err)
+	}
+	return nil
+}
+
+// ApplyScene runs every action of scene under a single write lock so toggles
+// read the state they flip atomically. Nothing is applied if any target is
+// missing.
+func (s *Store) ApplyScene(ctx context.Context, scene *Scene) ([]*Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, action := range scene.Actions {
+		device, ok := s.devices[action.ID]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", errDeviceNotFound, action.ID)
+		}
+		if err := checkOnline(device); err != nil {
+			return nil, err
+		}
+		if err := validateSceneAction(device.schemaKind(), action); err != nil {
+			return nil, err
+		}
+		if err := checkValueTypes(device, sceneActionState(device, action)); err != nil {
+			return nil, err
+		}
+		if err := checkStateKeys(device, sceneActionState(device, action), nil); err != nil {
+			return nil, err
+		}
+		if err := authorizeWrite(ctx, s.authorizer, device, sceneActionState(device, action)); err != nil {
+			return nil, err
+		}
+		if err := checkFaults(device.ID, sceneActionState(device, action)); err != nil {
+			return nil, err
+		}
+	}
+	updated := make([]*Device, 0, len(scene.Actions))
+	for _, action := range scene.Actions {
+		device := s.devices[action.ID]
+		if err := mergeState(device, sceneActionState(device, action)); err != nil {
+			return nil, err
+		}
+		updated = append(updated, cloneDevice(device))
+	}
+	return updated, nil
+}
+
+// sceneSaver is implemented by stores that persist captured scenes alongside
+// device state.
+type sceneSaver interface {
+	SaveScene(scene *Scene) error
+	CapturedScenes() ([]*Scene, error)
+}
+
+// restoreCapturedScenes adds the scenes saved by an earlier run to scenes,
+// skipping any that no longer fit the catalog.
+func restoreCapturedScenes(saver sceneSaver, devices []*Device) error {
+	list, err := saver.CapturedScenes()
+	if err != nil {
+		return err
+	}
+	for _, scene := range list {
+		if err := validateScenes([]*Scene{scene}, devices); err != nil {
+			log.Printf("skipping captured scene: %v", err)
+			continue
+		}
+		if err := scenes.Capture(scene, nil); err != nil {
+			log.Printf("skipping captured scene: %v", err)
+		}
+	}
+	return nil
+}
+
+// capturableState is the part of device's state a captured scene restores:
+// everything but readonly keys such as sensor readings, and private keys
+// unless private is set.
+func capturableState(device *Device, private bool) map[string]interface{} {
+	kind := device.schemaKind()
+	state := make(map[string]interface{}, len(device.State))
+	for key, value := range device.State {
+		if schema, ok := lookupKey(kind, key); ok && schema.Control.Widget == widgetReadonly {
+			continue
+		}
+		if !private && isPrivateKey(kind, key) {
+			continue
+		}
+		state[key] = value
+	}
+	return state
+}
+
+// handleCaptureScene serves POST /api/scenes/{name}/capture: the current
+// state of the devices matching ?ids=, ?kind=, and ?room= (every device
+// without them) becomes scene name, which triggering later restores.
+func handleCaptureScene(w http.ResponseWriter, r *http.Request, name string) {
+	query := r.URL.Query()
+	ids := queryValues(query["ids"])
+	wanted := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if id != "" {
+			wanted[id] = true
+		}
+	}
+	kind, room := query.Get("kind"), query.Get("room")
+	private := showPrivate(r)
+	scene := &Scene{Name: name}
+	byID := len(wanted) > 0
+	for _, device := range store.List() {
+		if byID && !wanted[device.ID] {
+			continue
+		}
+		delete(wanted, device.ID)
+		if !matchesFilter(device, kind, room) {
+			continue
+		}
+		if state := capturableState(device, private); len(state) > 0 {
+			scene.Actions = append(scene.Actions, &SceneAction{ID: device.ID, State: state})
+		}
+	}
+	for id := range wanted {
+		writeStoreError(w, fmt.Errorf("%w: %s", errDeviceNotFound, id))
+		return
+	}
+	if len(scene.Actions) == 0 {
+		writeError(w, http.StatusBadRequest, "no matching device has state to capture")
+		return
+	}
+	var save func(*Scene) error
+	if saver, ok := store.(sceneSaver); ok {
+		save = saver.SaveScene
+	}
+	if err := scenes.Capture(scene, save); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, visibleScene(r, scene))
+}
+
+// sceneActionState resolves action against the device's current state.
+func sceneActionState(device *Device, action *SceneAction) map[string]interface{} {
+	if action.Toggle != "" {
+		return map[string]interface{}{action.Toggle: !toBool(device.State[action.Toggle])}
+	}
+	return action.State
+}
+
+func handleScenes(w http.ResponseWriter, r *http.Request) {
+	list := scenes.List()
+	visible := make([]*Scene, 0, len(list))
+	for _, scene := range list {
+		visible = append(visible, visibleScene(r, scene))
+	}
+	writeList(w, r, visible)
+}
+
+// visibleScene returns scene with its actions' states as r should see them:
+// in r's temperature unit and without the private keys of their devices, which
+// an admin capture with ?private=true may have stored, unless r may see them.
+// An action whose device is gone is left as stored for r if r may see private
+// keys and keeps no state otherwise, as its kind is unknown.
+func visibleScene(r *http.Request, scene *Scene) *Scene {
+	private, unit := showPrivate(r), requestUnit(r)
+	visible := &Scene{Name: scene.Name, Actions: make([]*SceneAction, 0, len(scene.Actions))}
+	for _, action := range scene.Actions {
+		if action.State != nil {
+			shown := *action
+			if device, ok := store.Get(action.ID); ok {
+				shown.State = visibleState(device, action.State, private, unit)
+			} else if !private {
+				shown.State = map[string]interface{}{}
+			}
+			action = &shown
+		}
+		visible.Actions = append(visible.Actions, action)
+	}
+	return visible
+}
+
+// visibleState returns state, meant for device, in unit and, unless private,
+// without device's private keys.
+func visibleState(device *Device, state map[string]interface{}, private bool, unit string) map[string]interface{} {
+	kind := device.schemaKind()
+	if !private {
+		state = redactState(kind, state)
+	}
+	return localizeState(kind, state, unit)
+}
+
+// handleDeviceScenes serves GET /api/devices/{id}/scenes: the scenes that
+// include the device and what each would do to it.
+func handleDeviceScenes(w http.ResponseWriter, r *http.Request, id string) {
+	device, ok := store.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "device not found")
+		return
+	}
+	memberships := scenes.ForDevice(id)
+	private, unit := showPrivate(r), requestUnit(r)
+	for i := range memberships {
+		if memberships[i].State != nil {
+			memberships[i].State = visibleState(device, memberships[i].State, private, unit)
+		}
+	}
+	writeJSON(w, http.StatusOK, memberships)
+}
+
+// handleScene serves GET /api/scenes/{name} and POST /api/scenes/{name}/trigger.
+func handleScene(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/scenes/")
+	name, action, _ := strings.Cut(path, "/")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, "missing scene name")
+		return
+	}
+	if action == "capture" {
+		allowMethods(func(w http.ResponseWriter, r *http.Request) {
+			handleCaptureScene(w, r, name)
+		}, http.MethodPost)(w, r)
+		return
+	}
+	scene, ok := scenes.Get(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, errSceneNotFound.Error())
+		return
+	}
+	if action != "" && action != "trigger" {
+		writeError(w, http.StatusNotFound, "unknown scene action")
+		return
+	}
+	allowed := http.MethodGet
+	if action == "trigger" {
+		allowed = http.MethodPost
+	}
+	if handleOptions(w, r, allowed) {
+		return
+	}
+	if r.Method != allowed {
+		methodNotAllowed(w, allowed)
+		return
+	}
+	if action == "" {
+		writeJSON(w, http.StatusOK, visibleScene(r, scene))
+		return
+	}
+	updated, err := store.ApplyScene(r.Context(), scene)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	for _, device := range updated {
+		hub.PublishChange(r.Context(), WSMessage{Type: "update", Device: device})
+	}
+	writeJSON(w, http.StatusOK, visibleDevices(r, updated))
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestScenesShowCallersView(t *testing.T) {
+	previousStore, previousScenes := store, scenes
+	t.Cleanup(func() { store, scenes = previousStore, previousScenes })
+	store = NewStore([]*Device{
+		{ID: "thermostat_hall", Name: "Hall Thermostat", Kind: "thermostat", State: map[string]interface{}{"temperature": 20.0, "calibration": 0.0}},
+	})
+	scenes = NewSceneRegistry([]*Scene{{Name: "warm", Actions: []*SceneAction{
+		{ID: "thermostat_hall", State: map[string]interface{}{"temperature": 25.0, "calibration": 1.0}},
+	}}})
+	want := map[string]interface{}{"temperature": 77.0}
+
+	recorder := httptest.NewRecorder()
+	handleDeviceScenes(recorder, httptest.NewRequest(http.MethodGet, "/api/devices/thermostat_hall/scenes?unit=F", nil), "thermostat_hall")
+	var memberships []SceneMembership
+	if err := json.Unmarshal(recorder.Body.Bytes(), &memberships); err != nil {
+		t.Fatal(err)
+	}
+	if len(memberships) != 1 || !statesEqual(memberships[0].State, want) {
+		t.Fatalf("device scenes = %+v, want the state in Fahrenheit without calibration", memberships)
+	}
+
+	scene := visibleScene(httptest.NewRequest(http.MethodGet, "/api/scenes/warm?unit=F", nil), scenes.List()[0])
+	if !statesEqual(scene.Actions[0].State, want) {
+		t.Fatalf("scene state = %v, want it in Fahrenheit without calibration", scene.Actions[0].State)
+	}
+}
+
+func statesEqual(got, want map[string]interface{}) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for key, value := range want {
+		if got[key] != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	typeBool   = "bool"
+	typeInt    = "int"
+	typeFloat  = "float"
+	typeString = "string"
+)
+
+// Control widgets a UI can render for a key.
+const (
+	widgetToggle   = "toggle"
+	widgetSlider   = "slider"
+	widgetDropdown = "dropdown"
+	widgetText     = "text"
+	widgetReadonly = "readonly"
+)
+
+// ControlHint suggests how a generic UI should render a key: the widget, the
+// step of a slider, and the choices of a dropdown. Hints are advisory; the
+// server does not restrict values to Options.
+type ControlHint struct {
+	Widget  string   `json:"widget"`
+	Step    float64  `json:"step,omitempty"`
+	Options []string `json:"options,omitempty"`
+}
+
+// KeySchema describes one state key: its value type, for numbers the range
+// values are clamped to, and the control a UI should render for it. Private
+// keys are stored but left out of what clients see unless an admin asks for
+// them. Required keys cannot be removed from a device's state.
+type KeySchema struct {
+	Type     string      `json:"type"`
+	Min      *float64    `json:"min,omitempty"`
+	Max      *float64    `json:"max,omitempty"`
+	Unit     string      `json:"unit,omitempty"`
+	Private  bool        `json:"private,omitempty"`
+	Required bool        `json:"required,omitempty"`
+	Control  ControlHint `json:"control"`
+	// Units are the alternate units a value may be written in, as
+	// {"value":...,"unit":...}, besides Unit; see convertUnits.
+	Units []string `json:"units,omitempty"`
+
+	conversions map[string]unitConversion
+	// difference marks a temperature that is an offset rather than a
+	// reading, converted between units without shifting the zero point.
+	difference bool
+}
+
+// KindSchema lists the state keys a device kind understands. Keys outside the
+// schema are stored as submitted. Derived fields are computed from the state
+// on output and cannot be written. Sensors pick their keys from SensorTypes by
+// their sensor_type.
+type KindSchema struct {
+	Kind        string                  `json:"kind"`
+	Keys        map[string]KeySchema    `json:"keys"`
+	Derived     map[string]DerivedField `json:"derived,omitempty"`
+	SensorTypes map[string]KindSchema   `json:"sensor_types,omitempty"`
+	// PollInterval is the kind's advised poll interval in seconds, filled in
+	// by GET /api/kinds.
+	PollInterval float64 `json:"poll_interval,omitempty"`
+}
+
+var errInvalidValue = errors.New("invalid value")
+
+func boolKey() KeySchema {
+	return KeySchema{Type: typeBool, Control: ControlHint{Widget: widgetToggle}}
+}
+
+func stringKey() KeySchema {
+	return KeySchema{Type: typeString, Control: ControlHint{Widget: widgetText}}
+}
+
+// choiceKey is a string key a UI offers as a dropdown of options.
+func choiceKey(options ...string) KeySchema {
+	return KeySchema{Type: typeString, Control: ControlHint{Widget: widgetDropdown, Options: options}}
+}
+
+// rangeKey is a number clamped to min..max, shown as a slider in steps of 1.
+func rangeKey(keyType string, min, max float64, unit string) KeySchema {
+	return KeySchema{Type: keyType, Min: &min, Max: &max, Unit: unit, Control: ControlHint{Widget: widgetSlider, Step: 1}}
+}
+
+func differenceKey(key KeySchema) KeySchema {
+	key.difference = true
+	return key
+}
+
+// withUnits lets values of key be written in the units of conversions.
+func withUnits(key KeySchema, conversions map[string]unitConversion) KeySchema {
+	key.conversions = conversions
+	key.Units = make([]string, 0, len(conversions))
+	for unit := range conversions {
+		key.Units = append(key.Units, unit)
+	}
+	sort.Strings(key.Units)
+	return key
+}
+
+func withStep(key KeySchema, step float64) KeySchema {
+	key.Control.Step = step
+	return key
+}
+
+// readonlyKey marks a key a UI should display but not offer to change, such
+// as a sensor reading.
+func readonlyKey(key KeySchema) KeySchema {
+	key.Control = ControlHint{Widget: widgetReadonly}
+	return key
+}
+
+func privateKey(key KeySchema) KeySchema {
+	key.Private = true
+	return key
+}
+
+func requiredKey(key KeySchema) KeySchema {
+	key.Required = true
+	return key
+}
+
+var kindSchemas = map[string]KindSchema{
+	"toggle": {Kind: "toggle", Keys: map[string]KeySchema{
+		"on":         requiredKey(boolKey()),
+		"color_temp": withStep(rangeKey(typeInt, 2000, 6500, "K"), 100),
+	}},
+	"toaster": {Kind: "toaster", Keys: map[string]KeySchema{
+		"on": requiredKey(boolKey()),
+	}},
+	"vacuum": {Kind: "vacuum", Keys: map[string]KeySchema{
+		"on":   requiredKey(boolKey()),
+		"mode": choiceKey("docked", "cleaning", "spot", "returning"),
+	}},
+	"lock": {Kind: "lock", Keys: map[string]KeySchema{
+		"locked": requiredKey(boolKey()),
+	}},
+	"sensor": {Kind: "sensor", Keys: sensorTypes[defaultSensorType].Keys, SensorTypes: sensorTypes},
+	"doors": {Kind: "doors", Keys: map[string]KeySchema{
+		"open": requiredKey(boolKey()),
+	}},
+	"blind": {Kind: "blind", Keys: map[string]KeySchema{
+		"position": requiredKey(withUnits(rangeKey(typeInt, 0, 100, "%"), map[string]unitConversion{
+			"m":      travelPercent("meters", func(travel Travel) float64 { return travel.Meters }),
+			"counts": travelPercent("counts", func(travel Travel) float64 { return travel.Counts }),
+		})),
+	}, Derived: map[string]DerivedField{
+		"fully_open":   derivedKey("position == 100"),
+		"fully_closed": derivedKey("position == 0"),
+	}},
+	"humidifier": {Kind: "humidifier", Keys: map[string]KeySchema{
+		"level": requiredKey(rangeKey(typeInt, 0, 100, "%")),
+	}, Derived: map[string]DerivedField{
+		"running": derivedKey("level > 0"),
+	}},
+	// Buttons are momentary and hold no state; see handlePress.
+	"button": {Kind: "button", Keys: map[string]KeySchema{}},
+	"thermostat": {Kind: "thermostat", Keys: map[string]KeySchema{
+		"temperature": requiredKey(withStep(rangeKey(typeFloat, 10, 30, "°C"), 0.5)),
+		"calibration": privateKey(differenceKey(withStep(rangeKey(typeFloat, -5, 5, "°C"), 0.1))),
+	}},
+}
+
+// schemaKind names the schema d's state follows: its kind, qualified by the
+// sensor type for sensors, e.g. "sensor:temperature".
+func (d Device) schemaKind() string {
+	if d.SensorType == "" {
+		return d.Kind
+	}
+	return d.Kind + ":" + d.SensorType
+}
+
+// schemaFor returns the schema for a kind as named by schemaKind.
+func schemaFor(kind string) (KindSchema, bool) {
+	base, sensorType, typed := strings.Cut(kind, ":")
+	schema, ok := kindSchemas[base]
+	if !ok || !typed {
+		return schema, ok
+	}
+	schema, ok = schema.SensorTypes[sensorType]
+	return schema, ok
+}
+
+func lookupKey(kind, key string) (KeySchema, bool) {
+	schema, ok := schemaFor(kind)
+	if !ok {
+		return KeySchema{}, false
+	}
+	keySchema, ok := schema.Keys[key]
+	return keySchema, ok
+}
+
+// normalizeState returns a normalized copy of state for the given kind without
+// touching the input map.
+func normalizeState(kind string, state map[string]interface{}) (map[string]interface{}, error) {
+	normalized := make(map[string]interface{}, len(state))
+	for key, value := range state {
+		value, err := normalizeValue(kind, key, value)
+		if err != nil {
+			return nil, err
+		}
+		normalized[key] = value
+	}
+	return normalized, nil
+}
+
+// normalizeValue coerces value to the type its kind schema declares, clamping
+// numbers to range. Numeric keys reject non-numeric input.
+func normalizeValue(kind, key string, value interface{}) (interface{}, error) {
+	if isDerivedKey(kind, key) {
+		return nil, fmt.Errorf("%w: %s is derived and read-only", errInvalidValue, key)
+	}
+	schema, ok := lookupKey(kind, key)
+	if !ok {
+		return plainNumber(value), nil
+	}
+	if isCelsiusKey(schema) {
+		converted, err := parseTemperature(key, schema, value)
+		if err != nil {
+			return nil, err
+		}
+		value = converted
+	}
+	switch schema.Type {
+	case typeBool:
+		on, ok := parseBool(value)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s must be a boolean", errInvalidValue, key)
+		}
+		return on, nil
+	case typeInt:
+		if !isNumber(value) {
+			return nil, fmt.Errorf("%w: %s must be a number", errInvalidValue, key)
+		}
+		return clampToInt(value, int(*schema.Min), int(*schema.Max)), nil
+	case typeFloat:
+		if !isNumber(value) {
+			return nil, fmt.Errorf("%w: %s must be a number", errInvalidValue, key)
+		}
+		return clampToFloat(value, *schema.Min, *schema.Max), nil
+	case typeString:
+		text, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s must be a string", errInvalidValue, key)
+		}
+		return strings.TrimSpace(text), nil
+	}
+	return value, nil
+}
+
+// isBoolLike reports whether value is a boolean or something toBool reads as
+// one deliberately: a number, or "true", "false", "on", "off", "1", or "0".
+// Other strings, such as "open", are rejected rather than read as false.
+func isBoolLike(value interface{}) bool {
+	_, ok := parseBool(value)
+	return ok
+}
+
+// parseBool reads value as a boolean: a number is true unless zero, and the
+// strings above are matched ignoring case and surrounding space. ok is false
+// for anything else.
+func parseBool(value interface{}) (on, ok bool) {
+	switch v := value.(type) {
+	case bool:
+		return v, true
+	case string:
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "true", "on", "1":
+			return true, true
+		case "false", "off", "0":
+			return false, true
+		}
+		return false, false
+	case json.Number:
+		number, err := v.Float64()
+		return err == nil && number != 0, err == nil
+	}
+	number, ok := toFloat(value)
+	return ok && number != 0, ok
+}
+
+// valueType names the JSON type of a state value.
+func valueType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	}
+	if isNumber(value) {
+		return "number"
+	}
+	return "unknown"
+}
+
+// checkValueTypes keeps the type of keys outside the kind schema stable: a key
+// that holds a number can only be set to another number, and so on. Keys in
+// the schema are checked against their declared type by normalizeValue, and
+// null may replace or be replaced by anything.
+func checkValueTypes(device *Device, state map[string]interface{}) error {
+	for key, value := range state {
+		if _, ok := lookupKey(device.schemaKind(), key); ok {
+			continue
+		}
+		current, ok := device.State[key]
+		if !ok || current == nil || value == nil {
+			continue
+		}
+		if was, got := valueType(current), valueType(value); was != got {
+			return fmt.Errorf("%w: %s holds a %s, got a %s", errInvalidValue, key, was, got)
+		}
+	}
+	return nil
+}
+
+// isRequiredKey reports whether key may not be removed from kind's state.
+func isRequiredKey(kind, key string) bool {
+	schema, ok := lookupKey(kind, key)
+	return ok && schema.Required
+}
+
+// isPrivateKey reports whether key is hidden from non-admin clients of kind.
+func isPrivateKey(kind, key string) bool {
+	schema, ok := lookupKey(kind, key)
+	return ok && schema.Private
+}
+
+// isBoolKey reports whether key is normalized as a boolean for kind.
+func isBoolKey(kind, key string) bool {
+	schema, ok := lookupKey(kind, key)
+	return ok && schema.Type == typeBool
+}
+
+func isNumber(value interface{}) bool {
+	switch number := value.(type) {
+	case int, int64, float64, float32:
+		return true
+	case json.Number:
+		_, err := number.Float64()
+		return err == nil
+	}
+	return false
+}
+
+func handleKinds(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, kindList())
+}
+
+// kindList returns every kind's schema, sorted by kind.
+func kindList() []KindSchema {
+	kinds := make([]KindSchema, 0, len(kindSchemas))
+	for _, schema := range kindSchemas {
+		schema.PollInterval = pollIntervals.forKind(schema.Kind).Seconds()
+		kinds = append(kinds, schema)
+	}
+	sort.Slice(kinds, func(i, j int) bool {
+		return kinds[i].Kind < kinds[j].Kind
+	})
+	return kinds
+}
+
+func clampToInt(value interface{}, min, max int) int {
+	switch number := value.(type) {
+	case int:
+		return clampInt(number, min, max)
+	case int64:
+		return clampInt(int(number), min, max)
+	case float64:
+		return clampInt(int(number+0.5), min, max)
+	case float32:
+		return clampInt(int(number+0.5), min, max)
+	case json.Number:
+		if parsed, err := number.Int64(); err == nil {
+			return clampInt(int(parsed), min, max)
+		}
+		if parsed, err := number.Float64(); err == nil {
+			return clampInt(int(parsed+0.5), min, max)
+		}
+	}
+	return min
+}
+
+// plainNumber turns a json.Number from a UseNumber decoder into an int64 when
+// it is integral and a float64 when it has a fraction or exponent, so
+// schema-less keys keep integers exact. Integers too large for int64 stay
+// json.Number, which encodes back verbatim. Other values are returned
+// unchanged.
+func plainNumber(value interface{}) interface{} {
+	number, ok := value.(json.Number)
+	if !ok {
+		return value
+	}
+	if parsed, err := number.Int64(); err == nil {
+		return parsed
+	}
+	if strings.ContainsAny(number.String(), ".eE") {
+		if parsed, err := number.Float64(); err == nil {
+			return parsed
+		}
+	}
+	return number
+}
+
+func clampToFloat(value interface{}, min, max float64) float64 {
+	switch number := value.(type) {
+	case float64:
+		return clampFloat(number, min, max)
+	case float32:
+		return clampFloat(float64(number), min, max)
+	case int:
+		return clampFloat(float64(number), min, max)
+	case int64:
+		return clampFloat(float64(number), min, max)
+	case json.Number:
+		if parsed, err := number.Float64(); err == nil {
+			return clampFloat(parsed, min, max)
+		}
+	}
+	return min
+}
+
+func clampInt(value, min, max int) int {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
+
+func clampFloat(value, min, max float64) float64 {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
+
+// toBool reads value as parseBool does, taking anything else as false.
+func toBool(value interface{}) bool {
+	on, _ := parseBool(value)
+	return on
+}
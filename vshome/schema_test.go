@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestBoolParsing(t *testing.T) {
+	tests := []struct {
+		value    interface{}
+		boolLike bool
+		on       bool
+	}{
+		{true, true, true},
+		{false, true, false},
+		{"true", true, true},
+		{"TRUE ", true, true},
+		{" on", true, true},
+		{"On", true, true},
+		{"1 ", true, true},
+		{"off", true, false},
+		{" False", true, false},
+		{"0", true, false},
+		{1, true, true},
+		{0, true, false},
+		{int64(2), true, true},
+		{0.5, true, true},
+		{float32(1), true, true},
+		{float32(0), true, false},
+		{json.Number("1"), true, true},
+		{json.Number("0"), true, false},
+		{"open", false, false},
+		{"", false, false},
+		{nil, false, false},
+		{[]interface{}{true}, false, false},
+	}
+	for _, test := range tests {
+		if boolLike := isBoolLike(test.value); boolLike != test.boolLike {
+			t.Errorf("isBoolLike(%#v) = %v, want %v", test.value, boolLike, test.boolLike)
+		}
+		if on := toBool(test.value); on != test.on {
+			t.Errorf("toBool(%#v) = %v, want %v", test.value, on, test.on)
+		}
+	}
+}
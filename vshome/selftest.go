@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// selfTestStepDelay is how long each self-test step is left on view before
+// the next.
+const selfTestStepDelay = time.Second
+
+var errSelfTestRunning = errors.New("self-test already running")
+
+// SelfTest is a device's self-test as returned by POST /api/devices/{id}/test
+// and /stop-test. Steps are the states it applies in order, the last being
+// the state it started from.
+type SelfTest struct {
+	ID      string                   `json:"id"`
+	Running bool                     `json:"running"`
+	Steps   []map[string]interface{} `json:"steps,omitempty"`
+}
+
+// selfTests holds the cancel function of each device's running self-test.
+var selfTests = struct {
+	sync.Mutex
+	cancel map[string]context.CancelFunc
+}{cancel: make(map[string]context.CancelFunc)}
+
+// selfTestSteps scripts a visible cycle through the required keys of
+// device's kind: booleans flip, ranged numbers sweep to their maximum and
+// then their minimum. Readonly keys such as sensor readings are left alone.
+// It returns nil when there is nothing to exercise.
+func selfTestSteps(device *Device) []map[string]interface{} {
+	schema, ok := schemaFor(device.schemaKind())
+	if !ok {
+		return nil
+	}
+	keys := make([]string, 0, len(schema.Keys))
+	for key := range schema.Keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var steps []map[string]interface{}
+	start := make(map[string]interface{})
+	for _, key := range keys {
+		keySchema := schema.Keys[key]
+		current, ok := device.State[key]
+		if !ok || !keySchema.Required || keySchema.Control.Widget == widgetReadonly {
+			continue
+		}
+		switch {
+		case keySchema.Type == typeBool:
+			steps = append(steps, map[string]interface{}{key: !toBool(current)})
+		case keySchema.Min != nil && keySchema.Max != nil:
+			steps = append(steps, map[string]interface{}{key: *keySchema.Max}, map[string]interface{}{key: *keySchema.Min})
+		default:
+			continue
+		}
+		start[key] = current
+	}
+	if len(steps) == 0 {
+		return nil
+	}
+	return append(steps, start)
+}
+
+// handleSelfTest serves POST /api/devices/{id}/test: it runs the device's
+// self-test steps through the update path, selfTestStepDelay apart, and
+// responds 202 right away. A device runs one self-test at a time.
+func handleSelfTest(w http.ResponseWriter, r *http.Request, id string) {
+	device, ok := store.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "device not found")
+		return
+	}
+	if err := checkOnline(device); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	steps := selfTestSteps(device)
+	if steps == nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("kind %s has nothing to self-test", device.Kind))
+		return
+	}
+	selfTests.Lock()
+	defer selfTests.Unlock()
+	if _, running := selfTests.cancel[id]; running {
+		writeError(w, http.StatusConflict, fmt.Sprintf("%s: %s", errSelfTestRunning, id))
+		return
+	}
+	// Detached from the request, which ends with this response; stop-test
+	// cancels it instead.
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	selfTests.cancel[id] = cancel
+	go runSelfTest(ctx, id, steps)
+	writeJSON(w, http.StatusAccepted, SelfTest{ID: id, Running: true, Steps: steps})
+}
+
+// handleStopSelfTest serves POST /api/devices/{id}/stop-test. The device is
+// put back in the state its self-test started from.
+func handleStopSelfTest(w http.ResponseWriter, r *http.Request, id string) {
+	if _, ok := store.Get(id); !ok {
+		writeError(w, http.StatusNotFound, "device not found")
+		return
+	}
+	selfTests.Lock()
+	if cancel, ok := selfTests.cancel[id]; ok {
+		cancel()
+	}
+	selfTests.Unlock()
+	writeJSON(w, http.StatusOK, SelfTest{ID: id})
+}
+
+func runSelfTest(ctx context.Context, id string, steps []map[string]interface{}) {
+	defer func() {
+		selfTests.Lock()
+		delete(selfTests.cancel, id)
+		selfTests.Unlock()
+	}()
+	for i, step := range steps {
+		if i > 0 {
+			wait := time.NewTimer(selfTestStepDelay)
+			select {
+			case <-ctx.Done():
+				wait.Stop()
+				applySelfTestStep(context.WithoutCancel(ctx), id, steps[len(steps)-1])
+				return
+			case <-wait.C:
+			}
+		}
+		if err := applySelfTestStep(ctx, id, step); err != nil {
+			log.Printf("self-test of %s stopped: %v", id, err)
+			return
+		}
+	}
+}
+
+func applySelfTestStep(ctx context.Context, id string, state map[string]interface{}) error {
+	updated, err := store.Update(ctx, id, state)
+	if err != nil {
+		return err
+	}
+	hub.PublishChange(ctx, WSMessage{Type: "update", Device: updated})
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import "fmt"
+
+// defaultSensorType is assumed for sensors that do not name a type, matching
+// the open/closed sensors catalogs had before sensor types existed.
+const defaultSensorType = "contact"
+
+// sensorTypes are the schemas of the quantities a sensor can report. Numeric
+// types report a single reading under "value", clamped to a range the
+// quantity can plausibly take, in the type's unit.
+var sensorTypes = map[string]KindSchema{
+	"contact": {Kind: "sensor", Keys: map[string]KeySchema{
+		"open": readonlyKey(requiredKey(boolKey())),
+	}},
+	"temperature": {Kind: "sensor", Keys: map[string]KeySchema{
+		"value": readonlyKey(requiredKey(rangeKey(typeFloat, -40, 85, "°C"))),
+	}},
+	"humidity": {Kind: "sensor", Keys: map[string]KeySchema{
+		"value": readonlyKey(requiredKey(rangeKey(typeFloat, 0, 100, "%"))),
+	}},
+	"co2": {Kind: "sensor", Keys: map[string]KeySchema{
+		"value": readonlyKey(requiredKey(rangeKey(typeInt, 0, 10000, "ppm"))),
+	}},
+}
+
+// sensorUnit is the unit of a sensor type's reading, or "" for types without
+// one.
+func sensorUnit(schema KindSchema) string {
+	return schema.Keys["value"].Unit
+}
+
+// validateSensor checks a device's sensor type and unit. Sensors without a
+// type are contact sensors and a missing unit is filled in from the type; a
+// unit that does not match the type is rejected.
+func validateSensor(device *Device) error {
+	if device.Kind != "sensor" {
+		if device.SensorType != "" || device.Unit != "" {
+			return fmt.Errorf("%w: sensor_type and unit only apply to sensors, not %s", errInvalidValue, device.Kind)
+		}
+		return nil
+	}
+	if device.SensorType == "" {
+		device.SensorType = defaultSensorType
+	}
+	schema, ok := sensorTypes[device.SensorType]
+	if !ok {
+		return fmt.Errorf("%w: unknown sensor type %q for %s", errInvalidValue, device.SensorType, device.ID)
+	}
+	unit := sensorUnit(schema)
+	if device.Unit == "" {
+		device.Unit = unit
+	}
+	if device.Unit != unit {
+		return fmt.Errorf("%w: unit of %s sensor %s must be %q, not %q", errInvalidValue, device.SensorType, device.ID, unit, device.Unit)
+	}
+	return nil
+}
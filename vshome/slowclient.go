@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Slow client policies decide what happens when a client's send queue is full
+// or its oldest message has waited longer than the queue age limit.
+const (
+	slowClientDrop       = "drop"
+	slowClientDisconnect = "disconnect"
+)
+
+func validSlowClientPolicy(policy string) error {
+	switch policy {
+	case slowClientDrop, slowClientDisconnect:
+		return nil
+	}
+	return fmt.Errorf("ws slow client policy must be %s or %s", slowClientDrop, slowClientDisconnect)
+}
+
+// queuedMessage is a payload waiting in a client's send queue. A non-zero
+// closeCode closes the connection with that code and closeReason once the
+// payload is written.
+type queuedMessage struct {
+	payload     []byte
+	queued      time.Time
+	closeCode   int
+	closeReason string
+}
+
+// lagging is called when c cannot keep up, for the given reason. Under the
+// drop policy the message at hand is discarded and counted; under disconnect
+// the client is evicted.
+func (c *client) lagging(reason string) {
+	c.dropped.Add(1)
+	if c.slowPolicy != slowClientDisconnect {
+		return
+	}
+	c.evictOnce.Do(func() {
+		log.Printf("websocket client %s evicted: %s", c.remoteAddr, reason)
+		if c.evictions != nil {
+			c.evictions.Add(1)
+		}
+		c.close()
+	})
+}
+
+// WSStats summarizes the hub's connections and slow client handling.
+type WSStats struct {
+	Clients       int    `json:"clients"`
+	Evicted       uint64 `json:"evicted"`
+	Policy        string `json:"slow_client_policy"`
+	QueueSize     int    `json:"queue_size"`
+	QueueMaxAgeMS int64  `json:"queue_max_age_ms"`
+	// Messages counts messages received and sent by type since startup.
+	Messages MessageCounts `json:"messages"`
+}
+
+func (h *Hub) Stats() WSStats {
+	h.mu.Lock()
+	clients := len(h.clients)
+	h.mu.Unlock()
+	return WSStats{
+		Clients:       clients,
+		Evicted:       h.evictions.Load(),
+		Policy:        h.slowClient,
+		QueueSize:     h.queueSize,
+		QueueMaxAgeMS: h.queueMaxAge.Milliseconds(),
+		Messages:      h.counts.snapshot(),
+	}
+}
+
+func handleWSStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, hub.Stats())
+}
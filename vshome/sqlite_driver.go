@@ -0,0 +1,7 @@
+//go:build sqlite
+
+package main
+
+// Registers the pure-Go "sqlite" database/sql driver used by SQLiteStore.
+// Build with: go build -tags sqlite
+import _ "modernc.org/sqlite"
@@ -0,0 +1,787 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sqliteDriver is registered by sqlite_driver.go, which is only compiled with
+// the sqlite build tag.
+const sqliteDriver = "sqlite"
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS devices (
+	id        TEXT PRIMARY KEY,
+	position  INTEGER NOT NULL,
+	name      TEXT NOT NULL,
+	kind      TEXT NOT NULL,
+	room      TEXT NOT NULL DEFAULT '',
+	state     TEXT NOT NULL DEFAULT '{}',
+	last_seen TEXT,
+	offline   INTEGER NOT NULL DEFAULT 0,
+	sensor_type TEXT NOT NULL DEFAULT '',
+	unit      TEXT NOT NULL DEFAULT '',
+	firmware  TEXT NOT NULL DEFAULT '',
+	latest_firmware TEXT NOT NULL DEFAULT '',
+	updating  INTEGER NOT NULL DEFAULT 0,
+	travel    TEXT
+)`
+
+// sqliteNameIndex backs GetByName. It is created after migrations so it also
+// covers databases made before it existed.
+const sqliteNameIndex = `CREATE INDEX IF NOT EXISTS devices_name ON devices (name)`
+
+// sqliteScenesSchema holds scenes captured at runtime, their actions as JSON.
+const sqliteScenesSchema = `
+CREATE TABLE IF NOT EXISTS scenes (
+	name    TEXT PRIMARY KEY,
+	actions TEXT NOT NULL
+)`
+
+// sqliteMigrations add columns introduced after the first schema to existing
+// databases.
+var sqliteMigrations = []struct{ column, definition string }{
+	{"last_seen", "TEXT"},
+	{"offline", "INTEGER NOT NULL DEFAULT 0"},
+	{"sensor_type", "TEXT NOT NULL DEFAULT ''"},
+	{"unit", "TEXT NOT NULL DEFAULT ''"},
+	{"firmware", "TEXT NOT NULL DEFAULT ''"},
+	{"latest_firmware", "TEXT NOT NULL DEFAULT ''"},
+	{"updating", "INTEGER NOT NULL DEFAULT 0"},
+	{"travel", "TEXT"},
+}
+
+const deviceColumns = `id, name, kind, room, state, last_seen, offline, sensor_type, unit, firmware, latest_firmware, updating, travel`
+
+// SQLiteStore is a DeviceStore that persists devices, with state kept as a JSON
+// column, so changes survive restarts.
+type SQLiteStore struct {
+	db         *sql.DB
+	maxDevices int
+	authorizer WriteAuthorizer
+	autoIDs    bool
+
+	// initial is kept in memory: the catalog state for catalog devices and the
+	// state at startup or creation for the rest.
+	initialMu sync.RWMutex
+	initial   map[string]map[string]interface{}
+}
+
+var _ DeviceStore = (*SQLiteStore)(nil)
+var _ sceneSaver = (*SQLiteStore)(nil)
+
+// OpenSQLiteStore opens or creates the database at path. When the devices table
+// is empty it is seeded from the YAML catalog; otherwise the stored devices win.
+func OpenSQLiteStore(path string, seed []*Device, maxDevices int) (*SQLiteStore, error) {
+	db, err := sql.Open(sqliteDriver, path)
+	if err != nil {
+		if strings.Contains(err.Error(), "unknown driver") {
+			return nil, errors.New("sqlite support not compiled in, rebuild with -tags sqlite")
+		}
+		return nil, err
+	}
+	// A single connection serializes writers and keeps :memory: databases shared.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("initialize schema: %w", err)
+	}
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate schema: %w", err)
+	}
+	if _, err := db.Exec(sqliteNameIndex); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create name index: %w", err)
+	}
+	if _, err := db.Exec(sqliteScenesSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create scenes table: %w", err)
+	}
+	// A firmware update cut short by a restart never finishes; give the
+	// device back on its old version.
+	if _, err := db.Exec(`UPDATE devices SET updating = 0`); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("reset firmware updates: %w", err)
+	}
+	s := &SQLiteStore{db: db, maxDevices: maxDevices}
+	if err := s.seed(seed); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("seed devices: %w", err)
+	}
+	s.initial = make(map[string]map[string]interface{})
+	for _, device := range s.List() {
+		s.initial[device.ID] = device.State
+	}
+	for _, device := range seed {
+		if _, ok := s.initial[device.ID]; !ok {
+			continue
+		}
+		if state, err := normalizeDeviceState(device, device.State); err == nil {
+			s.initial[device.ID] = state
+		}
+	}
+	return s, nil
+}
+
+func migrateSQLite(db *sql.DB) error {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info('devices')`)
+	if err != nil {
+		return err
+	}
+	existing := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, migration := range sqliteMigrations {
+		if existing[migration.column] {
+			continue
+		}
+		if _, err := db.Exec(`ALTER TABLE devices ADD COLUMN ` + migration.column + ` ` + migration.definition); err != nil {
+			return fmt.Errorf("add column %s: %w", migration.column, err)
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteStore) seed(devices []*Device) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM devices`).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	for _, device := range devices {
+		seeded := cloneDevice(device)
+		state, err := normalizeDeviceState(device, device.State)
+		if err != nil {
+			return fmt.Errorf("%s: %w", device.ID, err)
+		}
+		seeded.State = state
+		if err := insertDevice(tx, seeded); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanDevice(row rowScanner) (*Device, error) {
+	var device Device
+	var state string
+	var lastSeen, travel sql.NullString
+	if err := row.Scan(&device.ID, &device.Name, &device.Kind, &device.Room, &state, &lastSeen, &device.Offline, &device.SensorType, &device.Unit, &device.Firmware, &device.LatestFirmware, &device.Updating, &travel); err != nil {
+		return nil, err
+	}
+	if travel.Valid {
+		if err := json.Unmarshal([]byte(travel.String), &device.Travel); err != nil {
+			return nil, fmt.Errorf("decode travel of %s: %w", device.ID, err)
+		}
+	}
+	if lastSeen.Valid {
+		seen, err := time.Parse(time.RFC3339Nano, lastSeen.String)
+		if err != nil {
+			return nil, fmt.Errorf("decode last_seen of %s: %w", device.ID, err)
+		}
+		device.LastSeen = &seen
+	}
+	// Numbers come back as the memory store keeps them, so an integer a
+	// client wrote is not read back as a float.
+	if err := decodeJSON(strings.NewReader(state), &device.State); err != nil {
+		return nil, fmt.Errorf("decode state of %s: %w", device.ID, err)
+	}
+	if device.State == nil {
+		device.State = map[string]interface{}{}
+	}
+	for key, value := range device.State {
+		device.State[key] = plainNumber(value)
+	}
+	return &device, nil
+}
+
+func getDevice(tx *sql.Tx, id string) (*Device, error) {
+	row := tx.QueryRow(`SELECT `+deviceColumns+` FROM devices WHERE id = ?`, id)
+	device, err := scanDevice(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", errDeviceNotFound, id)
+	}
+	return device, err
+}
+
+func insertDevice(tx *sql.Tx, device *Device) error {
+	state, err := json.Marshal(device.State)
+	if err != nil {
+		return err
+	}
+	var travel sql.NullString
+	if device.Travel != nil {
+		encoded, err := json.Marshal(device.Travel)
+		if err != nil {
+			return err
+		}
+		travel = sql.NullString{String: string(encoded), Valid: true}
+	}
+	_, err = tx.Exec(
+		`INSERT INTO devices (id, position, name, kind, room, state, sensor_type, unit, firmware, latest_firmware, travel)
+		 VALUES (?, (SELECT COALESCE(MAX(position), 0) + 1 FROM devices), ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		device.ID, device.Name, device.Kind, device.Room, string(state), device.SensorType, device.Unit, device.Firmware, device.LatestFirmware, travel,
+	)
+	return err
+}
+
+func saveState(tx *sql.Tx, device *Device) error {
+	state, err := json.Marshal(device.State)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE devices SET state = ? WHERE id = ?`, string(state), device.ID)
+	return err
+}
+
+// withTx runs fn in a transaction, committing only if it succeeds.
+func (s *SQLiteStore) withTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) List() []*Device {
+	return s.queryDevices("list", `SELECT `+deviceColumns+` FROM devices ORDER BY position`)
+}
+
+func (s *SQLiteStore) GetByName(name string) []*Device {
+	return s.queryDevices("get by name", `SELECT `+deviceColumns+` FROM devices WHERE name = ? ORDER BY position`, name)
+}
+
+// queryDevices runs a device query, logging failures as op and skipping rows
+// that cannot be decoded.
+func (s *SQLiteStore) queryDevices(op, query string, args ...interface{}) []*Device {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		log.Printf("sqlite %s failed: %v", op, err)
+		return []*Device{}
+	}
+	defer rows.Close()
+	devices := make([]*Device, 0)
+	for rows.Next() {
+		device, err := scanDevice(rows)
+		if err != nil {
+			log.Printf("sqlite %s failed: %v", op, err)
+			continue
+		}
+		devices = append(devices, device)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("sqlite %s failed: %v", op, err)
+	}
+	return devices
+}
+
+func (s *SQLiteStore) Get(id string) (*Device, bool) {
+	row := s.db.QueryRow(`SELECT `+deviceColumns+` FROM devices WHERE id = ?`, id)
+	device, err := scanDevice(row)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("sqlite get %s failed: %v", id, err)
+		}
+		return nil, false
+	}
+	return device, true
+}
+
+func (s *SQLiteStore) Update(ctx context.Context, id string, state map[string]interface{}) (*Device, error) {
+	var updated *Device
+	err := s.withTx(func(tx *sql.Tx) error {
+		device, err := getDevice(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := checkOnline(device); err != nil {
+			return err
+		}
+		if err := authorizeWrite(ctx, s.authorizer, device, state); err != nil {
+			return err
+		}
+		if err := checkFaults(id, state); err != nil {
+			return err
+		}
+		if err := mergeState(device, state); err != nil {
+			return err
+		}
+		if err := saveState(tx, device); err != nil {
+			return err
+		}
+		updated = device
+		return nil
+	})
+	return updated, err
+}
+
+func (s *SQLiteStore) Patch(ctx context.Context, id string, patch map[string]interface{}) (*Device, error) {
+	var patched *Device
+	err := s.withTx(func(tx *sql.Tx) error {
+		device, err := getDevice(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := checkOnline(device); err != nil {
+			return err
+		}
+		if err := authorizeWrite(ctx, s.authorizer, device, patch); err != nil {
+			return err
+		}
+		if err := checkFaults(id, patch); err != nil {
+			return err
+		}
+		if err := mergePatch(device, patch); err != nil {
+			return err
+		}
+		if err := saveState(tx, device); err != nil {
+			return err
+		}
+		patched = device
+		return nil
+	})
+	return patched, err
+}
+
+func (s *SQLiteStore) Step(ctx context.Context, id string, deltas map[string]float64, percent bool) (*Device, error) {
+	var updated *Device
+	err := s.withTx(func(tx *sql.Tx) error {
+		device, err := getDevice(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := checkOnline(device); err != nil {
+			return err
+		}
+		state, err := stepState(device, deltas, percent)
+		if err != nil {
+			return err
+		}
+		if err := authorizeWrite(ctx, s.authorizer, device, state); err != nil {
+			return err
+		}
+		if err := checkFaults(id, state); err != nil {
+			return err
+		}
+		if err := mergeState(device, state); err != nil {
+			return err
+		}
+		if err := saveState(tx, device); err != nil {
+			return err
+		}
+		updated = device
+		return nil
+	})
+	return updated, err
+}
+
+func (s *SQLiteStore) UpdateMany(ctx context.Context, updates []DeviceUpdate, partial bool) ([]BulkResult, error) {
+	var results []BulkResult
+	err := s.withTx(func(tx *sql.Tx) error {
+		results = make([]BulkResult, 0, len(updates))
+		for _, update := range updates {
+			device, err := getDevice(tx, update.ID)
+			if err == nil {
+				err = checkOnline(device)
+			}
+			if err == nil {
+				err = authorizeWrite(ctx, s.authorizer, device, update.State)
+			}
+			if err == nil {
+				err = checkFaults(update.ID, update.State)
+			}
+			if err == nil {
+				err = checkUpdate(update, device)
+			}
+			if err == nil {
+				err = mergeState(device, update.State)
+			}
+			if err != nil {
+				if !partial || !isClientError(err) {
+					return err
+				}
+				results = append(results, BulkResult{ID: update.ID, Status: statusForError(err), Error: err.Error()})
+				continue
+			}
+			if err := saveState(tx, device); err != nil {
+				return err
+			}
+			results = append(results, BulkResult{ID: update.ID, Status: http.StatusOK, Device: device})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (s *SQLiteStore) ApplyScene(ctx context.Context, scene *Scene) ([]*Device, error) {
+	var updated []*Device
+	err := s.withTx(func(tx *sql.Tx) error {
+		updated = make([]*Device, 0, len(scene.Actions))
+		for _, action := range scene.Actions {
+			device, err := getDevice(tx, action.ID)
+			if err != nil {
+				return err
+			}
+			if err := checkOnline(device); err != nil {
+				return err
+			}
+			if err := validateSceneAction(device.schemaKind(), action); err != nil {
+				return err
+			}
+			state := sceneActionState(device, action)
+			if err := authorizeWrite(ctx, s.authorizer, device, state); err != nil {
+				return err
+			}
+			if err := checkFaults(device.ID, state); err != nil {
+				return err
+			}
+			if err := mergeState(device, state); err != nil {
+				return err
+			}
+			if err := saveState(tx, device); err != nil {
+				return err
+			}
+			updated = append(updated, device)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+func (s *SQLiteStore) Reset(ctx context.Context, kind, room string) ([]*Device, error) {
+	var reset []*Device
+	err := s.withTx(func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT ` + deviceColumns + ` FROM devices ORDER BY position`)
+		if err != nil {
+			return err
+		}
+		var matched []*Device
+		for rows.Next() {
+			device, err := scanDevice(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			if matchesFilter(device, kind, room) {
+				matched = append(matched, device)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		reset = make([]*Device, 0, len(matched))
+		for _, device := range matched {
+			if err := checkOnline(device); err != nil {
+				return err
+			}
+			initial, ok := s.Initial(device.ID)
+			if !ok {
+				initial = device.State
+			}
+			if err := authorizeWrite(ctx, s.authorizer, device, initial); err != nil {
+				return err
+			}
+			if err := checkFaults(device.ID, initial); err != nil {
+				return err
+			}
+			device.State = initial
+			if err := saveState(tx, device); err != nil {
+				return err
+			}
+			reset = append(reset, device)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reset, nil
+}
+
+func (s *SQLiteStore) SaveScene(scene *Scene) error {
+	actions, err := json.Marshal(scene.Actions)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO scenes (name, actions) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET actions = excluded.actions`, scene.Name, string(actions))
+	return err
+}
+
+// CapturedScenes returns the saved scenes in the order they were first
+// captured.
+func (s *SQLiteStore) CapturedScenes() ([]*Scene, error) {
+	rows, err := s.db.Query(`SELECT name, actions FROM scenes ORDER BY rowid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []*Scene
+	for rows.Next() {
+		var name, actions string
+		if err := rows.Scan(&name, &actions); err != nil {
+			return nil, err
+		}
+		scene := &Scene{Name: name}
+		if err := json.Unmarshal([]byte(actions), &scene.Actions); err != nil {
+			return nil, fmt.Errorf("decode scene %s: %w", name, err)
+		}
+		list = append(list, scene)
+	}
+	return list, rows.Err()
+}
+
+func (s *SQLiteStore) Add(device *Device) (*Device, error) {
+	state, err := normalizeDeviceState(device, device.State)
+	if err != nil {
+		return nil, err
+	}
+	created := cloneDevice(device)
+	created.State = state
+	err = s.withTx(func(tx *sql.Tx) error {
+		if created.ID == "" && s.autoIDs && created.Name != "" {
+			var lookupErr error
+			created.ID = uniqueSlug(created.Name, func(id string) bool {
+				exists, err := deviceExists(tx, id)
+				if err != nil {
+					lookupErr = err
+					return false
+				}
+				return exists
+			})
+			if lookupErr != nil {
+				return lookupErr
+			}
+		}
+		if err := validateDevice(created); err != nil {
+			return err
+		}
+		if err := checkStateKeys(&Device{ID: created.ID}, created.State, nil); err != nil {
+			return err
+		}
+		exists, err := deviceExists(tx, created.ID)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("%w: %s", errDeviceExists, created.ID)
+		}
+		if s.maxDevices > 0 {
+			var count int
+			if err := tx.QueryRow(`SELECT COUNT(*) FROM devices`).Scan(&count); err != nil {
+				return err
+			}
+			if count >= s.maxDevices {
+				return fmt.Errorf("%w (%d)", errDeviceLimit, s.maxDevices)
+			}
+		}
+		return insertDevice(tx, created)
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.initialMu.Lock()
+	s.initial[created.ID] = copyState(created.State)
+	s.initialMu.Unlock()
+	return created, nil
+}
+
+func deviceExists(tx *sql.Tx, id string) (bool, error) {
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM devices WHERE id = ?`, id).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (s *SQLiteStore) Delete(ctx context.Context, id string) (*Device, error) {
+	var removed *Device
+	err := s.withTx(func(tx *sql.Tx) error {
+		device, err := getDevice(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := authorizeWrite(ctx, s.authorizer, device, device.State); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM devices WHERE id = ?`, id); err != nil {
+			return err
+		}
+		removed = device
+		return nil
+	})
+	if err == nil {
+		s.initialMu.Lock()
+		delete(s.initial, id)
+		s.initialMu.Unlock()
+	}
+	return removed, err
+}
+
+func (s *SQLiteStore) Initial(id string) (map[string]interface{}, bool) {
+	s.initialMu.RLock()
+	defer s.initialMu.RUnlock()
+	state, ok := s.initial[id]
+	if !ok {
+		return nil, false
+	}
+	return copyState(state), true
+}
+
+func (s *SQLiteStore) Touch(id string) (*Device, error) {
+	var touched *Device
+	err := s.withTx(func(tx *sql.Tx) error {
+		device, err := getDevice(tx, id)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		if _, err := tx.Exec(`UPDATE devices SET last_seen = ? WHERE id = ?`, now.Format(time.RFC3339Nano), id); err != nil {
+			return err
+		}
+		device.LastSeen = &now
+		touched = device
+		return nil
+	})
+	return touched, err
+}
+
+func (s *SQLiteStore) SetOffline(id string, offline bool) (*Device, error) {
+	var changed *Device
+	err := s.withTx(func(tx *sql.Tx) error {
+		device, err := getDevice(tx, id)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE devices SET offline = ? WHERE id = ?`, offline, id); err != nil {
+			return err
+		}
+		device.Offline = offline
+		changed = device
+		return nil
+	})
+	return changed, err
+}
+
+func (s *SQLiteStore) BeginFirmwareUpdate(id string) (*Device, error) {
+	var changed *Device
+	err := s.withTx(func(tx *sql.Tx) error {
+		device, err := getDevice(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := checkOnline(device); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE devices SET updating = 1 WHERE id = ?`, id); err != nil {
+			return err
+		}
+		device.Updating = true
+		changed = device
+		return nil
+	})
+	return changed, err
+}
+
+func (s *SQLiteStore) FinishFirmwareUpdate(id, version string) (*Device, error) {
+	var changed *Device
+	err := s.withTx(func(tx *sql.Tx) error {
+		device, err := getDevice(tx, id)
+		if err != nil {
+			return err
+		}
+		finishFirmwareUpdate(device, version)
+		if _, err := tx.Exec(`UPDATE devices SET updating = 0, firmware = ?, latest_firmware = ? WHERE id = ?`,
+			device.Firmware, device.LatestFirmware, id); err != nil {
+			return err
+		}
+		changed = device
+		return nil
+	})
+	return changed, err
+}
+
+func (s *SQLiteStore) SetInfo(id, name, room string) (*Device, error) {
+	var changed *Device
+	err := s.withTx(func(tx *sql.Tx) error {
+		device, err := getDevice(tx, id)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE devices SET name = ?, room = ? WHERE id = ?`, name, room, id); err != nil {
+			return err
+		}
+		device.Name = name
+		device.Room = room
+		changed = device
+		return nil
+	})
+	return changed, err
+}
+
+func (s *SQLiteStore) Count() int {
+	var count int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM devices`).Scan(&count); err != nil {
+		log.Printf("sqlite count failed: %v", err)
+	}
+	return count
+}
+
+func (s *SQLiteStore) MaxDevices() int {
+	return s.maxDevices
+}
+
+// isClientError reports whether err is a per-entry failure, such as invalid
+// input or an offline device, rather than a storage failure.
+func isClientError(err error) bool {
+	if errors.Is(err, errDeviceOffline) {
+		return true
+	}
+	status := statusForError(err)
+	return status >= 400 && status < 500
+}
@@ -0,0 +1,70 @@
+//go:build sqlite
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func openTestSQLiteStore(t *testing.T, path string) *SQLiteStore {
+	t.Helper()
+	store, err := OpenSQLiteStore(path, testCatalog(), 0)
+	if err != nil {
+		t.Fatalf("open %s: %v", path, err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestSQLiteStoreConformance(t *testing.T) {
+	testDeviceStore(t, openTestSQLiteStore(t, ":memory:"))
+}
+
+func TestSQLiteStorePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vshome.db")
+	store := openTestSQLiteStore(t, path)
+	if _, err := store.Update(context.Background(), "blinds_living", map[string]interface{}{"position": 80}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	store.Close()
+
+	reopened := openTestSQLiteStore(t, path)
+	device, ok := reopened.Get("blinds_living")
+	if !ok {
+		t.Fatal("blinds_living missing after reopening")
+	}
+	if position, _ := toFloat(device.State["position"]); position != 80 {
+		t.Fatalf("position after reopening = %v, want 80 rather than the seed", device.State["position"])
+	}
+}
+
+func TestSQLiteStoreUpdateManyPartial(t *testing.T) {
+	store := openTestSQLiteStore(t, ":memory:")
+	maxStateKeys = 1
+	t.Cleanup(func() { maxStateKeys = 0 })
+	// Only the merge catches a write over the state key limit.
+	updates := []DeviceUpdate{
+		{ID: "light_kitchen", State: map[string]interface{}{"color_temp": 3000}},
+		{ID: "blinds_living", State: map[string]interface{}{"position": 10}},
+	}
+	if _, err := store.UpdateMany(context.Background(), updates, false); err == nil {
+		t.Fatal("atomic batch with a bad entry succeeded")
+	}
+	if device, _ := store.Get("blinds_living"); !stateEquals(device, "position", 45) {
+		t.Fatal("atomic batch applied an entry despite failing")
+	}
+
+	results, err := store.UpdateMany(context.Background(), updates, true)
+	if err != nil {
+		t.Fatalf("partial batch: %v", err)
+	}
+	if len(results) != 2 || results[0].Status != http.StatusConflict || results[1].Status != http.StatusOK {
+		t.Fatalf("partial results = %+v, want 409 then 200", results)
+	}
+	if device, _ := store.Get("blinds_living"); !stateEquals(device, "position", 10) {
+		t.Fatalf("position = %v, want the valid entry applied", device.State["position"])
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// stepState resolves relative deltas against the device's current state into
+// absolute values, which the caller merges through the normal normalization so
+// results are clamped to range. With percent set, every key must be a 0–100
+// percentage key such as a blind's position.
+func stepState(device *Device, deltas map[string]float64, percent bool) (map[string]interface{}, error) {
+	state := make(map[string]interface{}, len(deltas))
+	for key, delta := range deltas {
+		schema, ok := lookupKey(device.schemaKind(), key)
+		if !ok || (schema.Type != typeInt && schema.Type != typeFloat) {
+			return nil, fmt.Errorf("%w: %s is not a numeric key for kind %s", errInvalidValue, key, device.Kind)
+		}
+		if percent && !isPercentKey(schema) {
+			return nil, fmt.Errorf("%w: %s is not a percentage key for kind %s", errInvalidValue, key, device.Kind)
+		}
+		current, ok := toFloat(device.State[key])
+		if !ok {
+			current = *schema.Min
+		}
+		state[key] = current + delta
+	}
+	return state, nil
+}
+
+func isPercentKey(schema KeySchema) bool {
+	return schema.Unit == "%" && schema.Min != nil && *schema.Min == 0 && schema.Max != nil && *schema.Max == 100
+}
+
+// handleStep serves POST /api/devices/{id}/step with either
+// {"step":{"key":delta}} for any numeric key or {"percent":{"key":delta}} for
+// percentage keys.
+func handleStep(w http.ResponseWriter, r *http.Request, id string) {
+	var payload struct {
+		Step    map[string]interface{} `json:"step"`
+		Percent map[string]interface{} `json:"percent"`
+	}
+	if err := decodeJSON(r.Body, &payload); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if (len(payload.Step) == 0) == (len(payload.Percent) == 0) {
+		writeError(w, http.StatusBadRequest, "body needs exactly one of step or percent")
+		return
+	}
+	raw, percent := payload.Step, false
+	if len(payload.Percent) > 0 {
+		raw, percent = payload.Percent, true
+	}
+	deltas := make(map[string]float64, len(raw))
+	for key, value := range raw {
+		delta, ok := toFloat(plainNumber(value))
+		if !ok {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("delta for %s must be a number", key))
+			return
+		}
+		deltas[key] = delta
+	}
+	updated, err := store.Step(r.Context(), id, deltas, percent)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	hub.PublishChange(r.Context(), WSMessage{Type: "update", Device: updated})
+	writeJSON(w, http.StatusOK, visibleDevice(r, updated))
+}
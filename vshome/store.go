@@ -0,0 +1,706 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DeviceStore is the device backend used by the HTTP and WebSocket handlers.
+// Every method returns copies, so callers may keep or modify results freely.
+// State writes are authorized against the identity carried by ctx.
+type DeviceStore interface {
+	List() []*Device
+	Get(id string) (*Device, bool)
+	// GetByName returns the devices named exactly name, in catalog order.
+	GetByName(name string) []*Device
+	Update(ctx context.Context, id string, state map[string]interface{}) (*Device, error)
+	Patch(ctx context.Context, id string, patch map[string]interface{}) (*Device, error)
+	Step(ctx context.Context, id string, deltas map[string]float64, percent bool) (*Device, error)
+	UpdateMany(ctx context.Context, updates []DeviceUpdate, partial bool) ([]BulkResult, error)
+	ApplyScene(ctx context.Context, scene *Scene) ([]*Device, error)
+	// Reset puts every device matching kind and room (either may be empty to
+	// match all) back to its Initial state, all or nothing.
+	Reset(ctx context.Context, kind, room string) ([]*Device, error)
+	Add(device *Device) (*Device, error)
+	Delete(ctx context.Context, id string) (*Device, error)
+	Touch(id string) (*Device, error)
+	SetOffline(id string, offline bool) (*Device, error)
+	SetInfo(id, name, room string) (*Device, error)
+	// BeginFirmwareUpdate marks an online device as updating, and
+	// FinishFirmwareUpdate brings it back on version.
+	BeginFirmwareUpdate(id string) (*Device, error)
+	FinishFirmwareUpdate(id, version string) (*Device, error)
+	// Initial returns the state a device was loaded from the catalog or
+	// created with.
+	Initial(id string) (map[string]interface{}, bool)
+	Count() int
+	MaxDevices() int
+}
+
+// Store is the default in-memory DeviceStore. Operations on a single device
+// hold mu for reading plus that device's own lock, so writes to different
+// devices run concurrently. Add, Delete, SetInfo, and multi-device operations
+// take mu for writing, which excludes everything else.
+type Store struct {
+	mu         sync.RWMutex
+	devices    map[string]*Device
+	locks      map[string]*sync.Mutex
+	initial    map[string]map[string]interface{}
+	byName     map[string][]string
+	order      []string
+	maxDevices int
+	authorizer WriteAuthorizer
+	// autoIDs derives an ID from the name when a created device has none.
+	autoIDs bool
+}
+
+var (
+	errDeviceNotFound = errors.New("device not found")
+	errDeviceExists   = errors.New("device already exists")
+	errDeviceLimit    = errors.New("device limit reached")
+	errStateLimit     = errors.New("state key limit reached")
+	errInvalidDevice  = errors.New("device missing id, name, or kind")
+	errMissingState   = errors.New("missing state")
+	errDeviceOffline  = errors.New("device offline")
+)
+
+var _ DeviceStore = (*Store)(nil)
+
+func NewStore(devices []*Device) *Store {
+	deviceMap := make(map[string]*Device, len(devices))
+	locks := make(map[string]*sync.Mutex, len(devices))
+	initial := make(map[string]map[string]interface{}, len(devices))
+	byName := make(map[string][]string, len(devices))
+	order := make([]string, 0, len(devices))
+	for _, device := range devices {
+		copyDevice := *device
+		copyDevice.State = copyState(device.State)
+		deviceMap[device.ID] = &copyDevice
+		locks[device.ID] = &sync.Mutex{}
+		initial[device.ID] = copyState(device.State)
+		byName[device.Name] = append(byName[device.Name], device.ID)
+		order = append(order, device.ID)
+	}
+	return &Store{devices: deviceMap, locks: locks, initial: initial, byName: byName, order: order}
+}
+
+// lockDevice holds mu for reading and the device's own lock. The returned
+// func releases both.
+func (s *Store) lockDevice(id string) (*Device, func(), error) {
+	s.mu.RLock()
+	device, ok := s.devices[id]
+	if !ok {
+		s.mu.RUnlock()
+		return nil, nil, fmt.Errorf("%w: %s", errDeviceNotFound, id)
+	}
+	lock := s.locks[id]
+	lock.Lock()
+	return device, func() {
+		lock.Unlock()
+		s.mu.RUnlock()
+	}, nil
+}
+
+func (s *Store) List() []*Device {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	devices := make([]*Device, 0, len(s.order))
+	for _, id := range s.order {
+		device, ok := s.devices[id]
+		if !ok {
+			continue
+		}
+		lock := s.locks[id]
+		lock.Lock()
+		devices = append(devices, cloneDevice(device))
+		lock.Unlock()
+	}
+	return devices
+}
+
+func (s *Store) Get(id string) (*Device, bool) {
+	device, unlock, err := s.lockDevice(id)
+	if err != nil {
+		return nil, false
+	}
+	defer unlock()
+	return cloneDevice(device), true
+}
+
+func (s *Store) GetByName(name string) []*Device {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ids := s.byName[name]
+	devices := make([]*Device, 0, len(ids))
+	for _, id := range ids {
+		lock := s.locks[id]
+		lock.Lock()
+		devices = append(devices, cloneDevice(s.devices[id]))
+		lock.Unlock()
+	}
+	return devices
+}
+
+// indexName and unindexName maintain byName; callers hold mu for writing.
+// IDs under a name are kept in catalog order so lookups list them the same
+// way List does.
+func (s *Store) indexName(name, id string) {
+	ids := append(s.byName[name], id)
+	position := make(map[string]int, len(s.order))
+	for i, existing := range s.order {
+		position[existing] = i
+	}
+	sort.SliceStable(ids, func(i, j int) bool {
+		return position[ids[i]] < position[ids[j]]
+	})
+	s.byName[name] = ids
+}
+
+func (s *Store) unindexName(name, id string) {
+	ids := s.byName[name]
+	for i, existing := range ids {
+		if existing == id {
+			ids = append(ids[:i:i], ids[i+1:]...)
+			break
+		}
+	}
+	if len(ids) == 0 {
+		delete(s.byName, name)
+		return
+	}
+	s.byName[name] = ids
+}
+
+func (s *Store) Update(ctx context.Context, id string, state map[string]interface{}) (*Device, error) {
+	device, unlock, err := s.lockDevice(id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if err := checkOnline(device); err != nil {
+		return nil, err
+	}
+	if err := authorizeWrite(ctx, s.authorizer, device, state); err != nil {
+		return nil, err
+	}
+	if err := checkFaults(id, state); err != nil {
+		return nil, err
+	}
+	if err := mergeState(device, state); err != nil {
+		return nil, err
+	}
+	return cloneDevice(device), nil
+}
+
+// Patch applies an RFC 7386 merge patch to the device state.
+func (s *Store) Patch(ctx context.Context, id string, patch map[string]interface{}) (*Device, error) {
+	device, unlock, err := s.lockDevice(id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if err := checkOnline(device); err != nil {
+		return nil, err
+	}
+	if err := authorizeWrite(ctx, s.authorizer, device, patch); err != nil {
+		return nil, err
+	}
+	if err := checkFaults(id, patch); err != nil {
+		return nil, err
+	}
+	if err := mergePatch(device, patch); err != nil {
+		return nil, err
+	}
+	return cloneDevice(device), nil
+}
+
+// Step adds deltas to the current values of numeric keys, reading and writing
+// under one lock so concurrent steps all take effect.
+func (s *Store) Step(ctx context.Context, id string, deltas map[string]float64, percent bool) (*Device, error) {
+	device, unlock, err := s.lockDevice(id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if err := checkOnline(device); err != nil {
+		return nil, err
+	}
+	state, err := stepState(device, deltas, percent)
+	if err != nil {
+		return nil, err
+	}
+	if err := authorizeWrite(ctx, s.authorizer, device, state); err != nil {
+		return nil, err
+	}
+	if err := checkFaults(id, state); err != nil {
+		return nil, err
+	}
+	if err := mergeState(device, state); err != nil {
+		return nil, err
+	}
+	return cloneDevice(device), nil
+}
+
+// Touch records that the device reported in without changing its state. A
+// device taken offline with SetOffline stays offline.
+func (s *Store) Touch(id string) (*Device, error) {
+	device, unlock, err := s.lockDevice(id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	now := time.Now().UTC()
+	device.LastSeen = &now
+	return cloneDevice(device), nil
+}
+
+// SetOffline simulates the device dropping off the network or coming back.
+// Offline devices can still be read but reject state writes.
+func (s *Store) SetOffline(id string, offline bool) (*Device, error) {
+	device, unlock, err := s.lockDevice(id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	device.Offline = offline
+	return cloneDevice(device), nil
+}
+
+func (s *Store) BeginFirmwareUpdate(id string) (*Device, error) {
+	device, unlock, err := s.lockDevice(id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if err := checkOnline(device); err != nil {
+		return nil, err
+	}
+	device.Updating = true
+	return cloneDevice(device), nil
+}
+
+func (s *Store) FinishFirmwareUpdate(id, version string) (*Device, error) {
+	device, unlock, err := s.lockDevice(id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	finishFirmwareUpdate(device, version)
+	return cloneDevice(device), nil
+}
+
+// finishFirmwareUpdate installs version on device, raising its latest
+// firmware if version is newer still.
+func finishFirmwareUpdate(device *Device, version string) {
+	device.Updating = false
+	device.Firmware = version
+	if device.LatestFirmware == "" || compareSemver(version, device.LatestFirmware) > 0 {
+		device.LatestFirmware = version
+	}
+}
+
+// SetInfo changes the display name and room of a device, leaving its state
+// alone.
+func (s *Store) SetInfo(id, name, room string) (*Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	device, ok := s.devices[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errDeviceNotFound, id)
+	}
+	if device.Name != name {
+		s.unindexName(device.Name, id)
+		s.indexName(name, id)
+	}
+	device.Name = name
+	device.Room = room
+	return cloneDevice(device), nil
+}
+
+// UpdateMany applies updates under a single lock. By default it is atomic: if
+// any entry is invalid nothing is applied and the first error is returned. With
+// partial set, valid entries are applied and every entry gets its own result.
+func (s *Store) UpdateMany(ctx context.Context, updates []DeviceUpdate, partial bool) ([]BulkResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !partial {
+		for _, update := range updates {
+			if _, err := s.checkUpdateLocked(ctx, update); err != nil {
+				return nil, err
+			}
+		}
+	}
+	results := make([]BulkResult, 0, len(updates))
+	for _, update := range updates {
+		device, err := s.checkUpdateLocked(ctx, update)
+		if err != nil {
+			results = append(results, BulkResult{ID: update.ID, Status: statusForError(err), Error: err.Error()})
+			continue
+		}
+		if err := mergeState(device, update.State); err != nil {
+			results = append(results, BulkResult{ID: update.ID, Status: statusForError(err), Error: err.Error()})
+			continue
+		}
+		results = append(results, BulkResult{ID: update.ID, Status: http.StatusOK, Device: cloneDevice(device)})
+	}
+	return results, nil
+}
+
+func (s *Store) Reset(ctx context.Context, kind, room string) ([]*Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var matched []*Device
+	for _, id := range s.order {
+		device := s.devices[id]
+		if !matchesFilter(device, kind, room) {
+			continue
+		}
+		if err := checkOnline(device); err != nil {
+			return nil, err
+		}
+		if err := authorizeWrite(ctx, s.authorizer, device, s.initial[id]); err != nil {
+			return nil, err
+		}
+		if err := checkFaults(id, s.initial[id]); err != nil {
+			return nil, err
+		}
+		matched = append(matched, device)
+	}
+	reset := make([]*Device, 0, len(matched))
+	for _, device := range matched {
+		device.State = copyState(s.initial[device.ID])
+		reset = append(reset, cloneDevice(device))
+	}
+	return reset, nil
+}
+
+// matchesFilter reports whether device has kind and is in room, ignoring
+// whichever is empty. Rooms compare case-insensitively.
+func matchesFilter(device *Device, kind, room string) bool {
+	if kind != "" && device.Kind != kind {
+		return false
+	}
+	return room == "" || strings.EqualFold(device.Room, room)
+}
+
+func (s *Store) checkUpdateLocked(ctx context.Context, update DeviceUpdate) (*Device, error) {
+	device, ok := s.devices[update.ID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errDeviceNotFound, update.ID)
+	}
+	if err := checkOnline(device); err != nil {
+		return nil, err
+	}
+	if err := authorizeWrite(ctx, s.authorizer, device, update.State); err != nil {
+		return nil, err
+	}
+	if err := checkFaults(update.ID, update.State); err != nil {
+		return nil, err
+	}
+	if err := checkUpdate(update, device); err != nil {
+		return nil, err
+	}
+	if err := checkValueTypes(device, update.State); err != nil {
+		return nil, fmt.Errorf("%s: %w", update.ID, err)
+	}
+	if err := checkStateKeys(device, update.State, nil); err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+// Add inserts a new device at the end of the catalog, enforcing unique IDs and
+// the configured device limit.
+func (s *Store) Add(device *Device) (*Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if device.ID == "" && s.autoIDs && device.Name != "" {
+		device.ID = uniqueSlug(device.Name, func(id string) bool {
+			_, ok := s.devices[id]
+			return ok
+		})
+	}
+	if err := validateDevice(device); err != nil {
+		return nil, err
+	}
+	if err := checkStateKeys(&Device{ID: device.ID}, device.State, nil); err != nil {
+		return nil, err
+	}
+	if _, ok := s.devices[device.ID]; ok {
+		return nil, fmt.Errorf("%w: %s", errDeviceExists, device.ID)
+	}
+	if s.maxDevices > 0 && len(s.devices) >= s.maxDevices {
+		return nil, fmt.Errorf("%w (%d)", errDeviceLimit, s.maxDevices)
+	}
+	state, err := normalizeDeviceState(device, device.State)
+	if err != nil {
+		return nil, err
+	}
+	copyDevice := *device
+	copyDevice.State = state
+	s.devices[device.ID] = &copyDevice
+	s.locks[device.ID] = &sync.Mutex{}
+	s.initial[device.ID] = copyState(state)
+	s.order = append(s.order, device.ID)
+	s.indexName(device.Name, device.ID)
+	result := copyDevice
+	result.State = copyState(copyDevice.State)
+	return &result, nil
+}
+
+// Delete removes a device and returns its last state. The caller must be
+// allowed to write the device's whole state.
+func (s *Store) Delete(ctx context.Context, id string) (*Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	device, ok := s.devices[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errDeviceNotFound, id)
+	}
+	if err := authorizeWrite(ctx, s.authorizer, device, device.State); err != nil {
+		return nil, err
+	}
+	delete(s.devices, id)
+	delete(s.locks, id)
+	delete(s.initial, id)
+	s.unindexName(device.Name, id)
+	for i, existing := range s.order {
+		if existing == id {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	return device, nil
+}
+
+func (s *Store) Initial(id string) (map[string]interface{}, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	state, ok := s.initial[id]
+	if !ok {
+		return nil, false
+	}
+	return copyState(state), true
+}
+
+func (s *Store) Count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.devices)
+}
+
+func (s *Store) MaxDevices() int {
+	return s.maxDevices
+}
+
+// checkUpdate validates a bulk entry for device independently of the backend.
+func checkUpdate(update DeviceUpdate, device *Device) error {
+	if len(update.State) == 0 {
+		return fmt.Errorf("%w for %s", errMissingState, update.ID)
+	}
+	if _, err := normalizeDeviceState(device, update.State); err != nil {
+		return fmt.Errorf("%s: %w", update.ID, err)
+	}
+	return nil
+}
+
+// maxStateKeys caps how many keys a write may grow a device's state to, 0 for
+// no limit. It is set from the config at startup.
+var maxStateKeys int
+
+// mergeState applies the normalized form of state onto device in place. The
+// device is left untouched if any value is invalid.
+func mergeState(device *Device, state map[string]interface{}) error {
+	return mergeStateRemoving(device, state, nil)
+}
+
+// mergeStateRemoving is mergeState that also deletes the keys in remove,
+// counting them against the state key limit.
+func mergeStateRemoving(device *Device, state map[string]interface{}, remove []string) error {
+	if err := checkValueTypes(device, state); err != nil {
+		return err
+	}
+	normalized, err := normalizeDeviceState(device, state)
+	if err != nil {
+		return err
+	}
+	if err := checkStateKeys(device, normalized, remove); err != nil {
+		return err
+	}
+	for key, value := range normalized {
+		device.State[key] = value
+	}
+	for _, key := range remove {
+		delete(device.State, key)
+	}
+	return nil
+}
+
+// checkStateKeys rejects a write that would leave device with more than
+// maxStateKeys state keys. Writes that add no keys always pass, so a device
+// loaded with more keys than the limit can still be updated.
+func checkStateKeys(device *Device, state map[string]interface{}, remove []string) error {
+	if maxStateKeys <= 0 {
+		return nil
+	}
+	count := len(device.State)
+	for key := range state {
+		if _, ok := device.State[key]; !ok {
+			count++
+		}
+	}
+	for _, key := range remove {
+		if _, ok := device.State[key]; ok {
+			count--
+		}
+	}
+	if count > maxStateKeys && count > len(device.State) {
+		return fmt.Errorf("%w: %s would hold %d state keys, limit is %d", errStateLimit, device.ID, count, maxStateKeys)
+	}
+	return nil
+}
+
+// checkOnline rejects writes to a device that is offline or busy updating its
+// firmware.
+func checkOnline(device *Device) error {
+	if device.Offline {
+		return fmt.Errorf("%w: %s", errDeviceOffline, device.ID)
+	}
+	if device.Updating {
+		return fmt.Errorf("%w: %s", errFirmwareBusy, device.ID)
+	}
+	return nil
+}
+
+// mergePatch applies an RFC 7386 merge patch to device's state: null removes a
+// key, objects merge recursively, and anything else is normalized and set.
+// Required keys of the kind cannot be removed. The state is left unchanged
+// when the patch is rejected.
+func mergePatch(device *Device, patch map[string]interface{}) error {
+	set := make(map[string]interface{}, len(patch))
+	var remove []string
+	for key, value := range patch {
+		switch value := value.(type) {
+		case nil:
+			if isRequiredKey(device.schemaKind(), key) {
+				return fmt.Errorf("%w: %s is required for kind %s", errInvalidValue, key, device.Kind)
+			}
+			remove = append(remove, key)
+		case map[string]interface{}:
+			set[key] = mergePatchObject(device.State[key], value)
+		default:
+			set[key] = value
+		}
+	}
+	return mergeStateRemoving(device, set, remove)
+}
+
+func mergePatchObject(target interface{}, patch map[string]interface{}) map[string]interface{} {
+	existing, _ := target.(map[string]interface{})
+	merged := make(map[string]interface{}, len(existing)+len(patch))
+	for key, value := range existing {
+		merged[key] = value
+	}
+	for key, value := range patch {
+		switch value := value.(type) {
+		case nil:
+			delete(merged, key)
+		case map[string]interface{}:
+			merged[key] = mergePatchObject(merged[key], value)
+		default:
+			merged[key] = value
+		}
+	}
+	return merged
+}
+
+func cloneDevice(device *Device) *Device {
+	copyDevice := *device
+	copyDevice.State = copyState(device.State)
+	return &copyDevice
+}
+
+func validateDevice(device *Device) error {
+	if device.ID == "" || device.Name == "" || device.Kind == "" {
+		return errInvalidDevice
+	}
+	if err := validID(device.ID); err != nil {
+		return err
+	}
+	if err := validateFirmware(device); err != nil {
+		return err
+	}
+	if err := validateTravel(device); err != nil {
+		return err
+	}
+	return validateSensor(device)
+}
+
+// validID keeps device IDs to characters that are safe as a URL path segment
+// or a message-broker topic level, so "/", "+", "#", and spaces are out, as are
+// the empty ID and the "." and ".." that a URL path cleans away.
+func validID(id string) error {
+	switch id {
+	case "":
+		return fmt.Errorf("%w: id must not be empty", errInvalidValue)
+	case ".", "..":
+		return fmt.Errorf("%w: id must not be %q", errInvalidValue, id)
+	}
+	for _, r := range id {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == '-' || r == '.' {
+			continue
+		}
+		return fmt.Errorf("%w: id %q may only contain letters, digits, '_', '-', and '.'", errInvalidValue, id)
+	}
+	return nil
+}
+
+// slugify turns a device name into a URL-safe ID: "Kitchen Lamp" becomes
+// "kitchen-lamp".
+func slugify(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+			continue
+		}
+		dash = true
+	}
+	if b.Len() == 0 {
+		return "device"
+	}
+	return b.String()
+}
+
+// uniqueSlug slugifies name and appends -2, -3, ... until taken reports the ID
+// is free.
+func uniqueSlug(name string, taken func(id string) bool) string {
+	base := slugify(name)
+	id := base
+	for n := 2; taken(id); n++ {
+		id = fmt.Sprintf("%s-%d", base, n)
+	}
+	return id
+}
+
+func copyState(state map[string]interface{}) map[string]interface{} {
+	if state == nil {
+		return map[string]interface{}{}
+	}
+	copyMap := make(map[string]interface{}, len(state))
+	for key, value := range state {
+		copyMap[key] = value
+	}
+	return copyMap
+}
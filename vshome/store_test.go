@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+// testDeviceStore checks that store, freshly loaded with testCatalog, behaves
+// as every DeviceStore must. Backends run it from their own tests; the steps
+// build on each other, so it stops at the first failure.
+func testDeviceStore(t *testing.T, store DeviceStore) {
+	t.Helper()
+	ctx := context.Background()
+
+	if ids := deviceIDs(store.List()); len(ids) != 2 || ids[0] != "light_kitchen" || ids[1] != "blinds_living" {
+		t.Fatalf("List = %v, want catalog order", ids)
+	}
+	if store.Count() != 2 {
+		t.Fatalf("Count = %d, want 2", store.Count())
+	}
+	if _, ok := store.Get("missing"); ok {
+		t.Fatal("Get found an unknown device")
+	}
+	if named := store.GetByName("Kitchen Lights"); len(named) != 1 || named[0].ID != "light_kitchen" {
+		t.Fatalf("GetByName = %v, want light_kitchen", deviceIDs(named))
+	}
+
+	// Single-device writes.
+	updated, err := store.Update(ctx, "light_kitchen", map[string]interface{}{"on": true})
+	if err != nil || updated.State["on"] != true {
+		t.Fatalf("Update = %v, %v; want on", updated, err)
+	}
+	if device, _ := store.Get("light_kitchen"); device.State["on"] != true {
+		t.Fatal("Update was not stored")
+	}
+	updated.State["on"] = false
+	if device, _ := store.Get("light_kitchen"); device.State["on"] != true {
+		t.Fatal("changing a returned device changed the store")
+	}
+	if _, err := store.Update(ctx, "missing", map[string]interface{}{"on": true}); !errors.Is(err, errDeviceNotFound) {
+		t.Fatalf("Update of an unknown device: %v, want errDeviceNotFound", err)
+	}
+	if _, err := store.Update(ctx, "light_kitchen", map[string]interface{}{"on": "maybe"}); !errors.Is(err, errInvalidValue) {
+		t.Fatalf("Update with a bad value: %v, want errInvalidValue", err)
+	}
+	patched, err := store.Patch(ctx, "light_kitchen", map[string]interface{}{"color_temp": 3000})
+	if err != nil || !stateEquals(patched, "color_temp", 3000) || patched.State["on"] != true {
+		t.Fatalf("Patch = %v, %v; want color_temp added and on kept", patched, err)
+	}
+	if _, err := store.Patch(ctx, "light_kitchen", map[string]interface{}{"on": nil}); !errors.Is(err, errInvalidValue) {
+		t.Fatalf("Patch removing a required key: %v, want errInvalidValue", err)
+	}
+	if _, err := store.Update(ctx, "blinds_living", map[string]interface{}{"count": json.Number(bigInteger)}); err != nil {
+		t.Fatalf("Update with a schema-less integer: %v", err)
+	}
+	if device, _ := store.Get("blinds_living"); fmt.Sprint(device.State["count"]) != bigInteger {
+		t.Fatalf("count read back as %v, want exactly %s", device.State["count"], bigInteger)
+	}
+	stepped, err := store.Step(ctx, "blinds_living", map[string]float64{"position": 10}, false)
+	if err != nil || !stateEquals(stepped, "position", 55) {
+		t.Fatalf("Step = %v, %v; want position 55", stepped, err)
+	}
+
+	// Bulk writes are atomic unless partial.
+	bad := []DeviceUpdate{
+		{ID: "blinds_living", State: map[string]interface{}{"position": 20}},
+		{ID: "missing", State: map[string]interface{}{"on": true}},
+	}
+	if _, err := store.UpdateMany(ctx, bad, false); !errors.Is(err, errDeviceNotFound) {
+		t.Fatalf("atomic UpdateMany: %v, want errDeviceNotFound", err)
+	}
+	if device, _ := store.Get("blinds_living"); !stateEquals(device, "position", 55) {
+		t.Fatal("atomic UpdateMany applied an entry of a failed batch")
+	}
+	results, err := store.UpdateMany(ctx, bad, true)
+	if err != nil || len(results) != 2 || results[0].Status != http.StatusOK || results[1].Status != http.StatusNotFound {
+		t.Fatalf("partial UpdateMany = %+v, %v; want 200 then 404", results, err)
+	}
+
+	// Scenes and resets.
+	scene := &Scene{Name: "test", Actions: []*SceneAction{
+		{ID: "light_kitchen", Toggle: "on"},
+		{ID: "blinds_living", State: map[string]interface{}{"position": 0}},
+	}}
+	applied, err := store.ApplyScene(ctx, scene)
+	if err != nil || len(applied) != 2 || applied[0].State["on"] != false || !stateEquals(applied[1], "position", 0) {
+		t.Fatalf("ApplyScene = %v, %v; want the light toggled off and the blind closed", applied, err)
+	}
+	reset, err := store.Reset(ctx, "blind", "")
+	if err != nil || len(reset) != 1 || !stateEquals(reset[0], "position", 45) {
+		t.Fatalf("Reset = %v, %v; want the blind back at 45", reset, err)
+	}
+	if initial, ok := store.Initial("light_kitchen"); !ok || initial["on"] != false {
+		t.Fatalf("Initial = %v, want the catalog state", initial)
+	}
+
+	// Offline devices and firmware updates refuse writes.
+	if device, err := store.SetOffline("blinds_living", true); err != nil || !device.Offline {
+		t.Fatalf("SetOffline = %v, %v", device, err)
+	}
+	if _, err := store.Update(ctx, "blinds_living", map[string]interface{}{"position": 5}); !errors.Is(err, errDeviceOffline) {
+		t.Fatalf("Update of an offline device: %v, want errDeviceOffline", err)
+	}
+	if device, err := store.Touch("blinds_living"); err != nil || !device.Offline || device.LastSeen == nil {
+		t.Fatalf("Touch = %v, %v; want it seen but still offline", device, err)
+	}
+	if device, err := store.SetOffline("blinds_living", false); err != nil || device.Offline {
+		t.Fatalf("SetOffline = %v, %v; want it back online", device, err)
+	}
+	if device, err := store.BeginFirmwareUpdate("light_kitchen"); err != nil || !device.Updating {
+		t.Fatalf("BeginFirmwareUpdate = %v, %v", device, err)
+	}
+	if _, err := store.Update(ctx, "light_kitchen", map[string]interface{}{"on": true}); !errors.Is(err, errFirmwareBusy) {
+		t.Fatalf("Update during a firmware update: %v, want errFirmwareBusy", err)
+	}
+	if device, err := store.FinishFirmwareUpdate("light_kitchen", "2.0.0"); err != nil || device.Updating || device.Firmware != "2.0.0" {
+		t.Fatalf("FinishFirmwareUpdate = %v, %v", device, err)
+	}
+
+	// Catalog changes.
+	if device, err := store.SetInfo("light_kitchen", "Pantry Lights", "Pantry"); err != nil || device.Room != "Pantry" {
+		t.Fatalf("SetInfo = %v, %v", device, err)
+	}
+	if named := store.GetByName("Pantry Lights"); len(named) != 1 {
+		t.Fatal("GetByName missed a renamed device")
+	}
+	if named := store.GetByName("Kitchen Lights"); len(named) != 0 {
+		t.Fatal("GetByName still finds a device by its old name")
+	}
+	added, err := store.Add(&Device{ID: "lock_front", Name: "Front Door", Kind: "lock", State: map[string]interface{}{"locked": true}})
+	if err != nil || added.ID != "lock_front" || store.Count() != 3 {
+		t.Fatalf("Add = %v, %v; count %d", added, err, store.Count())
+	}
+	if ids := deviceIDs(store.List()); ids[len(ids)-1] != "lock_front" {
+		t.Fatalf("List = %v, want the added device last", ids)
+	}
+	if _, err := store.Add(&Device{ID: "lock_front", Name: "Front Door", Kind: "lock", State: map[string]interface{}{"locked": true}}); !errors.Is(err, errDeviceExists) {
+		t.Fatalf("Add of a duplicate: %v, want errDeviceExists", err)
+	}
+	if _, err := store.Delete(ctx, "lock_front"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, ok := store.Get("lock_front"); ok || store.Count() != 2 {
+		t.Fatal("Delete left the device behind")
+	}
+	if _, err := store.Delete(ctx, "lock_front"); !errors.Is(err, errDeviceNotFound) {
+		t.Fatalf("second Delete: %v, want errDeviceNotFound", err)
+	}
+}
+
+func TestStore(t *testing.T) {
+	testDeviceStore(t, NewStore(testCatalog()))
+}
+
+func TestDeleteNeedsWriteAccess(t *testing.T) {
+	store := NewStore(testCatalog())
+	rules := NewWriteRules()
+	rules.ForKind("toggle", allowOnly([]string{roleAdmin}, nil))
+	store.authorizer = rules
+
+	for _, identity := range []Identity{anonymousIdentity, {Name: "kiosk", Role: roleViewer}} {
+		_, err := store.Delete(withIdentity(context.Background(), identity), "light_kitchen")
+		if status := statusForError(err); status != http.StatusForbidden {
+			t.Errorf("Delete as %s: %v (status %d), want 403", identity.Name, err, status)
+		}
+	}
+	if _, ok := store.Get("light_kitchen"); !ok {
+		t.Fatal("a refused Delete removed the device")
+	}
+	if _, err := store.Delete(withIdentity(context.Background(), Identity{Name: "root", Role: roleAdmin}), "light_kitchen"); err != nil {
+		t.Fatalf("Delete as admin: %v", err)
+	}
+}
+
+func TestValidID(t *testing.T) {
+	tests := []struct {
+		id    string
+		valid bool
+	}{
+		{"light_kitchen", true},
+		{"Blinds-2.east", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"...", true},
+		{"a/b", false},
+		{"a+b", false},
+		{"a#b", false},
+		{"a?b", false},
+		{"a b", false},
+		{" light", false},
+	}
+	for _, test := range tests {
+		err := validID(test.id)
+		if test.valid && err != nil {
+			t.Errorf("validID(%q) = %v, want valid", test.id, err)
+		}
+		if !test.valid && !errors.Is(err, errInvalidValue) {
+			t.Errorf("validID(%q) = %v, want errInvalidValue", test.id, err)
+		}
+	}
+}
+
+// benchmarkDevices is enough toggles for every parallel benchmark goroutine
+// to have its own.
+const benchmarkDevices = 256
+
+// BenchmarkStoreUpdate compares updates that all contend for one device's
+// lock with updates spread over many devices, which the per-device locks
+// let run concurrently.
+func BenchmarkStoreUpdate(b *testing.B) {
+	devices := make([]*Device, 0, benchmarkDevices)
+	for i := 0; i < benchmarkDevices; i++ {
+		devices = append(devices, &Device{ID: fmt.Sprintf("light_%d", i), Name: fmt.Sprintf("Light %d", i), Kind: "toggle", State: map[string]interface{}{"on": false}})
+	}
+	ctx := context.Background()
+
+	b.Run("same device", func(b *testing.B) {
+		store := NewStore(devices)
+		b.RunParallel(func(pb *testing.PB) {
+			on := false
+			for pb.Next() {
+				on = !on
+				if _, err := store.Update(ctx, "light_0", map[string]interface{}{"on": on}); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+
+	b.Run("different devices", func(b *testing.B) {
+		store := NewStore(devices)
+		var next atomic.Int64
+		b.RunParallel(func(pb *testing.PB) {
+			id := fmt.Sprintf("light_%d", next.Add(1)%benchmarkDevices)
+			on := false
+			for pb.Next() {
+				on = !on
+				if _, err := store.Update(ctx, id, map[string]interface{}{"on": on}); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
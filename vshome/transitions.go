@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const defaultTransitionInterval = 250 * time.Millisecond
+
+// TransitionConfig makes a numeric key of a kind change gradually at Rate units
+// per second. With Simulate set the hub broadcasts intermediate values every
+// Interval instead of jumping straight to the target.
+type TransitionConfig struct {
+	Kind     string        `yaml:"kind"`
+	Key      string        `yaml:"key"`
+	Rate     float64       `yaml:"rate"`
+	Simulate bool          `yaml:"simulate"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Transition describes a gradual change that accompanies an update broadcast.
+type Transition struct {
+	From       interface{} `json:"from"`
+	Target     interface{} `json:"target"`
+	DurationMS int64       `json:"duration_ms"`
+}
+
+type transitionTable map[string]map[string]TransitionConfig
+
+func newTransitionTable(configs []TransitionConfig) (transitionTable, error) {
+	table := transitionTable{}
+	for _, config := range configs {
+		schema, ok := lookupKey(config.Kind, config.Key)
+		if !ok || (schema.Type != typeInt && schema.Type != typeFloat) {
+			return nil, fmt.Errorf("transition for %s.%s: not a numeric key", config.Kind, config.Key)
+		}
+		if config.Rate <= 0 {
+			return nil, fmt.Errorf("transition for %s.%s: rate must be positive", config.Kind, config.Key)
+		}
+		if config.Interval <= 0 {
+			config.Interval = defaultTransitionInterval
+		}
+		if table[config.Kind] == nil {
+			table[config.Kind] = map[string]TransitionConfig{}
+		}
+		table[config.Kind][config.Key] = config
+	}
+	return table, nil
+}
+
+// simulation is one running stream of intermediate values for a device key.
+// It is owned by the hub goroutine; the stepping goroutine only reads from,
+// target and cancel.
+type simulation struct {
+	id     string
+	key    string
+	from   float64
+	target float64
+	value  float64
+	cancel chan struct{}
+}
+
+func simulationKey(id, key string) string {
+	return id + "/" + key
+}
+
+// applyTransitions runs on the hub goroutine for every real update. It attaches
+// transition metadata for configured keys whose value moved and, for simulated
+// keys, starts streaming intermediate values from where the device currently is.
+func (h *Hub) applyTransitions(message *WSMessage) {
+	device := message.Device
+	previous := h.lastDevice[device.ID]
+	h.lastDevice[device.ID] = cloneDevice(device)
+	configs := h.transitions[device.Kind]
+	if previous == nil || len(configs) == 0 {
+		return
+	}
+	var shown *Device
+	for key, config := range configs {
+		running := h.simulations[simulationKey(device.ID, key)]
+		from, okFrom := toFloat(previous.State[key])
+		if running != nil {
+			from = running.value
+		}
+		target, okTarget := toFloat(device.State[key])
+		if !okFrom || !okTarget || from == target {
+			continue
+		}
+		duration := time.Duration(math.Abs(target-from) / config.Rate * float64(time.Second))
+		if message.Transition == nil {
+			message.Transition = map[string]Transition{}
+		}
+		message.Transition[key] = Transition{
+			From:       roundLike(device.State[key], from),
+			Target:     device.State[key],
+			DurationMS: duration.Milliseconds(),
+		}
+		if !config.Simulate {
+			continue
+		}
+		if running != nil {
+			close(running.cancel)
+		}
+		sim := &simulation{id: device.ID, key: key, from: from, target: target, value: from, cancel: make(chan struct{})}
+		h.simulations[simulationKey(device.ID, key)] = sim
+		go h.runSimulation(sim, config.Interval, duration)
+		if shown == nil {
+			shown = cloneDevice(device)
+		}
+		shown.State[key] = roundLike(device.State[key], from)
+	}
+	if shown != nil {
+		message.Device = shown
+	}
+}
+
+// runSimulation publishes the interpolated value every interval until the
+// target is reached or a newer update cancels it.
+func (h *Hub) runSimulation(sim *simulation, interval, duration time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	start := time.Now()
+	for {
+		select {
+		case <-sim.cancel:
+			return
+		case <-ticker.C:
+		}
+		elapsed := time.Since(start)
+		value := sim.target
+		if elapsed < duration {
+			value = sim.from + (sim.target-sim.from)*float64(elapsed)/float64(duration)
+		}
+		h.Publish(WSMessage{Type: "update", simulation: sim, simulatedValue: value})
+		if value == sim.target {
+			return
+		}
+	}
+}
+
+// simulatedFrame turns a step published by runSimulation into an update of the
+// latest known device. Steps from a replaced simulation yield nil.
+func (h *Hub) simulatedFrame(message WSMessage) *Device {
+	sim := message.simulation
+	if h.simulations[simulationKey(sim.id, sim.key)] != sim {
+		return nil
+	}
+	latest := h.lastDevice[sim.id]
+	if latest == nil {
+		delete(h.simulations, simulationKey(sim.id, sim.key))
+		return nil
+	}
+	sim.value = message.simulatedValue
+	if sim.value == sim.target {
+		delete(h.simulations, simulationKey(sim.id, sim.key))
+	}
+	frame := cloneDevice(latest)
+	frame.State[sim.key] = roundLike(latest.State[sim.key], sim.value)
+	return frame
+}
+
+// forgetDevice stops any simulations for a removed device.
+func (h *Hub) forgetDevice(id string) {
+	delete(h.lastDevice, id)
+	h.stopSimulations(id)
+}
+
+// stopSimulations cancels the simulations running for the device id.
+func (h *Hub) stopSimulations(id string) {
+	for simKey, sim := range h.simulations {
+		if sim.id == id {
+			close(sim.cancel)
+			delete(h.simulations, simKey)
+		}
+	}
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch number := value.(type) {
+	case int:
+		return float64(number), true
+	case int64:
+		return float64(number), true
+	case float64:
+		return number, true
+	case float32:
+		return float64(number), true
+	}
+	return 0, false
+}
+
+// roundLike converts value to an int when reference is an int.
+func roundLike(reference interface{}, value float64) interface{} {
+	if _, ok := reference.(int); ok {
+		return int(math.Round(value))
+	}
+	return value
+}
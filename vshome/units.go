@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Temperatures are stored and clamped in Celsius. Clients may read them in
+// Fahrenheit, chosen per request or connection, and write either unit by
+// marking the value, e.g. "72F".
+const (
+	unitCelsius    = "C"
+	unitFahrenheit = "F"
+	// unitAuto picks Fahrenheit for clients whose Accept-Language names a
+	// region that uses it, and Celsius for everyone else.
+	unitAuto = "auto"
+
+	celsiusSymbol    = "°C"
+	fahrenheitSymbol = "°F"
+)
+
+// temperatureUnit is the configured default, set from the config at startup.
+var temperatureUnit = unitCelsius
+
+// fahrenheitRegions are the Accept-Language regions unitAuto reads in
+// Fahrenheit.
+var fahrenheitRegions = map[string]bool{"US": true, "LR": true, "MM": true, "BS": true, "BZ": true, "KY": true, "PW": true}
+
+func validTemperatureUnit(unit string) error {
+	switch unit {
+	case unitCelsius, unitFahrenheit, unitAuto:
+		return nil
+	}
+	return fmt.Errorf("temperature unit must be %s, %s, or %s, not %q", unitCelsius, unitFahrenheit, unitAuto, unit)
+}
+
+// requestUnit returns the unit r should read temperatures in: its ?unit= if
+// that is C or F, otherwise the configured unit, resolved against
+// Accept-Language when that is auto.
+func requestUnit(r *http.Request) string {
+	switch unit := strings.ToUpper(r.URL.Query().Get("unit")); unit {
+	case unitCelsius, unitFahrenheit:
+		return unit
+	}
+	if temperatureUnit != unitAuto {
+		return temperatureUnit
+	}
+	tag, _, _ := strings.Cut(r.Header.Get("Accept-Language"), ",")
+	tag, _, _ = strings.Cut(tag, ";")
+	if _, region, ok := strings.Cut(strings.TrimSpace(tag), "-"); ok && fahrenheitRegions[strings.ToUpper(region)] {
+		return unitFahrenheit
+	}
+	return unitCelsius
+}
+
+func isCelsiusKey(schema KeySchema) bool {
+	return schema.Unit == celsiusSymbol
+}
+
+// localizeDevice returns device with its Celsius keys in unit and its unit
+// set to say so, or device itself when it has no temperatures.
+func localizeDevice(device *Device, unit string) *Device {
+	if device == nil {
+		return nil
+	}
+	kind := device.schemaKind()
+	var localized *Device
+	for key, value := range device.State {
+		schema, ok := lookupKey(kind, key)
+		if !ok || !isCelsiusKey(schema) {
+			continue
+		}
+		if localized == nil {
+			copied := *device
+			copied.State = copyState(device.State)
+			copied.Unit = celsiusSymbol
+			if unit == unitFahrenheit {
+				copied.Unit = fahrenheitSymbol
+			}
+			localized = &copied
+		}
+		if number, ok := toFloat(value); ok && unit == unitFahrenheit {
+			localized.State[key] = roundTenth(toFahrenheit(number, schema.difference))
+		}
+	}
+	if localized == nil {
+		return device
+	}
+	return localized
+}
+
+// localizeTransitions returns the transitions of a device of kind with the
+// endpoints of its Celsius keys in unit.
+func localizeTransitions(kind string, transitions map[string]Transition, unit string) map[string]Transition {
+	if unit != unitFahrenheit || len(transitions) == 0 {
+		return transitions
+	}
+	localized := make(map[string]Transition, len(transitions))
+	for key, transition := range transitions {
+		if schema, ok := lookupKey(kind, key); ok && isCelsiusKey(schema) {
+			if from, ok := toFloat(transition.From); ok {
+				transition.From = roundTenth(toFahrenheit(from, schema.difference))
+			}
+			if target, ok := toFloat(transition.Target); ok {
+				transition.Target = roundTenth(toFahrenheit(target, schema.difference))
+			}
+		}
+		localized[key] = transition
+	}
+	return localized
+}
+
+// localizeState returns state, of a device of kind, with its Celsius keys in
+// unit. It is state itself when nothing needs converting.
+func localizeState(kind string, state map[string]interface{}, unit string) map[string]interface{} {
+	if unit != unitFahrenheit {
+		return state
+	}
+	var localized map[string]interface{}
+	for key, value := range state {
+		schema, ok := lookupKey(kind, key)
+		if !ok || !isCelsiusKey(schema) {
+			continue
+		}
+		number, ok := toFloat(value)
+		if !ok {
+			continue
+		}
+		if localized == nil {
+			localized = copyState(state)
+		}
+		localized[key] = roundTenth(toFahrenheit(number, schema.difference))
+	}
+	if localized == nil {
+		return state
+	}
+	return localized
+}
+
+func localizeDevices(devices []*Device, unit string) []*Device {
+	localized := make([]*Device, 0, len(devices))
+	for _, device := range devices {
+		localized = append(localized, localizeDevice(device, unit))
+	}
+	return localized
+}
+
+// parseTemperature reads a Celsius key written with a unit marker, such as
+// "72F", "72 °F", or "22.5C", returning it in Celsius.
+func parseTemperature(key string, schema KeySchema, value interface{}) (interface{}, error) {
+	text, ok := value.(string)
+	if !ok {
+		return value, nil
+	}
+	text = strings.TrimSpace(text)
+	upper := strings.ToUpper(text)
+	unit := unitCelsius
+	switch {
+	case strings.HasSuffix(upper, "F"):
+		unit = unitFahrenheit
+	case !strings.HasSuffix(upper, "C"):
+		return nil, fmt.Errorf("%w: %s must be a number or a temperature such as \"72F\"", errInvalidValue, key)
+	}
+	number, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(text[:len(text)-1], "°")), 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s must be a number or a temperature such as \"72F\"", errInvalidValue, key)
+	}
+	if unit == unitFahrenheit {
+		number = roundTenth(toCelsius(number, schema.difference))
+	}
+	return number, nil
+}
+
+// toFahrenheit converts a Celsius temperature, or when difference is set a
+// change in temperature such as a calibration offset, which has no zero
+// point to shift.
+func toFahrenheit(celsius float64, difference bool) float64 {
+	if difference {
+		return celsius * 9 / 5
+	}
+	return celsius*9/5 + 32
+}
+
+func toCelsius(fahrenheit float64, difference bool) float64 {
+	if difference {
+		return fahrenheit * 5 / 9
+	}
+	return (fahrenheit - 32) * 5 / 9
+}
+
+func roundTenth(value float64) float64 {
+	return math.Round(value*10) / 10
+}
+
+// Travel is how far a blind moves from closed to open, in meters and in motor
+// encoder counts, so its position can be written in either.
+type Travel struct {
+	Meters float64 `yaml:"meters" json:"meters,omitempty"`
+	Counts float64 `yaml:"counts" json:"counts,omitempty"`
+}
+
+func validateTravel(device *Device) error {
+	if device.Travel == nil {
+		return nil
+	}
+	if device.Travel.Meters < 0 || device.Travel.Counts < 0 {
+		return fmt.Errorf("%w: travel of %s must not be negative", errInvalidValue, device.ID)
+	}
+	return nil
+}
+
+// unitConversion converts a value written to device in an alternate unit to
+// its key's canonical unit.
+type unitConversion func(device *Device, value float64) (float64, error)
+
+// travelPercent converts a distance along a blind's travel, measured by
+// length in unit, to a percentage of it.
+func travelPercent(unit string, length func(Travel) float64) unitConversion {
+	return func(device *Device, value float64) (float64, error) {
+		if device.Travel == nil || length(*device.Travel) <= 0 {
+			return 0, fmt.Errorf("%w: %s has no travel in %s configured", errInvalidValue, device.ID, unit)
+		}
+		return value / length(*device.Travel) * 100, nil
+	}
+}
+
+// convertUnits returns state with every value written as
+// {"value":...,"unit":...} converted to its key's canonical unit, or state
+// itself when there is none. The canonical unit is accepted too; any other
+// unit is rejected.
+func convertUnits(device *Device, state map[string]interface{}) (map[string]interface{}, error) {
+	converted, copied := state, false
+	for key, value := range state {
+		written, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		schema, ok := lookupKey(device.schemaKind(), key)
+		if !ok || len(schema.Units) == 0 {
+			continue
+		}
+		number, unit, err := parseUnitValue(key, written)
+		if err != nil {
+			return nil, err
+		}
+		if unit != schema.Unit {
+			convert, ok := schema.conversions[unit]
+			if !ok {
+				return nil, fmt.Errorf("%w: %s does not accept unit %q, only %s or %s", errInvalidValue, key, unit, schema.Unit, strings.Join(schema.Units, ", "))
+			}
+			if number, err = convert(device, number); err != nil {
+				return nil, err
+			}
+		}
+		if !copied {
+			converted, copied = copyState(state), true
+		}
+		converted[key] = number
+	}
+	return converted, nil
+}
+
+// parseUnitValue reads a value written as {"value":...,"unit":...}.
+func parseUnitValue(key string, written map[string]interface{}) (float64, string, error) {
+	number, isNumber := toFloat(plainNumber(written["value"]))
+	unit, isUnit := written["unit"].(string)
+	if len(written) != 2 || !isNumber || !isUnit {
+		return 0, "", fmt.Errorf("%w: %s must be a number or {\"value\":number,\"unit\":string}", errInvalidValue, key)
+	}
+	return number, strings.TrimSpace(unit), nil
+}
+
+// normalizeDeviceState is normalizeState for a write to device, which may
+// give values in alternate units.
+func normalizeDeviceState(device *Device, state map[string]interface{}) (map[string]interface{}, error) {
+	state, err := convertUnits(device, state)
+	if err != nil {
+		return nil, err
+	}
+	return normalizeState(device.schemaKind(), state)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// catalogReloadDebounce is how long the catalog file must stay quiet before it
+// is read, so a save written in several steps is not loaded half-finished.
+const catalogReloadDebounce = 500 * time.Millisecond
+
+// watchCatalog reloads the device catalog at path whenever it changes on disk.
+// A file that fails to load is logged and ignored, keeping the last good
+// catalog in place.
+func watchCatalog(path string, maxDevices int, allowEmpty bool, defaultRoom string) error {
+	if isCatalogURL(path) {
+		return errors.New("only local catalog files can be watched")
+	}
+	var mu sync.Mutex
+	reload := time.AfterFunc(time.Hour, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		catalog, err := loadDevices(path, maxDevices, allowEmpty, defaultRoom)
+		if err != nil {
+			log.Printf("catalog reload skipped, keeping last good catalog: %v", err)
+			return
+		}
+		previous := loadedDeviceIDs()
+		setLoadedDevices(catalog.Devices)
+		reloadCatalog(systemContext(), previous, catalog)
+	})
+	reload.Stop()
+	return watchFile(path, func() {
+		reload.Reset(catalogReloadDebounce)
+	})
+}
+
+// reloadCatalog brings the store in line with catalog. Devices new to the
+// catalog are added, and devices of the previous catalog that are no longer
+// listed are removed; devices created at runtime are left alone. A device
+// whose kind or sensor type changed is replaced. Devices that remain keep
+// their runtime state and only pick up name and room changes from the file.
+func reloadCatalog(ctx context.Context, previous map[string]bool, catalog *DeviceCatalog) {
+	listed := make(map[string]bool, len(catalog.Devices))
+	for _, device := range catalog.Devices {
+		listed[device.ID] = true
+	}
+	var added, removed, changed int
+	// Removals go first so replacements and additions are not refused by the
+	// device limit.
+	for _, device := range store.List() {
+		if listed[device.ID] || !previous[device.ID] {
+			continue
+		}
+		if reloadRemove(ctx, device.ID) {
+			removed++
+		}
+	}
+	for _, device := range catalog.Devices {
+		current, ok := store.Get(device.ID)
+		switch {
+		case !ok:
+			if reloadAdd(ctx, device) {
+				added++
+			}
+		case current.Kind != device.Kind || current.SensorType != device.SensorType:
+			if reloadRemove(ctx, device.ID) && reloadAdd(ctx, device) {
+				changed++
+			}
+		case current.Name != device.Name || current.Room != device.Room:
+			updated, err := store.SetInfo(device.ID, device.Name, device.Room)
+			if err != nil {
+				log.Printf("catalog reload: update %s failed: %v", device.ID, err)
+				continue
+			}
+			hub.PublishChange(ctx, WSMessage{Type: "renamed", Device: updated})
+			changed++
+		}
+	}
+	log.Printf("catalog reloaded: %d added, %d removed, %d changed", added, removed, changed)
+}
+
+func reloadAdd(ctx context.Context, device *Device) bool {
+	created, err := store.Add(cloneDevice(device))
+	if err != nil {
+		log.Printf("catalog reload: add %s failed: %v", device.ID, err)
+		return false
+	}
+	hub.PublishChange(ctx, WSMessage{Type: "added", Device: created})
+	return true
+}
+
+func reloadRemove(ctx context.Context, id string) bool {
+	removed, err := store.Delete(ctx, id)
+	if err != nil {
+		log.Printf("catalog reload: remove %s failed: %v", id, err)
+		return false
+	}
+	hub.PublishChange(ctx, WSMessage{Type: "removed", Device: removed})
+	return true
+}
@@ -0,0 +1,46 @@
+//go:build fsnotify
+
+package main
+
+// Watches the catalog through fsnotify rather than polling.
+// Build with: go build -tags fsnotify
+import (
+	"log"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchFile calls notify for every write to path. The parent directory is
+// watched rather than the file so saves that replace the file, as most
+// editors do, are still seen.
+func watchFile(path string, notify func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	path = filepath.Clean(path)
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == path && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					notify()
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("catalog watch: %v", err)
+			}
+		}
+	}()
+	return nil
+}
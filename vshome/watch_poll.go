@@ -0,0 +1,38 @@
+//go:build !fsnotify
+
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const catalogPollInterval = time.Second
+
+// watchFile polls path and calls notify whenever its size or modification
+// time changes. Build with -tags fsnotify to use filesystem events instead.
+func watchFile(path string, notify func()) error {
+	path = filepath.Clean(path)
+	last, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for range time.Tick(catalogPollInterval) {
+			info, err := os.Stat(path)
+			if err != nil {
+				if !os.IsNotExist(err) {
+					log.Printf("catalog watch: %v", err)
+				}
+				continue
+			}
+			if info.Size() != last.Size() || !info.ModTime().Equal(last.ModTime()) {
+				last = info
+				notify()
+			}
+		}
+	}()
+	return nil
+}
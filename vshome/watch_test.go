@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestReloadCatalogKeepsRuntimeDevices(t *testing.T) {
+	testHub, testStore := newTestHub(t)
+	previousHub, previousStore := hub, store
+	hub, store = testHub, testStore
+	t.Cleanup(func() { hub, store = previousHub, previousStore })
+
+	if _, err := store.Add(&Device{ID: "lock_front", Name: "Front Door", Kind: "lock", State: map[string]interface{}{"locked": true}}); err != nil {
+		t.Fatal(err)
+	}
+	previous := map[string]bool{"light_kitchen": true, "blinds_living": true}
+	reloadCatalog(systemContext(), previous, &DeviceCatalog{Devices: testCatalog()[:1]})
+
+	if ids := deviceIDs(store.List()); len(ids) != 2 || ids[0] != "light_kitchen" || ids[1] != "lock_front" {
+		t.Fatalf("devices = %v, want the dropped catalog device gone and the runtime one kept", ids)
+	}
+}
@@ -56,6 +56,14 @@ const formatValue = (value) => {
   return String(value);
 };
 
+const sensorLabelFor = (device) => {
+  if (!device.sensor_type || device.sensor_type === 'contact') {
+    return device.state.open ? 'Open' : 'Closed';
+  }
+  const value = formatValue(Number(device.state.value));
+  return device.unit ? `${value} ${device.unit}` : value;
+};
+
 const setStatus = (connected) => {
   wsStatus.textContent = connected ? 'Connected' : 'Disconnected';
   wsDot.classList.toggle('connected', connected);
@@ -74,6 +82,18 @@ const sendSet = (id, state) => {
   );
 };
 
+const sendHold = (id, held) => {
+  if (!socket || socket.readyState !== WebSocket.OPEN) {
+    return;
+  }
+  socket.send(
+    JSON.stringify({
+      type: held ? 'hold' : 'release',
+      id,
+    })
+  );
+};
+
 const currentStateFor = (id) => {
   return deviceState.get(id) || null;
 };
@@ -95,7 +115,7 @@ const buildSwitch = (labelText, checked, onToggle) => {
   return { wrapper, input };
 };
 
-const buildSlider = (labelText, value, min, max, step, onChange) => {
+const buildSlider = (labelText, value, min, max, step, onChange, onHold) => {
   const container = document.createElement('div');
   container.className = 'slider';
   const badge = document.createElement('span');
@@ -113,9 +133,11 @@ const buildSlider = (labelText, value, min, max, step, onChange) => {
   container.appendChild(badge);
   container.appendChild(input);
   container.appendChild(display);
+  input.addEventListener('pointerdown', () => onHold(true));
   input.addEventListener('change', (event) => {
     event.preventDefault();
     onChange(Number(input.value));
+    onHold(false);
   });
   return { container, input, display };
 };
@@ -149,6 +171,15 @@ const indicatorLabelFor = (device, isOn) => {
   return isOn ? 'On' : 'Off';
 };
 
+const setOffline = (root, controls, offline) => {
+  root.classList.toggle('offline', offline);
+  controls.forEach((control) => {
+    if (control.input) {
+      control.input.disabled = offline;
+    }
+  });
+};
+
 const renderDeviceCard = (device) => {
   const card = cardTemplate.content.cloneNode(true);
   const root = card.querySelector('.card');
@@ -191,6 +222,19 @@ const renderDeviceCard = (device) => {
     body.appendChild(wrapper);
     controls.push({ type: 'switch', input, key: 'on' });
     controls.push({ type: 'indicator', text: indicatorText, dot: indicatorDot, key: 'on' });
+    if (device.kind === 'toggle' && device.state.color_temp !== undefined) {
+      const { container, input: tempInput, display } = buildSlider(
+        'Color Temp (K)',
+        Number(device.state.color_temp),
+        2000,
+        6500,
+        100,
+        (value) => sendSet(device.id, { color_temp: value }),
+        (held) => sendHold(device.id, held)
+      );
+      body.appendChild(container);
+      controls.push({ type: 'slider', input: tempInput, display, key: 'color_temp' });
+    }
   } else if (device.kind === 'lock') {
     body.appendChild(indicator);
     indicatorText.textContent = indicatorLabelFor(device, Boolean(device.state.locked));
@@ -207,7 +251,9 @@ const renderDeviceCard = (device) => {
     controls.push({ type: 'switch', input, key: 'locked' });
     controls.push({ type: 'indicator', text: indicatorText, dot: indicatorDot, key: 'locked' });
   } else if (device.kind === 'sensor') {
-    updateBadge(device.state.open ? 'Open' : 'Closed');
+    updateBadge(sensorLabelFor(device));
+  } else if (device.kind === 'button') {
+    updateBadge('Idle');
   } else if (device.kind === 'blind') {
     const { container, input, display } = buildSlider(
       'Position',
@@ -215,7 +261,8 @@ const renderDeviceCard = (device) => {
       0,
       100,
       5,
-      (value) => sendSet(device.id, { position: value })
+      (value) => sendSet(device.id, { position: value }),
+      (held) => sendHold(device.id, held)
     );
     body.appendChild(container);
     controls.push({ type: 'slider', input, display, key: 'position' });
@@ -226,7 +273,8 @@ const renderDeviceCard = (device) => {
       10,
       30,
       0.5,
-      (value) => sendSet(device.id, { temperature: value })
+      (value) => sendSet(device.id, { temperature: value }),
+      (held) => sendHold(device.id, held)
     );
     body.appendChild(container);
     controls.push({ type: 'slider', input, display, key: 'temperature' });
@@ -237,7 +285,8 @@ const renderDeviceCard = (device) => {
       0,
       100,
       5,
-      (value) => sendSet(device.id, { level: value })
+      (value) => sendSet(device.id, { level: value }),
+      (held) => sendHold(device.id, held)
     );
     body.appendChild(container);
     controls.push({ type: 'slider', input, display, key: 'level' });
@@ -263,12 +312,29 @@ const renderDeviceCard = (device) => {
   if (device.kind === 'toggle') {
     root.classList.toggle('light-on', Boolean(device.state.on));
   }
+  setOffline(root, controls, Boolean(device.offline));
 
   return { root, controls };
 };
 
+const flashPressed = (id) => {
+  const badge = cardRefs.get(id)?.root.querySelector('.pill');
+  if (!badge) {
+    return;
+  }
+  badge.textContent = 'Pressed';
+  setTimeout(() => {
+    badge.textContent = 'Idle';
+  }, 1000);
+};
+
 const applyDeviceUpdate = (device) => {
+  const previous = deviceState.get(device.id);
   deviceState.set(device.id, device);
+  if (previous && (previous.name !== device.name || previous.room !== device.room)) {
+    renderDevices(Array.from(deviceState.values()));
+    return;
+  }
 
   const ref = cardRefs.get(device.id);
   if (!ref) {
@@ -295,11 +361,12 @@ const applyDeviceUpdate = (device) => {
   if (device.kind === 'toggle') {
     ref.root.classList.toggle('light-on', Boolean(device.state.on));
   }
+  setOffline(ref.root, ref.controls, Boolean(device.offline));
 
   if (device.kind === 'sensor') {
     const badge = ref.root.querySelector('.pill');
     if (badge) {
-      badge.textContent = device.state.open ? 'Open' : 'Closed';
+      badge.textContent = sensorLabelFor(device);
     }
   }
 
@@ -364,22 +431,85 @@ const renderDevices = (devices) => {
   updateToasterEasterEgg();
 };
 
+// lastSeq is the last broadcast seen, so a reconnect only receives what it
+// missed when the server still has it.
+let lastSeq = null;
+
 const connect = () => {
-  socket = new WebSocket(`${window.location.origin.replace('http', 'ws')}/ws`);
+  const since = lastSeq === null ? '' : `&since=${lastSeq}`;
+  socket = new WebSocket(`${window.location.origin.replace('http', 'ws')}/ws?unit=C${since}`);
 
+  let restarting = false;
   socket.addEventListener('open', () => setStatus(true));
-  socket.addEventListener('close', () => setStatus(false));
+  socket.addEventListener('close', () => {
+    if (!restarting) {
+      setStatus(false);
+    }
+  });
   socket.addEventListener('error', () => setStatus(false));
 
-  socket.addEventListener('message', (event) => {
-    const payload = JSON.parse(event.data);
+  const handleMessage = (payload) => {
+    if (payload.type === 'batch') {
+      (payload.messages || []).forEach(handleMessage);
+      return;
+    }
+    if (payload.seq) {
+      lastSeq = payload.seq;
+    }
+    if (payload.type === 'server_shutdown') {
+      restarting = true;
+      setStatus(false);
+      wsStatus.textContent = 'Server restarting…';
+      setTimeout(connect, (payload.reconnect_after || 2) * 1000);
+    }
     if (payload.type === 'state') {
       renderDevices(payload.devices || []);
     }
-    if (payload.type === 'update' && payload.device) {
+    if (['update', 'liveness', 'renamed', 'firmware', 'released'].includes(payload.type) && payload.device) {
       applyDeviceUpdate(payload.device);
     }
-  });
+    if (payload.type === 'reset') {
+      (payload.devices || []).forEach(applyDeviceUpdate);
+    }
+    if (payload.type === 'event' && payload.event === 'pressed') {
+      flashPressed(payload.id);
+    }
+    if (payload.type === 'added' && payload.device) {
+      deviceState.set(payload.device.id, payload.device);
+      renderDevices(Array.from(deviceState.values()));
+    }
+    if (payload.type === 'removed' && payload.device) {
+      deviceState.delete(payload.device.id);
+      renderDevices(Array.from(deviceState.values()));
+    }
+  };
+
+  socket.addEventListener('message', (event) => handleMessage(JSON.parse(event.data)));
+};
+
+const loadMotd = async () => {
+  try {
+    const response = await fetch('/api/motd');
+    if (!response.ok) {
+      return;
+    }
+    const motd = await response.json();
+    if (motd.server_name) {
+      document.getElementById('motd-name').textContent = motd.server_name;
+      document.title = motd.server_name;
+    }
+    if (motd.message) {
+      document.getElementById('motd-message').textContent = motd.message;
+    }
+    if (motd.logo_url) {
+      const logo = document.getElementById('motd-logo');
+      logo.src = motd.logo_url;
+      logo.hidden = false;
+    }
+  } catch (err) {
+    // Branding is optional; keep the defaults.
+  }
 };
 
+loadMotd();
 connect();
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	webhookQueueSize   = 256
+	webhookTimeout     = 5 * time.Second
+	deadLetterCapacity = 100
+)
+
+// WebhookOptions controls outbound delivery: how often a failed delivery is
+// attempted and how long to wait between attempts. The wait doubles after
+// each failure up to MaxBackoff.
+type WebhookOptions struct {
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+}
+
+// webhookPayload is the JSON body posted for each hub event.
+type webhookPayload struct {
+	Type       EventType `json:"type"`
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Device     *Device   `json:"device,omitempty"`
+}
+
+// DeadLetter is a delivery that was given up on.
+type DeadLetter struct {
+	Time     time.Time       `json:"time"`
+	URL      string          `json:"url"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+// DeadLetterLog keeps the most recent failed deliveries in memory and, when a
+// file is configured, appends every one to it as a JSON line.
+type DeadLetterLog struct {
+	mu      sync.Mutex
+	entries []DeadLetter
+	file    *os.File
+}
+
+var deadLetters = &DeadLetterLog{}
+
+func openDeadLetterLog(path string) (*DeadLetterLog, error) {
+	deadLetterLog := &DeadLetterLog{}
+	if path == "" {
+		return deadLetterLog, nil
+	}
+	file, err := os.OpenFile(filepath.Clean(path), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	deadLetterLog.file = file
+	return deadLetterLog, nil
+}
+
+func (l *DeadLetterLog) Add(entry DeadLetter) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.entries) >= deadLetterCapacity {
+		copy(l.entries, l.entries[1:])
+		l.entries = l.entries[:len(l.entries)-1]
+	}
+	l.entries = append(l.entries, entry)
+	if l.file == nil {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("dead letter encode failed: %v", err)
+		return
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		log.Printf("dead letter write failed: %v", err)
+	}
+}
+
+// Entries returns the retained dead letters, oldest first.
+func (l *DeadLetterLog) Entries() []DeadLetter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := make([]DeadLetter, len(l.entries))
+	copy(entries, l.entries)
+	return entries
+}
+
+func (l *DeadLetterLog) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// webhook delivers payloads to one URL from its own queue, so a slow or failing
+// endpoint never holds up the hub or other endpoints.
+type webhook struct {
+	url     string
+	options WebhookOptions
+	client  *http.Client
+	queue   chan []byte
+}
+
+// parseWebhookURLs reads a comma-separated list of http(s) URLs.
+func parseWebhookURLs(spec string) ([]string, error) {
+	var urls []string
+	for _, raw := range strings.Split(spec, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		parsed, err := url.Parse(raw)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid webhook url %q", raw)
+		}
+		urls = append(urls, raw)
+	}
+	return urls, nil
+}
+
+// startWebhooks forwards every hub event to each URL. It consumes the hub
+// event channel, which drops events rather than block when it is full.
+func startWebhooks(h *Hub, urls []string, options WebhookOptions) {
+	if len(urls) == 0 {
+		return
+	}
+	webhooks := make([]*webhook, 0, len(urls))
+	for _, target := range urls {
+		hook := &webhook{
+			url:     target,
+			options: options,
+			client:  &http.Client{Timeout: webhookTimeout},
+			queue:   make(chan []byte, webhookQueueSize),
+		}
+		go hook.run()
+		webhooks = append(webhooks, hook)
+	}
+	go func() {
+		for event := range h.Events() {
+			payload, err := json.Marshal(webhookPayload{
+				Type:       event.Type,
+				Time:       event.Time.UTC(),
+				RemoteAddr: event.RemoteAddr,
+				Device:     redactDevice(event.Device),
+			})
+			if err != nil {
+				log.Printf("webhook encode failed: %v", err)
+				continue
+			}
+			for _, hook := range webhooks {
+				hook.enqueue(payload)
+			}
+		}
+	}()
+}
+
+func (w *webhook) enqueue(payload []byte) {
+	select {
+	case w.queue <- payload:
+	default:
+		deadLetters.Add(DeadLetter{Time: time.Now().UTC(), URL: w.url, Error: "delivery queue full", Payload: payload})
+	}
+}
+
+func (w *webhook) run() {
+	for payload := range w.queue {
+		w.deliver(payload)
+	}
+}
+
+// deliver posts payload until it succeeds, the endpoint rejects it outright,
+// or the attempts run out, then dead-letters it on failure.
+func (w *webhook) deliver(payload []byte) {
+	backoff := w.options.Backoff
+	var err error
+	attempt := 1
+	for ; ; attempt++ {
+		var retry bool
+		if retry, err = w.post(payload); err == nil {
+			return
+		}
+		if !retry || attempt >= w.options.MaxAttempts {
+			break
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > w.options.MaxBackoff {
+			backoff = w.options.MaxBackoff
+		}
+	}
+	log.Printf("webhook %s gave up after %d attempts: %v", w.url, attempt, err)
+	deadLetters.Add(DeadLetter{Time: time.Now().UTC(), URL: w.url, Attempts: attempt, Error: err.Error(), Payload: payload})
+}
+
+// post makes one delivery attempt. Network errors, timeouts, 5xx, 408, and
+// 429 are worth retrying; any other non-2xx status is not.
+func (w *webhook) post(payload []byte) (retry bool, err error) {
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("unexpected status %s", resp.Status)
+}
+
+func handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	writeList(w, r, deadLetters.Entries())
+}